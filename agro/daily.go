@@ -0,0 +1,164 @@
+package agro
+
+import (
+	"math"
+	"time"
+
+	"github.com/ttocsneb/weather/types"
+	"github.com/ttocsneb/weather/util"
+)
+
+// Samples further apart than this are treated as a gap in the data
+const maxGap = time.Hour
+
+// A day's solar radiation is only trusted if it covers this much of the day
+const minSolarCoverage = 0.8
+
+// Temperatures (°C) that count towards chill hours
+const (
+	chillMin = 0
+	chillMax = 7.2
+)
+
+type Day struct {
+	Start   time.Time
+	End     time.Time
+	Weather Weather
+	// Whether the day is still in progress
+	Partial bool
+	// Whether there is enough data to calculate the evapotranspiration
+	Complete       bool
+	SolarEstimated bool
+	ChillHours     float64
+}
+
+// Sensors that are needed to summarize a day
+var Sensors = []string{
+	types.SensorTemperature,
+	types.SensorHumidity,
+	types.SensorWindSpeed,
+	types.SensorSolarRadiation,
+}
+
+type dayStats struct {
+	min      float64
+	max      float64
+	sum      float64
+	count    int
+	integral float64
+	covered  time.Duration
+}
+
+func newDayStats() dayStats {
+	return dayStats{min: math.Inf(1), max: math.Inf(-1)}
+}
+
+func (self dayStats) mean() float64 {
+	if self.count == 0 {
+		return math.NaN()
+	}
+	return self.sum / float64(self.count)
+}
+
+func (self dayStats) extreme(value float64) float64 {
+	if self.count == 0 {
+		return math.NaN()
+	}
+	return value
+}
+
+// dayIndex finds which day (starting at midnight in loc) a time falls on.
+func dayIndex(days []Day, t time.Time) int {
+	for i, day := range days {
+		if !t.Before(day.Start) && t.Before(day.End) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Summarize splits a station's history into days in loc, starting on the day
+// of start. The last day ends at now and may be partial.
+func Summarize(history map[string]types.SensorSeries, start time.Time, now time.Time, loc *time.Location) []Day {
+	local := start.In(loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+
+	var days []Day
+	for t := midnight; t.Before(now); t = t.AddDate(0, 0, 1) {
+		end := t.AddDate(0, 0, 1)
+		days = append(days, Day{Start: t, End: end})
+	}
+	if len(days) > 0 && days[len(days)-1].End.After(now) {
+		days[len(days)-1].End = now
+		days[len(days)-1].Partial = true
+	}
+
+	stats := make(map[string][]dayStats)
+	for _, name := range Sensors {
+		series, exists := history[name]
+		day_stats := make([]dayStats, len(days))
+		for i := range day_stats {
+			day_stats[i] = newDayStats()
+		}
+		stats[name] = day_stats
+		if !exists {
+			continue
+		}
+
+		for i, t := range series.Times {
+			index := dayIndex(days, t)
+			if index < 0 {
+				continue
+			}
+			value, _ := util.SensorToMetric(series.Values[i], series.Unit, name)
+			s := &day_stats[index]
+			s.min = math.Min(s.min, value)
+			s.max = math.Max(s.max, value)
+			s.sum += value
+			s.count++
+
+			if i+1 < len(series.Times) {
+				next := series.Times[i+1]
+				if next.Sub(t) > maxGap || dayIndex(days, next) != index {
+					continue
+				}
+				next_value, _ := util.SensorToMetric(series.Values[i+1], series.Unit, name)
+				s.integral += (value + next_value) / 2 * next.Sub(t).Seconds()
+				s.covered += next.Sub(t)
+
+				if name == types.SensorTemperature && value >= chillMin && value <= chillMax {
+					days[index].ChillHours += next.Sub(t).Hours()
+				}
+			}
+		}
+	}
+
+	for i := range days {
+		day := &days[i]
+		temperature := stats[types.SensorTemperature][i]
+		humidity := stats[types.SensorHumidity][i]
+		wind := stats[types.SensorWindSpeed][i]
+		solar := stats[types.SensorSolarRadiation][i]
+
+		day.Weather = Weather{
+			TempMin:      temperature.extreme(temperature.min),
+			TempMax:      temperature.extreme(temperature.max),
+			HumidityMin:  humidity.extreme(humidity.min),
+			HumidityMax:  humidity.extreme(humidity.max),
+			HumidityMean: humidity.mean(),
+			WindSpeed:    wind.mean(),
+			Solar:        math.NaN(),
+		}
+		day.Complete = temperature.count > 0
+
+		if solar.covered.Seconds() >= minSolarCoverage*day.End.Sub(day.Start).Seconds() {
+			// Scale up to the whole day to make up for small gaps
+			coverage := solar.covered.Seconds() / day.End.Sub(day.Start).Seconds()
+			day.Weather.Solar = solar.integral / coverage / 1e6
+		} else {
+			day.SolarEstimated = true
+		}
+	}
+
+	return days
+}
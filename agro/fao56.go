@@ -0,0 +1,147 @@
+package agro
+
+import (
+	"math"
+)
+
+// Stefan-Boltzmann constant in MJ/K⁴/m²/day
+const stefanBoltzmann = 4.903e-9
+
+// Wind speed to assume when a station has no anemometer (m/s)
+const defaultWindSpeed = 2
+
+// Height (m) that station anemometers are assumed to be mounted at
+const windHeight = 2
+
+// Weather is the daily summary needed to calculate the reference
+// evapotranspiration. Unknown values are NaN.
+type Weather struct {
+	// °C
+	TempMin float64
+	TempMax float64
+	// %
+	HumidityMin  float64
+	HumidityMax  float64
+	HumidityMean float64
+	// Mean wind speed in m/s
+	WindSpeed float64
+	// Solar radiation in MJ/m²/day
+	Solar float64
+}
+
+// SaturationVapourPressure finds the saturation vapour pressure (kPa) at a
+// temperature (°C).
+func SaturationVapourPressure(temperature float64) float64 {
+	return 0.6108 * math.Exp(17.27*temperature/(temperature+237.3))
+}
+
+// ExtraterrestrialRadiation finds the solar radiation (MJ/m²/day) at the top
+// of the atmosphere for a latitude on a day of the year.
+func ExtraterrestrialRadiation(latitude float64, day int) float64 {
+	phi := latitude * math.Pi / 180
+	j := 2 * math.Pi * float64(day) / 365
+
+	dr := 1 + 0.033*math.Cos(j)
+	declination := 0.409 * math.Sin(j-1.39)
+	// Sunset hour angle, which is clamped for polar days and nights
+	ws := math.Acos(math.Max(-1, math.Min(1, -math.Tan(phi)*math.Tan(declination))))
+
+	return 24 * 60 / math.Pi * 0.0820 * dr *
+		(ws*math.Sin(phi)*math.Sin(declination) +
+			math.Cos(phi)*math.Cos(declination)*math.Sin(ws))
+}
+
+// WindAt2m converts a wind speed measured at a height (m) to the speed at 2 m
+// using a logarithmic wind profile.
+func WindAt2m(speed float64, height float64) float64 {
+	return speed * 4.87 / math.Log(67.8*height-5.42)
+}
+
+// ReferenceET calculates the daily FAO-56 Penman-Monteith reference
+// evapotranspiration (mm) of a station at a latitude and elevation (m). If
+// there is no solar radiation it is estimated from the temperature range with
+// Hargreaves' formula.
+func ReferenceET(weather Weather, latitude float64, elevation float64, day int) float64 {
+	tmean := (weather.TempMax + weather.TempMin) / 2
+
+	pressure := 101.3 * math.Pow((293-0.0065*elevation)/293, 5.26)
+	gamma := 0.000665 * pressure
+	delta := 4098 * SaturationVapourPressure(tmean) / math.Pow(tmean+237.3, 2)
+
+	es_max := SaturationVapourPressure(weather.TempMax)
+	es_min := SaturationVapourPressure(weather.TempMin)
+	es := (es_max + es_min) / 2
+
+	var ea float64
+	switch {
+	case !math.IsNaN(weather.HumidityMin) && !math.IsNaN(weather.HumidityMax):
+		ea = (es_min*weather.HumidityMax/100 + es_max*weather.HumidityMin/100) / 2
+	case !math.IsNaN(weather.HumidityMean):
+		ea = es * weather.HumidityMean / 100
+	default:
+		// The dew point is close to the minimum temperature
+		ea = es_min
+	}
+
+	ra := ExtraterrestrialRadiation(latitude, day)
+	rso := (0.75 + 2e-5*elevation) * ra
+	rs := weather.Solar
+	if math.IsNaN(rs) {
+		rs = 0.16 * math.Sqrt(math.Max(weather.TempMax-weather.TempMin, 0)) * ra
+	}
+	rs = math.Min(rs, rso)
+
+	rns := 0.77 * rs
+	relative := 0.0
+	if rso > 0 {
+		relative = rs / rso
+	}
+	rnl := stefanBoltzmann *
+		(math.Pow(weather.TempMax+273.16, 4) + math.Pow(weather.TempMin+273.16, 4)) / 2 *
+		(0.34 - 0.14*math.Sqrt(ea)) *
+		(1.35*relative - 0.35)
+	rn := rns - rnl
+
+	u2 := float64(defaultWindSpeed)
+	if !math.IsNaN(weather.WindSpeed) {
+		u2 = WindAt2m(weather.WindSpeed, windHeight)
+	}
+
+	et0 := (0.408*delta*rn + gamma*900/(tmean+273)*u2*(es-ea)) /
+		(delta + gamma*(1+0.34*u2))
+	return math.Max(et0, 0)
+}
+
+// GrowingDegreeDays calculates the growing degree days of a day using the
+// modified average method, where temperatures are held between the base and
+// the cap.
+func GrowingDegreeDays(tmin float64, tmax float64, base float64, cap float64) float64 {
+	tmax = math.Max(math.Min(tmax, cap), base)
+	tmin = math.Max(math.Min(tmin, cap), base)
+	return (tmax+tmin)/2 - base
+}
+
+// SoilWater is a bucket model of the water held in the root zone (mm). Rain
+// fills the bucket, evapotranspiration empties it, and anything beyond its
+// capacity drains away.
+type SoilWater struct {
+	Capacity float64
+	Water    float64
+}
+
+// Step adds a day of rain and crop evapotranspiration (mm), returning how much
+// water drained away.
+func (self *SoilWater) Step(rain float64, et float64) float64 {
+	self.Water += rain - et
+	drainage := 0.0
+	if self.Water > self.Capacity {
+		drainage = self.Water - self.Capacity
+		self.Water = self.Capacity
+	}
+	self.Water = math.Max(self.Water, 0)
+	return drainage
+}
+
+func (self SoilWater) Deficit() float64 {
+	return self.Capacity - self.Water
+}
@@ -0,0 +1,228 @@
+package alerts
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/types"
+	"github.com/ttocsneb/weather/util"
+)
+
+var Operators = []string{">", ">=", "<", "<=", "==", "!="}
+
+func Compare(operator string, value float64, threshold float64) bool {
+	switch operator {
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	case "==":
+		return value == threshold
+	case "!=":
+		return value != threshold
+	}
+	return false
+}
+
+func Validate(rule types.AlertRule) error {
+	if rule.Sensor == "" {
+		return errors.New("sensor is required")
+	}
+	if _, exists := util.IndexOf(Operators, &rule.Operator); !exists {
+		return fmt.Errorf("operator must be one of %v", strings.Join(Operators, ", "))
+	}
+	switch rule.Scope {
+	case types.AlertScopeStation:
+		if rule.Server == "" || rule.Station == "" {
+			return errors.New("server and station are required for station rules")
+		}
+	case types.AlertScopeRadius:
+		if rule.Range <= 0 {
+			return errors.New("range must be greater than 0 for radius rules")
+		}
+	case types.AlertScopeRegion:
+		if rule.Country == "" && rule.Region == "" && rule.City == "" && rule.District == "" {
+			return errors.New("at least one of country, region, city, or district is required for region rules")
+		}
+	default:
+		return fmt.Errorf("scope must be one of %v, %v, %v",
+			types.AlertScopeStation, types.AlertScopeRadius, types.AlertScopeRegion)
+	}
+	return nil
+}
+
+func MatchesStation(rule types.AlertRule, station types.StationEntry) bool {
+	switch rule.Scope {
+	case types.AlertScopeStation:
+		return rule.Server == station.Server && rule.Station == station.Station
+	case types.AlertScopeRadius:
+		if station.Updated.IsZero() {
+			// We don't know where this station is
+			return false
+		}
+		d := util.HarvesineDistance(rule.Latitude, rule.Longitude,
+			station.Latitude, station.Longitude)
+		return d <= rule.Range
+	case types.AlertScopeRegion:
+		if station.Updated.IsZero() {
+			return false
+		}
+		matches := func(want string, have string) bool {
+			return want == "" || strings.EqualFold(want, have)
+		}
+		return matches(rule.Country, station.Country) &&
+			matches(rule.Region, station.Region) &&
+			matches(rule.City, station.City) &&
+			matches(rule.District, station.District)
+	}
+	return false
+}
+
+// Evaluate checks a rule against the sensors of an entry. The threshold is
+// converted to metric so that it can be compared with the stored values.
+func Evaluate(rule types.AlertRule, sensors map[string][]types.SensorValue) (bool, float64, string, bool) {
+	values, exists := sensors[rule.Sensor]
+	if !exists || len(values) == 0 {
+		return false, 0, "", false
+	}
+	value, unit := util.SensorToMetric(values[0].Value, values[0].Unit, rule.Sensor)
+	threshold, threshold_unit := util.SensorToMetric(rule.Threshold, rule.Unit, rule.Sensor)
+	if rule.Unit != "" && threshold_unit != unit {
+		return false, value, unit, false
+	}
+	return Compare(rule.Operator, value, threshold), value, unit, true
+}
+
+func fetchStation(db *sql.DB, server string, station string) (types.StationEntry, error) {
+	info, exists, err := database.FetchStationInfo(db, server, station)
+	if err != nil {
+		return types.StationEntry{}, err
+	}
+	if !exists {
+		return types.StationEntry{Server: server, Station: station}, nil
+	}
+	return info, nil
+}
+
+// CheckEntry evaluates every enabled rule against a newly received entry,
+// recording any alerts that start or stop firing.
+func CheckEntry(db *sql.DB, entry types.WeatherEntry) ([]types.AlertEvent, error) {
+	events := []types.AlertEvent{}
+
+	rules, err := database.QueryAlertRules(db, "WHERE enabled = 1")
+	if err != nil {
+		return events, err
+	}
+	if len(rules) == 0 {
+		return events, nil
+	}
+
+	station, err := fetchStation(db, entry.Server, entry.Station)
+	if err != nil {
+		return events, err
+	}
+
+	active, err := database.QueryActiveAlerts(db,
+		"WHERE server.value = ? AND station.value = ?",
+		entry.Server, entry.Station)
+	if err != nil {
+		return events, err
+	}
+	active_rules := make(map[int64]bool)
+	for _, alert := range active {
+		active_rules[alert.Rule] = true
+	}
+
+	for _, rule := range rules {
+		if !MatchesStation(rule, station) {
+			continue
+		}
+		firing, value, unit, ok := Evaluate(rule, entry.Sensors)
+		if !ok || firing == active_rules[rule.ID] {
+			continue
+		}
+
+		event := types.AlertEvent{
+			Rule:    rule.ID,
+			Server:  entry.Server,
+			Station: entry.Station,
+			Time:    entry.Time.UTC(),
+			Firing:  firing,
+			Value:   value,
+			Unit:    unit,
+		}
+
+		if firing {
+			err = database.SetActiveAlert(db, types.ActiveAlert{
+				Rule:    rule.ID,
+				Server:  entry.Server,
+				Station: entry.Station,
+				Since:   entry.Time.UTC(),
+				Value:   value,
+				Unit:    unit,
+			})
+		} else {
+			err = database.ClearActiveAlert(db, rule.ID, entry.Server, entry.Station)
+		}
+		if err != nil {
+			return events, err
+		}
+
+		event.ID, err = database.InsertAlertEvent(db, event)
+		if err != nil {
+			return events, err
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// TestRule replays the stored history of the given stations since after
+// through a rule and returns the events that it would have produced. Nothing
+// is saved.
+func TestRule(db *sql.DB, rule types.AlertRule, stations []types.StationEntry, after time.Time) ([]types.AlertEvent, error) {
+	events := []types.AlertEvent{}
+
+	for _, station := range stations {
+		if !MatchesStation(rule, station) {
+			continue
+		}
+		entries, err := database.FetchEntries(db, `WHERE server.value = ?
+				AND station.value = ?
+				AND time >= ?
+				ORDER BY time ASC`,
+			station.Server, station.Station, after.UTC())
+		if err != nil {
+			return events, err
+		}
+
+		active := false
+		for _, entry := range entries {
+			firing, value, unit, ok := Evaluate(rule, entry.Sensors)
+			if !ok || firing == active {
+				continue
+			}
+			active = firing
+			events = append(events, types.AlertEvent{
+				Rule:    rule.ID,
+				Server:  entry.Server,
+				Station: entry.Station,
+				Time:    entry.Time.UTC(),
+				Firing:  firing,
+				Value:   value,
+				Unit:    unit,
+			})
+		}
+	}
+
+	return events, nil
+}
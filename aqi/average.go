@@ -0,0 +1,213 @@
+package aqi
+
+import (
+	"database/sql"
+	"math"
+	"time"
+
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/types"
+	"github.com/ttocsneb/weather/util"
+)
+
+// Pollutants that have air quality indices
+var Pollutants = []string{
+	types.SensorPM25,
+	types.SensorPM10,
+}
+
+// Sensors that are calculated from the concentrations. These can't be
+// averaged between stations as the indices are not linear, and should instead
+// be recalculated from the averaged concentrations.
+var Indices = []string{
+	types.SensorAQI,
+	types.SensorAQIPM25,
+	types.SensorAQIPM10,
+	types.SensorCAQI,
+}
+
+// Averaging windows of the concentrations
+const (
+	Hour    = "1h"
+	NowCast = "nowcast"
+	Day     = "24h"
+)
+
+// The number of hours in a day needed for a 24 h average
+const minDailyHours = 18
+
+func AverageName(pollutant string, window string) string {
+	return pollutant + "-" + window
+}
+
+// hourlyAverages finds the average concentration of each hour before now,
+// starting with the most recent. Hours without any samples are NaN.
+func hourlyAverages(series types.SensorSeries, name string, now time.Time, hours int) []float64 {
+	sums := make([]float64, hours)
+	counts := make([]int, hours)
+	for i, t := range series.Times {
+		if t.After(now) {
+			continue
+		}
+		hour := int(now.Sub(t) / time.Hour)
+		if hour >= hours {
+			continue
+		}
+		value, _ := util.SensorToMetric(series.Values[i], series.Unit, name)
+		sums[hour] += value
+		counts[hour]++
+	}
+
+	averages := make([]float64, hours)
+	for i := range averages {
+		if counts[i] == 0 {
+			averages[i] = math.NaN()
+		} else {
+			averages[i] = sums[i] / float64(counts[i])
+		}
+	}
+	return averages
+}
+
+// CalculateNowCast weighs the last 12 hourly averages (most recent first) by
+// how quickly the concentration is changing, as the EPA does for particulate
+// matter. At least two of the last three hours are needed.
+func CalculateNowCast(hourly []float64) (float64, bool) {
+	recent := 0
+	for _, c := range hourly[:int(math.Min(3, float64(len(hourly))))] {
+		if !math.IsNaN(c) {
+			recent++
+		}
+	}
+	if recent < 2 {
+		return 0, false
+	}
+
+	min := math.Inf(1)
+	max := math.Inf(-1)
+	for _, c := range hourly {
+		if !math.IsNaN(c) {
+			min = math.Min(min, c)
+			max = math.Max(max, c)
+		}
+	}
+	weight := 1.0
+	if max > 0 {
+		weight = math.Max(min/max, 0.5)
+	}
+
+	sum := 0.0
+	total := 0.0
+	factor := 1.0
+	for _, c := range hourly {
+		if !math.IsNaN(c) {
+			sum += factor * c
+			total += factor
+		}
+		factor *= weight
+	}
+	return sum / total, true
+}
+
+// Averages calculates the rolling averages of a station's pollutant
+// concentrations at the given time.
+func Averages(db *sql.DB, server string, station string, now time.Time) (map[string]types.SensorValue, error) {
+	averages := make(map[string]types.SensorValue)
+
+	history, err := database.FetchSensorHistory(db, server, station,
+		now.Add(-24*time.Hour).UTC(), now.Add(time.Second).UTC(), Pollutants...)
+	if err != nil {
+		return averages, err
+	}
+
+	for _, pollutant := range Pollutants {
+		series, exists := history[pollutant]
+		if !exists {
+			continue
+		}
+		hourly := hourlyAverages(series, pollutant, now, 24)
+
+		if !math.IsNaN(hourly[0]) {
+			averages[AverageName(pollutant, Hour)] = types.SensorValue{
+				Unit: "ug/m3", Value: hourly[0],
+			}
+		}
+		if value, ok := CalculateNowCast(hourly[:12]); ok {
+			averages[AverageName(pollutant, NowCast)] = types.SensorValue{
+				Unit: "ug/m3", Value: value,
+			}
+		}
+
+		sum := 0.0
+		count := 0
+		for _, c := range hourly {
+			if !math.IsNaN(c) {
+				sum += c
+				count++
+			}
+		}
+		if count >= minDailyHours {
+			averages[AverageName(pollutant, Day)] = types.SensorValue{
+				Unit: "ug/m3", Value: sum / float64(count),
+			}
+		}
+	}
+
+	return averages, nil
+}
+
+// firstSensor finds the first of the given sensors that has a value.
+func firstSensor(sensors map[string]types.SensorValue, names ...string) (float64, bool) {
+	for _, name := range names {
+		sensor, exists := sensors[name]
+		if exists {
+			value, _ := util.SensorToMetric(sensor.Value, sensor.Unit, name)
+			return value, true
+		}
+	}
+	return 0, false
+}
+
+// CalculateIndices finds the air quality indices from a set of sensors that
+// contain the pollutant concentrations and their averages. The EPA index
+// prefers the NowCast and the CAQI the hourly average, falling back to the
+// latest concentration.
+func CalculateIndices(sensors map[string]types.SensorValue) map[string]types.SensorValue {
+	indices := make(map[string]types.SensorValue)
+
+	aqi := math.Inf(-1)
+	caqi := math.Inf(-1)
+	for _, pollutant := range Pollutants {
+		concentration, exists := firstSensor(sensors,
+			AverageName(pollutant, NowCast), AverageName(pollutant, Hour), pollutant)
+		if exists {
+			if index, ok := EPA(pollutant, concentration); ok {
+				indices[types.SensorAQI+"-"+pollutant] = types.SensorValue{
+					Unit: "aqi", Value: index, Label: EPACategory(index),
+				}
+				aqi = math.Max(aqi, index)
+			}
+		}
+
+		concentration, exists = firstSensor(sensors,
+			AverageName(pollutant, Hour), pollutant)
+		if exists {
+			if index, ok := CAQI(pollutant, concentration); ok {
+				caqi = math.Max(caqi, index)
+			}
+		}
+	}
+
+	if !math.IsInf(aqi, -1) {
+		indices[types.SensorAQI] = types.SensorValue{
+			Unit: "aqi", Value: aqi, Label: EPACategory(aqi),
+		}
+	}
+	if !math.IsInf(caqi, -1) {
+		indices[types.SensorCAQI] = types.SensorValue{
+			Unit: "caqi", Value: caqi, Label: CAQICategory(caqi),
+		}
+	}
+
+	return indices
+}
@@ -0,0 +1,134 @@
+package aqi
+
+import (
+	"math"
+
+	"github.com/ttocsneb/weather/types"
+)
+
+type breakpoint struct {
+	low    float64
+	high   float64
+	index  float64
+	higher float64
+}
+
+// US EPA breakpoints in µg/m³ for the NowCast or 24 h average concentration
+var epaBreakpoints = map[string][]breakpoint{
+	types.SensorPM25: {
+		{0, 9.0, 0, 50},
+		{9.1, 35.4, 51, 100},
+		{35.5, 55.4, 101, 150},
+		{55.5, 125.4, 151, 200},
+		{125.5, 225.4, 201, 300},
+		{225.5, 325.4, 301, 500},
+	},
+	types.SensorPM10: {
+		{0, 54, 0, 50},
+		{55, 154, 51, 100},
+		{155, 254, 101, 150},
+		{255, 354, 151, 200},
+		{355, 424, 201, 300},
+		{425, 604, 301, 500},
+	},
+}
+
+// Concentrations are truncated to this precision before looking up the index
+var epaPrecision = map[string]float64{
+	types.SensorPM25: 10,
+	types.SensorPM10: 1,
+}
+
+// The EPA index stops at 500, beyond which air quality is "beyond the AQI"
+const epaMax = 500
+
+var epaCategories = []struct {
+	index float64
+	name  string
+}{
+	{50, "Good"},
+	{100, "Moderate"},
+	{150, "Unhealthy for Sensitive Groups"},
+	{200, "Unhealthy"},
+	{300, "Very Unhealthy"},
+	{math.Inf(1), "Hazardous"},
+}
+
+// CAQI grid of hourly concentrations in µg/m³
+var caqiBreakpoints = map[string][]breakpoint{
+	types.SensorPM25: {
+		{0, 15, 0, 25},
+		{15, 30, 25, 50},
+		{30, 55, 50, 75},
+		{55, 110, 75, 100},
+	},
+	types.SensorPM10: {
+		{0, 25, 0, 25},
+		{25, 50, 25, 50},
+		{50, 90, 50, 75},
+		{90, 180, 75, 100},
+	},
+}
+
+var caqiCategories = []struct {
+	index float64
+	name  string
+}{
+	{25, "Very low"},
+	{50, "Low"},
+	{75, "Medium"},
+	{100, "High"},
+	{math.Inf(1), "Very high"},
+}
+
+func interpolate(breakpoints []breakpoint, concentration float64) float64 {
+	for _, bp := range breakpoints {
+		if concentration <= bp.high {
+			return (bp.higher-bp.index)/(bp.high-bp.low)*(concentration-bp.low) + bp.index
+		}
+	}
+	// Beyond the scale, keep extending the last segment, as CAQI is open
+	// ended
+	bp := breakpoints[len(breakpoints)-1]
+	return (bp.higher-bp.index)/(bp.high-bp.low)*(concentration-bp.low) + bp.index
+}
+
+// EPA finds the US EPA air quality index of a pollutant's concentration
+// (µg/m³), which is at most 500. Returns false if the pollutant has no index.
+func EPA(pollutant string, concentration float64) (float64, bool) {
+	breakpoints, exists := epaBreakpoints[pollutant]
+	if !exists || math.IsNaN(concentration) {
+		return 0, false
+	}
+	precision := epaPrecision[pollutant]
+	concentration = math.Floor(math.Max(concentration, 0)*precision) / precision
+	return math.Round(math.Min(interpolate(breakpoints, concentration), epaMax)), true
+}
+
+func EPACategory(index float64) string {
+	for _, category := range epaCategories {
+		if index <= category.index {
+			return category.name
+		}
+	}
+	return ""
+}
+
+// CAQI finds the European common air quality index of a pollutant's hourly
+// concentration (µg/m³). Returns false if the pollutant has no index.
+func CAQI(pollutant string, concentration float64) (float64, bool) {
+	breakpoints, exists := caqiBreakpoints[pollutant]
+	if !exists || math.IsNaN(concentration) {
+		return 0, false
+	}
+	return math.Round(interpolate(breakpoints, math.Max(concentration, 0))), true
+}
+
+func CAQICategory(index float64) string {
+	for _, category := range caqiCategories {
+		if index <= category.index {
+			return category.name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,50 @@
+package aqi
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ttocsneb/weather/types"
+)
+
+func TestEPA(t *testing.T) {
+	tests := []struct {
+		pollutant     string
+		concentration float64
+		index         float64
+		exists        bool
+	}{
+		{types.SensorPM25, 0, 0, true},
+		{types.SensorPM25, 9.0, 50, true},
+		// Concentrations are truncated to a tenth before the lookup
+		{types.SensorPM25, 9.09, 50, true},
+		{types.SensorPM25, 9.1, 51, true},
+		{types.SensorPM25, 35.4, 100, true},
+		{types.SensorPM25, 325.4, 500, true},
+		// The index doesn't go past the top of the scale
+		{types.SensorPM25, 500, 500, true},
+		{types.SensorPM10, 604, 500, true},
+		{types.SensorPM10, 2000, 500, true},
+		{types.SensorPM25, -5, 0, true},
+		{types.SensorPM25, math.NaN(), 0, false},
+		{types.SensorCO2, 400, 0, false},
+	}
+
+	for _, test := range tests {
+		index, exists := EPA(test.pollutant, test.concentration)
+		if index != test.index || exists != test.exists {
+			t.Errorf("%v %v: got %v %v, want %v %v", test.pollutant,
+				test.concentration, index, exists, test.index, test.exists)
+		}
+	}
+}
+
+func TestCAQIIsOpenEnded(t *testing.T) {
+	index, _ := CAQI(types.SensorPM25, 220)
+	if index <= 100 {
+		t.Errorf("got %v for 220 µg/m³, want more than 100", index)
+	}
+	if category := CAQICategory(index); category != "Very high" {
+		t.Errorf("got %v, want Very high", category)
+	}
+}
@@ -0,0 +1,52 @@
+package astro
+
+import (
+	"math"
+	"time"
+)
+
+// Solar constant in W/m²
+const solarConstant = 1361
+
+// Below this elevation (degrees) the sun is too low for the clear-sky model,
+// and measurements are dominated by the horizon around the sensor.
+const MinClearSkyElevation = 10.0
+
+// airMass finds the relative optical air mass at a solar elevation (degrees)
+// using Kasten and Young's formula.
+func airMass(elevation float64) float64 {
+	zenith := 90 - elevation
+	return 1 / (math.Cos(zenith*rad) + 0.50572*math.Pow(96.07995-zenith, -1.6364))
+}
+
+// ClearSkyRadiation estimates the global horizontal irradiance (W/m²) under a
+// cloudless sky for a location and elevation (m). The direct beam follows
+// Meinel's model with Laue's correction for elevation, and diffuse light adds
+// a further 10%.
+func ClearSkyRadiation(t time.Time, latitude float64, longitude float64, elevation float64) float64 {
+	sun_elevation, _ := SunPosition(t, latitude, longitude)
+	if sun_elevation <= 0 {
+		return 0
+	}
+
+	// Earth-sun distance correction
+	day := float64(t.UTC().YearDay())
+	extraterrestrial := solarConstant * (1 + 0.033*math.Cos(2*math.Pi*day/365))
+
+	h := math.Max(elevation, 0) / 1000
+	am := airMass(sun_elevation)
+	direct := extraterrestrial * ((1-0.14*h)*math.Pow(0.7, math.Pow(am, 0.678)) + 0.14*h)
+
+	return 1.1 * direct * math.Sin(sun_elevation*rad)
+}
+
+// CloudCover estimates the fraction of the sky covered by clouds (0-1) from a
+// clear-sky index by inverting Kasten and Czeplak's relation
+// G/Gclear = 1 - 0.75 N^3.4.
+func CloudCover(index float64) float64 {
+	if index >= 1 {
+		return 0
+	}
+	cover := math.Pow((1-math.Max(index, 0))/0.75, 1/3.4)
+	return math.Min(cover, 1)
+}
@@ -0,0 +1,147 @@
+package astro
+
+import (
+	"math"
+	"time"
+)
+
+// Obliquity of the earth
+const obliquity = 23.4397 * rad
+
+const synodicMonth = 29.530588853
+
+func daysSinceJ2000(t time.Time) float64 {
+	return julianDay(t) - 2451545
+}
+
+func rightAscension(l float64, b float64) float64 {
+	return math.Atan2(math.Sin(l)*math.Cos(obliquity)-math.Tan(b)*math.Sin(obliquity), math.Cos(l))
+}
+
+func declination(l float64, b float64) float64 {
+	return math.Asin(math.Sin(b)*math.Cos(obliquity) + math.Cos(b)*math.Sin(obliquity)*math.Sin(l))
+}
+
+func siderealTime(d float64, lw float64) float64 {
+	return rad*(280.16+360.9856235*d) - lw
+}
+
+// Low precision equatorial coordinates of the sun in radians
+func sunCoords(d float64) (float64, float64) {
+	M := rad * (357.5291 + 0.98560028*d)
+	C := rad * (1.9148*math.Sin(M) + 0.02*math.Sin(2*M) + 0.0003*math.Sin(3*M))
+	L := M + C + rad*102.9372 + math.Pi
+	return rightAscension(L, 0), declination(L, 0)
+}
+
+// Low precision equatorial coordinates (radians) and distance (km) of the moon
+func moonCoords(d float64) (float64, float64, float64) {
+	L := rad * (218.316 + 13.176396*d)
+	M := rad * (134.963 + 13.064993*d)
+	F := rad * (93.272 + 13.229350*d)
+
+	l := L + rad*6.289*math.Sin(M)
+	b := rad * 5.128 * math.Sin(F)
+	distance := 385001 - 20905*math.Cos(M)
+
+	return rightAscension(l, b), declination(l, b), distance
+}
+
+// MoonPosition finds the elevation and azimuth (clockwise from north) of the
+// moon in degrees, and its distance in km.
+func MoonPosition(t time.Time, latitude float64, longitude float64) (float64, float64, float64) {
+	d := daysSinceJ2000(t)
+	ra, dec, distance := moonCoords(d)
+
+	lw := -longitude * rad
+	phi := latitude * rad
+	H := siderealTime(d, lw) - ra
+
+	altitude := math.Asin(math.Sin(phi)*math.Sin(dec) + math.Cos(phi)*math.Cos(dec)*math.Cos(H))
+	azimuth := math.Atan2(math.Sin(H), math.Cos(H)*math.Sin(phi)-math.Tan(dec)*math.Cos(phi))
+
+	// Atmospheric refraction
+	h := math.Max(altitude, 0)
+	altitude += 0.0002967 / math.Tan(h+0.00312536/(h+0.08901179))
+
+	return altitude / rad, math.Mod(azimuth/rad+180, 360), distance
+}
+
+// MoonIllumination finds the illuminated fraction of the moon and its phase,
+// which goes from 0 (new moon) through 0.5 (full moon) back to 1.
+func MoonIllumination(t time.Time) (float64, float64) {
+	d := daysSinceJ2000(t)
+	sun_ra, sun_dec := sunCoords(d)
+	moon_ra, moon_dec, moon_distance := moonCoords(d)
+
+	const sun_distance = 149598000
+
+	phi := math.Acos(math.Sin(sun_dec)*math.Sin(moon_dec) +
+		math.Cos(sun_dec)*math.Cos(moon_dec)*math.Cos(sun_ra-moon_ra))
+	inc := math.Atan2(sun_distance*math.Sin(phi), moon_distance-sun_distance*math.Cos(phi))
+	angle := math.Atan2(math.Cos(sun_dec)*math.Sin(sun_ra-moon_ra),
+		math.Sin(sun_dec)*math.Cos(moon_dec)-
+			math.Cos(sun_dec)*math.Sin(moon_dec)*math.Cos(sun_ra-moon_ra))
+
+	sign := 1.0
+	if angle < 0 {
+		sign = -1.0
+	}
+
+	fraction := (1 + math.Cos(inc)) / 2
+	phase := 0.5 + 0.5*inc*sign/math.Pi
+	return fraction, phase
+}
+
+// MoonAge converts a phase into the number of days since the new moon.
+func MoonAge(phase float64) float64 {
+	return phase * synodicMonth
+}
+
+func MoonPhaseName(phase float64) string {
+	names := []string{
+		"New moon",
+		"Waxing crescent",
+		"First quarter",
+		"Waxing gibbous",
+		"Full moon",
+		"Waning gibbous",
+		"Last quarter",
+		"Waning crescent",
+	}
+	index := int(math.Floor(phase*8+0.5)) % len(names)
+	return names[index]
+}
+
+// MoonTimes finds when the moon rises and sets between start and end. Either
+// may be nil, as the moon doesn't rise or set every day.
+func MoonTimes(start time.Time, end time.Time, latitude float64, longitude float64) (*time.Time, *time.Time) {
+	const step = 10 * time.Minute
+	// The altitude of the moon's upper limb at the horizon
+	const horizon = 0.133
+
+	var rise *time.Time
+	var set *time.Time
+
+	altitude := func(t time.Time) float64 {
+		alt, _, _ := MoonPosition(t, latitude, longitude)
+		return alt - horizon
+	}
+
+	prev := altitude(start)
+	for t := start.Add(step); !t.After(end); t = t.Add(step) {
+		cur := altitude(t)
+		if (prev < 0) != (cur < 0) {
+			ratio := prev / (prev - cur)
+			crossing := t.Add(-step).Add(time.Duration(ratio * float64(step)))
+			if prev < 0 && rise == nil {
+				rise = &crossing
+			} else if prev >= 0 && set == nil {
+				set = &crossing
+			}
+		}
+		prev = cur
+	}
+
+	return rise, set
+}
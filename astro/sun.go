@@ -0,0 +1,175 @@
+package astro
+
+import (
+	"math"
+	"time"
+)
+
+const rad = math.Pi / 180
+
+// Altitudes of the sun's centre for each event, in degrees
+const (
+	AltitudeSunrise      = -0.833
+	AltitudeCivil        = -6.0
+	AltitudeNautical     = -12.0
+	AltitudeAstronomical = -18.0
+)
+
+func julianDay(t time.Time) float64 {
+	return float64(t.UnixNano())/float64(24*time.Hour) + 2440587.5
+}
+
+// sun calculates the sun's declination (degrees) and the equation of time
+// (minutes) using the NOAA solar calculator's algorithm.
+func sun(t time.Time) (float64, float64) {
+	T := (julianDay(t) - 2451545) / 36525
+
+	L0 := math.Mod(280.46646+T*(36000.76983+T*0.0003032), 360)
+	M := 357.52911 + T*(35999.05029-0.0001537*T)
+	e := 0.016708634 - T*(0.000042037+0.0000001267*T)
+
+	C := math.Sin(M*rad)*(1.914602-T*(0.004817+0.000014*T)) +
+		math.Sin(2*M*rad)*(0.019993-0.000101*T) +
+		math.Sin(3*M*rad)*0.000289
+
+	omega := 125.04 - 1934.136*T
+	lambda := L0 + C - 0.00569 - 0.00478*math.Sin(omega*rad)
+
+	epsilon0 := 23 + (26+(21.448-T*(46.815+T*(0.00059-T*0.001813)))/60)/60
+	epsilon := epsilon0 + 0.00256*math.Cos(omega*rad)
+
+	declination := math.Asin(math.Sin(epsilon*rad)*math.Sin(lambda*rad)) / rad
+
+	y := math.Tan(epsilon * rad / 2)
+	y *= y
+	eqTime := 4 / rad * (y*math.Sin(2*L0*rad) -
+		2*e*math.Sin(M*rad) +
+		4*e*y*math.Sin(M*rad)*math.Cos(2*L0*rad) -
+		0.5*y*y*math.Sin(4*L0*rad) -
+		1.25*e*e*math.Sin(2*M*rad))
+
+	return declination, eqTime
+}
+
+// SunPosition finds the elevation and azimuth (clockwise from north) of the
+// sun in degrees.
+func SunPosition(t time.Time, latitude float64, longitude float64) (float64, float64) {
+	declination, eqTime := sun(t)
+
+	utc := t.UTC()
+	minutes := float64(utc.Hour()*60+utc.Minute()) +
+		float64(utc.Second())/60 + float64(utc.Nanosecond())/6e10
+	solar_time := math.Mod(minutes+eqTime+4*longitude, 1440)
+	hour_angle := solar_time/4 - 180
+	if hour_angle < -180 {
+		hour_angle += 360
+	}
+
+	lat := latitude * rad
+	dec := declination * rad
+	ha := hour_angle * rad
+
+	cos_zenith := math.Sin(lat)*math.Sin(dec) + math.Cos(lat)*math.Cos(dec)*math.Cos(ha)
+	zenith := math.Acos(math.Max(-1, math.Min(1, cos_zenith)))
+
+	azimuth := math.Atan2(math.Sin(ha),
+		math.Cos(ha)*math.Sin(lat)-math.Tan(dec)*math.Cos(lat))/rad + 180
+
+	return 90 - zenith/rad, math.Mod(azimuth, 360)
+}
+
+// SolarNoon finds the solar noon closest to noon of the given day in loc.
+func SolarNoon(year int, month time.Month, day int, loc *time.Location, longitude float64) time.Time {
+	target := time.Date(year, month, day, 12, 0, 0, 0, loc)
+	noon := target
+	for i := 0; i < 2; i++ {
+		_, eqTime := sun(noon)
+		utc := target.UTC()
+		midnight := time.Date(utc.Year(), utc.Month(), utc.Day(), 0, 0, 0, 0, time.UTC)
+		noon = midnight.Add(time.Duration((720 - 4*longitude - eqTime) * float64(time.Minute)))
+		if noon.Sub(target) > 12*time.Hour {
+			noon = noon.Add(-24 * time.Hour)
+		} else if target.Sub(noon) > 12*time.Hour {
+			noon = noon.Add(24 * time.Hour)
+		}
+	}
+	return noon
+}
+
+// SunEvent finds when the sun crosses the given altitude (degrees) in the
+// morning or evening around a solar noon. If the sun never crosses the
+// altitude that day, false is returned along with whether the sun stays above
+// it.
+func SunEvent(noon time.Time, latitude float64, altitude float64, morning bool) (time.Time, bool, bool) {
+	t := noon
+	for i := 0; i < 3; i++ {
+		declination, _ := sun(t)
+		lat := latitude * rad
+		dec := declination * rad
+
+		cos_ha := (math.Sin(altitude*rad) - math.Sin(lat)*math.Sin(dec)) /
+			(math.Cos(lat) * math.Cos(dec))
+		if cos_ha > 1 {
+			return time.Time{}, false, false
+		}
+		if cos_ha < -1 {
+			return time.Time{}, false, true
+		}
+
+		offset := time.Duration(math.Acos(cos_ha) / rad * 4 * float64(time.Minute))
+		if morning {
+			t = noon.Add(-offset)
+		} else {
+			t = noon.Add(offset)
+		}
+	}
+	return t, true, false
+}
+
+type SunTimes struct {
+	SolarNoon        time.Time
+	Sunrise          *time.Time
+	Sunset           *time.Time
+	CivilDawn        *time.Time
+	CivilDusk        *time.Time
+	NauticalDawn     *time.Time
+	NauticalDusk     *time.Time
+	AstronomicalDawn *time.Time
+	AstronomicalDusk *time.Time
+	DayLength        time.Duration
+}
+
+// Sun calculates the times of the sun's daily events on a day in loc. Events
+// that don't happen that day (such as during polar night) are nil.
+func Sun(year int, month time.Month, day int, loc *time.Location, latitude float64, longitude float64) SunTimes {
+	noon := SolarNoon(year, month, day, loc, longitude)
+
+	event := func(altitude float64, morning bool) *time.Time {
+		t, ok, _ := SunEvent(noon, latitude, altitude, morning)
+		if !ok {
+			return nil
+		}
+		t = t.In(loc)
+		return &t
+	}
+
+	times := SunTimes{
+		SolarNoon:        noon.In(loc),
+		Sunrise:          event(AltitudeSunrise, true),
+		Sunset:           event(AltitudeSunrise, false),
+		CivilDawn:        event(AltitudeCivil, true),
+		CivilDusk:        event(AltitudeCivil, false),
+		NauticalDawn:     event(AltitudeNautical, true),
+		NauticalDusk:     event(AltitudeNautical, false),
+		AstronomicalDawn: event(AltitudeAstronomical, true),
+		AstronomicalDusk: event(AltitudeAstronomical, false),
+	}
+
+	if times.Sunrise != nil && times.Sunset != nil {
+		times.DayLength = times.Sunset.Sub(*times.Sunrise)
+	} else if _, _, above := SunEvent(noon, latitude, AltitudeSunrise, true); above {
+		times.DayLength = 24 * time.Hour
+	}
+
+	return times
+}
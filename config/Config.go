@@ -1,20 +1,230 @@
 package config
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/BurntSushi/toml"
 	"os"
+	"time"
 )
 
+type ForecastConfig struct {
+	Interval time.Duration
+	History  time.Duration
+}
+
+type Rtl433Config struct {
+	// The server that the stations are stored under
+	Server string
+	// The broker that rtl_433 publishes its events to, if any
+	Broker string
+	Topic  string
+	// A file to read rtl_433's JSON lines from, or "-" for stdin
+	File string
+	// How long readings are gathered into a single message for a station
+	Window time.Duration
+	// The time zone of the times rtl_433 outputs without an offset, which is
+	// the server's local time zone by default as it is for rtl_433
+	TimeZone string
+	// Station ids by device, where devices are identified by
+	// "model/channel/id", or "model/id" if they don't have a channel. The id
+	// may be "*" to match any id, as many devices change ids when their
+	// batteries are replaced.
+	Stations map[string]string
+	// Stations are created for devices that aren't in Stations
+	AllDevices bool
+}
+
+// IngestConfig decides what happens to observations with unexpected times
+type IngestConfig struct {
+	// How far ahead of the server's clock an observation may be
+	MaxFuture time.Duration
+	// What to do with observations further in the future than MaxFuture:
+	// "reject" them, or "clamp" them to the current time
+	Future string
+	// What to do with observations older than the station's latest: "accept"
+	// them, "store" them without publishing them to live streams or checking
+	// them for alerts, or "reject" them
+	OutOfOrder string
+}
+
+// MigrateConfig lists corrections to make to data stored by older versions
+type MigrateConfig struct {
+	// Stations (as server/station) that reported rain in inches while inches
+	// were being converted to millimeters incorrectly. Their old rain is
+	// corrected the next time the server starts.
+	InchRain []string
+}
+
+// WriterConfig tunes how observations are batched into transactions
+type WriterConfig struct {
+	// The most entries written in a single transaction
+	BatchSize int
+	// How many writes may be waiting before ingest has to wait for them
+	Queue int
+}
+
+// InfluxConfig mirrors every observation as line protocol
+type InfluxConfig struct {
+	Measurement string
+	// A file to append lines to
+	File string
+	// A write endpoint such as http://localhost:8086/api/v2/write?org=o&bucket=b
+	URL   string
+	Token string
+	// How often lines are written
+	Interval time.Duration
+}
+
+// Topics are templates where {station} is replaced by the id of a station.
+// Stations are subscribed to with {station} replaced by +, and may also
+// contain other wildcards to ignore parts of a topic.
+type TopicConfig struct {
+	Weather      string
+	Info         string
+	Request      string
+	RapidWeather string
+	// Batches of messages that a station buffered while it was offline, or
+	// empty to not accept backfills over MQTT
+	Backfill string
+}
+
+type QoSConfig struct {
+	Weather      byte
+	Info         byte
+	Request      byte
+	RapidWeather byte
+	Backfill     byte
+}
+
+// TLSConfig points to PEM files used to connect to a broker over TLS, which
+// is used for ssl://, tls:// and mqtts:// urls
+type TLSConfig struct {
+	// Certificate authorities to verify the broker with, instead of the
+	// system's
+	CA string
+	// A client certificate and key for mutual TLS
+	Cert string
+	Key  string
+	// The name to verify the broker's certificate against, if it differs from
+	// the url
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+type BrokerConfig struct {
+	URL      string
+	Username string
+	Password string
+	TLS      TLSConfig
+	// Template of the client id where {id} is replaced by the id of the
+	// server, {instance} by the instance, and {broker} by the name of the
+	// broker. Every connection to a broker needs its own client id, or they
+	// will keep disconnecting each other.
+	ClientId string
+	// Weather is subscribed to as a shared subscription of this group when
+	// set, so that the instances in the group split the messages between them
+	// rather than each receiving every message.
+	ShareGroup string
+
+	CleanSession bool
+	KeepAlive    time.Duration
+	// How long to wait for the broker when connecting
+	ConnectTimeout time.Duration
+	// The longest to wait between attempts to reconnect
+	MaxReconnectInterval time.Duration
+
+	// Prepended to every topic
+	Prefix string
+	Topics TopicConfig
+	QoS    QoSConfig
+	// Template of the payload of requests to stations where {action} is
+	// replaced by the action being requested, and {station} by the id of the
+	// station.
+	RequestPayload string
+}
+
+func DefaultBrokerConfig() BrokerConfig {
+	return BrokerConfig{
+		ClientId:             "{id}-{instance}-{broker}",
+		CleanSession:         true,
+		KeepAlive:            time.Second * 30,
+		ConnectTimeout:       time.Second * 30,
+		MaxReconnectInterval: time.Minute,
+		Topics: TopicConfig{
+			Weather:      "/station/weather/{station}",
+			Info:         "/station/info/{station}",
+			Request:      "/station/request/{station}",
+			RapidWeather: "/station/rapid-weather/{station}",
+			Backfill:     "/station/backfill/{station}",
+		},
+		QoS: QoSConfig{
+			Weather:      0,
+			Info:         1,
+			Request:      1,
+			RapidWeather: 1,
+			Backfill:     1,
+		},
+		RequestPayload: `{"action":"{action}"}`,
+	}
+}
+
+// UnmarshalTOML lets a broker be configured with just its url, or with a
+// table to change its defaults.
+func (self *BrokerConfig) UnmarshalTOML(data any) error {
+	*self = DefaultBrokerConfig()
+	switch value := data.(type) {
+	case string:
+		self.URL = value
+		return nil
+	case map[string]any:
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(value); err != nil {
+			return err
+		}
+		// Decode into a type without this method to use the regular decoder
+		type broker BrokerConfig
+		_, err := toml.Decode(buf.String(), (*broker)(self))
+		return err
+	}
+	return fmt.Errorf("broker must be a url or a table, not %T", data)
+}
+
 type Config struct {
-	Brokers  map[string]string
-	Id       string
+	Brokers map[string]BrokerConfig
+	Id      string
+	// Tells apart instances of the server sharing the same config, which is
+	// the hostname by default
+	Instance string
 	Port     uint16
 	Database string
+	Forecast ForecastConfig
+	// Tokens of the clients allowed to use authenticated endpoints, by the
+	// name of the client
+	Tokens  map[string]string
+	Rtl433  Rtl433Config
+	Influx  InfluxConfig
+	Ingest  IngestConfig
+	Writer  WriterConfig
+	Migrate MigrateConfig
 }
 
 func ParseConfig(path string) (Config, error) {
 	var conf Config
 	conf.Port = 8080
+	conf.Instance, _ = os.Hostname()
+	conf.Forecast.Interval = time.Hour * 6
+	conf.Forecast.History = time.Hour * 24 * 14
+	conf.Rtl433.Server = "rtl433"
+	conf.Rtl433.Topic = "rtl_433/+/events"
+	conf.Rtl433.Window = time.Second * 30
+	conf.Influx.Measurement = "weather"
+	conf.Influx.Interval = time.Second * 10
+	conf.Ingest.MaxFuture = time.Minute * 5
+	conf.Ingest.Future = "reject"
+	conf.Ingest.OutOfOrder = "accept"
+	conf.Writer.BatchSize = 500
+	conf.Writer.Queue = 10000
 	f, e := os.ReadFile(path)
 	if e != nil {
 		return conf, e
@@ -0,0 +1,311 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/ttocsneb/weather/types"
+)
+
+func alertRuleStrings(rule types.AlertRule) []string {
+	return []string{
+		rule.Name,
+		rule.Sensor,
+		rule.Operator,
+		rule.Unit,
+		rule.Scope,
+		rule.Server,
+		rule.Station,
+		rule.District,
+		rule.City,
+		rule.Region,
+		rule.Country,
+	}
+}
+
+func InsertAlertRule(db *sql.DB, rule types.AlertRule) (int64, error) {
+	lookup, err := GetOrInsertLookupStrings(db, alertRuleStrings(rule))
+	if err != nil {
+		return 0, err
+	}
+
+	query := `INSERT INTO alert_rule (
+			name_id,
+			sensor_id,
+			operator_id,
+			threshold,
+			unit_id,
+			scope_id,
+			server_id,
+			station_id,
+			latitude,
+			longitude,
+			radius,
+			district_id,
+			city_id,
+			region_id,
+			country_id,
+			enabled,
+			created)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+
+	result, err := db.Exec(query, lookup[rule.Name], lookup[rule.Sensor],
+		lookup[rule.Operator], rule.Threshold, lookup[rule.Unit],
+		lookup[rule.Scope], lookup[rule.Server], lookup[rule.Station],
+		rule.Latitude, rule.Longitude, rule.Range, lookup[rule.District],
+		lookup[rule.City], lookup[rule.Region], lookup[rule.Country],
+		rule.Enabled, rule.Created)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func UpdateAlertRule(db *sql.DB, rule types.AlertRule) (bool, error) {
+	lookup, err := GetOrInsertLookupStrings(db, alertRuleStrings(rule))
+	if err != nil {
+		return false, err
+	}
+
+	query := `UPDATE alert_rule SET
+			name_id = ?,
+			sensor_id = ?,
+			operator_id = ?,
+			threshold = ?,
+			unit_id = ?,
+			scope_id = ?,
+			server_id = ?,
+			station_id = ?,
+			latitude = ?,
+			longitude = ?,
+			radius = ?,
+			district_id = ?,
+			city_id = ?,
+			region_id = ?,
+			country_id = ?,
+			enabled = ?
+			WHERE id = ?;`
+
+	result, err := db.Exec(query, lookup[rule.Name], lookup[rule.Sensor],
+		lookup[rule.Operator], rule.Threshold, lookup[rule.Unit],
+		lookup[rule.Scope], lookup[rule.Server], lookup[rule.Station],
+		rule.Latitude, rule.Longitude, rule.Range, lookup[rule.District],
+		lookup[rule.City], lookup[rule.Region], lookup[rule.Country],
+		rule.Enabled, rule.ID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// DeleteAlertRule deletes a rule along with its history and any alerts that
+// are active for it.
+func DeleteAlertRule(db *sql.DB, id int64) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM alert_active WHERE rule_id = ?;`, id)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`DELETE FROM alert_event WHERE rule_id = ?;`, id)
+	if err != nil {
+		return false, err
+	}
+	result, err := tx.Exec(`DELETE FROM alert_rule WHERE id = ?;`, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, tx.Commit()
+}
+
+func QueryAlertRules(db *sql.DB, condition string, args ...interface{}) ([]types.AlertRule, error) {
+	query := fmt.Sprintf(`SELECT
+			alert_rule.id,
+			name.value,
+			sensor.value,
+			operator.value,
+			threshold,
+			unit.value,
+			scope.value,
+			server.value,
+			station.value,
+			latitude,
+			longitude,
+			radius,
+			district.value,
+			city.value,
+			region.value,
+			country.value,
+			enabled,
+			created
+		FROM alert_rule
+		%v %v;`,
+		GenStringJoins("alert_rule", "name", "sensor", "operator", "unit",
+			"scope", "server", "station", "district", "city", "region",
+			"country"),
+		condition)
+
+	result := []types.AlertRule{}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rule types.AlertRule
+		err := rows.Scan(&rule.ID, &rule.Name, &rule.Sensor, &rule.Operator,
+			&rule.Threshold, &rule.Unit, &rule.Scope, &rule.Server,
+			&rule.Station, &rule.Latitude, &rule.Longitude, &rule.Range,
+			&rule.District, &rule.City, &rule.Region, &rule.Country,
+			&rule.Enabled, &rule.Created)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, rule)
+	}
+
+	return result, nil
+}
+
+func FetchAlertRule(db *sql.DB, id int64) (types.AlertRule, bool, error) {
+	rules, err := QueryAlertRules(db, "WHERE alert_rule.id = ? LIMIT 1", id)
+	if err != nil {
+		return types.AlertRule{}, false, err
+	}
+	if len(rules) == 0 {
+		return types.AlertRule{}, false, nil
+	}
+	return rules[0], true, nil
+}
+
+func InsertAlertEvent(db *sql.DB, event types.AlertEvent) (int64, error) {
+	lookup, err := GetOrInsertLookupStrings(db, []string{
+		event.Server,
+		event.Station,
+		event.Unit,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	query := `INSERT INTO alert_event
+			(rule_id, server_id, station_id, time, firing, value, unit_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?);`
+
+	result, err := db.Exec(query, event.Rule, lookup[event.Server],
+		lookup[event.Station], event.Time.UTC(), event.Firing, event.Value,
+		lookup[event.Unit])
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func QueryAlertEvents(db *sql.DB, condition string, args ...interface{}) ([]types.AlertEvent, error) {
+	query := fmt.Sprintf(`SELECT
+			alert_event.id,
+			rule_id,
+			server.value,
+			station.value,
+			time,
+			firing,
+			alert_event.value,
+			unit.value
+		FROM alert_event
+		%v %v;`,
+		GenStringJoins("alert_event", "server", "station", "unit"),
+		condition)
+
+	result := []types.AlertEvent{}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var event types.AlertEvent
+		err := rows.Scan(&event.ID, &event.Rule, &event.Server, &event.Station,
+			&event.Time, &event.Firing, &event.Value, &event.Unit)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, event)
+	}
+
+	return result, nil
+}
+
+func SetActiveAlert(db *sql.DB, alert types.ActiveAlert) error {
+	lookup, err := GetOrInsertLookupStrings(db, []string{
+		alert.Server,
+		alert.Station,
+		alert.Unit,
+	})
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT OR REPLACE INTO alert_active
+			(rule_id, server_id, station_id, since, value, unit_id)
+			VALUES (?, ?, ?, ?, ?, ?);`
+
+	_, err = db.Exec(query, alert.Rule, lookup[alert.Server],
+		lookup[alert.Station], alert.Since.UTC(), alert.Value, lookup[alert.Unit])
+	return err
+}
+
+func ClearActiveAlert(db *sql.DB, rule int64, server string, station string) error {
+	query := `DELETE FROM alert_active WHERE rule_id = ?
+			AND server_id IN (SELECT id FROM lookup_strings WHERE value = ?)
+			AND station_id IN (SELECT id FROM lookup_strings WHERE value = ?);`
+
+	_, err := db.Exec(query, rule, server, station)
+	return err
+}
+
+func QueryActiveAlerts(db *sql.DB, condition string, args ...interface{}) ([]types.ActiveAlert, error) {
+	query := fmt.Sprintf(`SELECT
+			rule_id,
+			server.value,
+			station.value,
+			since,
+			alert_active.value,
+			unit.value
+		FROM alert_active
+		%v %v;`,
+		GenStringJoins("alert_active", "server", "station", "unit"),
+		condition)
+
+	result := []types.ActiveAlert{}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var alert types.ActiveAlert
+		err := rows.Scan(&alert.Rule, &alert.Server, &alert.Station,
+			&alert.Since, &alert.Value, &alert.Unit)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, alert)
+	}
+
+	return result, nil
+}
@@ -114,63 +114,182 @@ func GetOrInsertLookupStrings(db *sql.DB, strs []string) (map[string]int, error)
 	return found, nil
 }
 
-func InsertWeatherEntry(db *sql.DB, entry types.WeatherEntry) (int64, error) {
-	string_list := make([]string, 2)
-	string_list[0] = entry.Station
-	string_list[1] = entry.Server
-	for key, sensors := range entry.Sensors {
-		string_list = append(string_list, key)
-		for _, sensor := range sensors {
-			string_list = append(string_list, sensor.Unit)
+func entryStrings(entries ...types.WeatherEntry) []string {
+	string_list := []string{}
+	for _, entry := range entries {
+		string_list = append(string_list, entry.Station, entry.Server)
+		for key, sensors := range entry.Sensors {
+			string_list = append(string_list, key)
+			for _, sensor := range sensors {
+				string_list = append(string_list, sensor.Unit)
+			}
 		}
 	}
+	return string_list
+}
+
+// InsertWeatherEntry stores an entry, or merges its sensors into the entry
+// that the station already has at the same time. The id of the entry is
+// returned along with whether it was created.
+func InsertWeatherEntry(db *sql.DB, entry types.WeatherEntry) (int64, bool, error) {
+	ids, created, err := insertWeatherEntries(db, []types.WeatherEntry{entry}, false)
+	if err != nil {
+		return 0, false, err
+	}
+	return ids[0], created[0], nil
+}
+
+// InsertBackfill stores entries that were buffered by a station in a single
+// transaction, marking them as backfilled. Like InsertWeatherEntry, the ids
+// of the entries are returned along with whether each was created.
+func InsertBackfill(db *sql.DB, entries []types.WeatherEntry) ([]int64, []bool, error) {
+	return insertWeatherEntries(db, entries, true)
+}
+
+func insertWeatherEntries(db *sql.DB, entries []types.WeatherEntry, backfilled bool) ([]int64, []bool, error) {
+	lookup, err := GetOrInsertLookupStrings(db, entryStrings(entries...))
+	if err != nil {
+		return nil, nil, err
+	}
 
-	lookup, err := GetOrInsertLookupStrings(db, string_list)
+	tx, err := db.Begin()
 	if err != nil {
-		return 0, err
+		return nil, nil, err
 	}
+	defer tx.Rollback()
 
-	query := `INSERT INTO weather_entry (station_id, server_id, time) 
-					VALUES (?, ?, ?);`
+	stmts, err := prepareEntryStatements(tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer stmts.Close()
+
+	ids := make([]int64, len(entries))
+	created := make([]bool, len(entries))
+	for i, entry := range entries {
+		ids[i], created[i], err = stmts.insert(lookup, entry, backfilled)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return ids, created, tx.Commit()
+}
 
-	result, err := db.Exec(query,
+type preparer interface {
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// entryStatements are the prepared statements used to insert entries.
+type entryStatements struct {
+	entry  *sql.Stmt
+	find   *sql.Stmt
+	sensor *sql.Stmt
+}
+
+func prepareEntryStatements(db preparer) (entryStatements, error) {
+	var self entryStatements
+	var err error
+	self.entry, err = db.Prepare(`INSERT INTO weather_entry
+			(station_id, server_id, time, backfilled)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT (server_id, station_id, time) DO NOTHING;`)
+	if err != nil {
+		return self, err
+	}
+	self.find, err = db.Prepare(`SELECT id FROM weather_entry
+			WHERE server_id = ? AND station_id = ? AND time = ?;`)
+	if err != nil {
+		self.Close()
+		return self, err
+	}
+	self.sensor, err = db.Prepare(`INSERT INTO sensor_value
+			(entry_id, name_id, sensor_number, unit_id, value)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (entry_id, name_id, sensor_number)
+			DO UPDATE SET unit_id = excluded.unit_id, value = excluded.value;`)
+	if err != nil {
+		self.Close()
+		return self, err
+	}
+	return self, nil
+}
+
+// in uses the statements within a transaction.
+func (self entryStatements) in(tx *sql.Tx) entryStatements {
+	return entryStatements{
+		entry:  tx.Stmt(self.entry),
+		find:   tx.Stmt(self.find),
+		sensor: tx.Stmt(self.sensor),
+	}
+}
+
+func (self entryStatements) Close() {
+	for _, stmt := range []*sql.Stmt{self.entry, self.find, self.sensor} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+}
+
+func (self entryStatements) insert(lookup map[string]int, entry types.WeatherEntry, backfilled bool) (int64, bool, error) {
+	result, err := self.entry.Exec(
 		lookup[entry.Station],
 		lookup[entry.Server],
-		entry.Time,
+		entry.Time.UTC(),
+		backfilled,
 	)
 	if err != nil {
-		return 0, err
+		return 0, false, err
 	}
-	entry_id, err := result.LastInsertId()
+	affected, err := result.RowsAffected()
 	if err != nil {
-		return 0, err
+		return 0, false, err
 	}
+	created := affected > 0
 
-	query = `INSERT INTO sensor_value 
-					(entry_id, name_id, sensor_number, unit_id, value) 
-					VALUES `
-
-	opts := []string{}
-	args := []interface{}{}
+	var entry_id int64
+	if created {
+		entry_id, err = result.LastInsertId()
+	} else {
+		err = self.find.QueryRow(
+			lookup[entry.Server], lookup[entry.Station], entry.Time.UTC(),
+		).Scan(&entry_id)
+	}
+	if err != nil {
+		return 0, false, err
+	}
 
 	for name, sensors := range entry.Sensors {
 		for number, sensor := range sensors {
-			opts = append(opts, "(?, ?, ?, ?, ?)")
-
-			args = append(args, entry_id)
-			args = append(args, lookup[name])
-			args = append(args, number)
-			args = append(args, lookup[sensor.Unit])
-			args = append(args, sensor.Value)
-
+			_, err := self.sensor.Exec(entry_id, lookup[name], number,
+				lookup[sensor.Unit], sensor.Value)
+			if err != nil {
+				return 0, false, err
+			}
 		}
 	}
 
-	query += fmt.Sprintf("%v;", strings.Join(opts, ", "))
+	return entry_id, created, nil
+}
 
-	_, err = db.Exec(query, args...)
+// LatestEntryTime finds the time of a station's most recent entry.
+func LatestEntryTime(db *sql.DB, server string, station string) (time.Time, bool, error) {
+	query := fmt.Sprintf(`SELECT weather_entry.time FROM weather_entry 
+			%v
+			WHERE server.value = ? AND station.value = ?
+			ORDER BY weather_entry.time DESC
+			LIMIT 1`,
+		GenStringJoins("weather_entry", "server", "station"))
 
-	return entry_id, err
+	var latest time.Time
+	err := db.QueryRow(query, server, station).Scan(&latest)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return time.Time{}, false, nil
+		}
+		return time.Time{}, false, err
+	}
+	return latest, true, nil
 }
 
 func fetchSensorsFromEntry(db *sql.DB, id int) (map[string][]types.SensorValue, error) {
@@ -216,7 +335,8 @@ func FetchEntry(db *sql.DB, condition string, args ...any) (types.WeatherEntry,
 	query := fmt.Sprintf(`SELECT 	weather_entry.id, 
 											station.value, 
 											server.value, 
-											time FROM weather_entry
+											time,
+											backfilled FROM weather_entry
 			%v %v
 			LIMIT 1;`,
 		GenStringJoins("weather_entry", "station", "server"),
@@ -227,7 +347,8 @@ func FetchEntry(db *sql.DB, condition string, args ...any) (types.WeatherEntry,
 	var station string
 	var server string
 	var time time.Time
-	err := row.Scan(&id, &station, &server, &time)
+	var backfilled bool
+	err := row.Scan(&id, &station, &server, &time, &backfilled)
 	if err != nil {
 		return types.WeatherEntry{}, err
 	}
@@ -238,10 +359,11 @@ func FetchEntry(db *sql.DB, condition string, args ...any) (types.WeatherEntry,
 	}
 
 	return types.WeatherEntry{
-		Time:    time,
-		Station: station,
-		Server:  server,
-		Sensors: sensors,
+		Time:       time,
+		Station:    station,
+		Server:     server,
+		Sensors:    sensors,
+		Backfilled: backfilled,
 	}, nil
 }
 
@@ -249,7 +371,8 @@ func FetchEntries(db *sql.DB, condition string, args ...any) ([]types.WeatherEnt
 	query := fmt.Sprintf(`SELECT 	weather_entry.id, 
 											station.value, 
 											server.value, 
-											time FROM weather_entry
+											time,
+											backfilled FROM weather_entry
 					%v %v;`,
 		GenStringJoins("weather_entry", "station", "server"),
 		condition)
@@ -266,7 +389,8 @@ func FetchEntries(db *sql.DB, condition string, args ...any) ([]types.WeatherEnt
 		var station string
 		var server string
 		var time time.Time
-		err := rows.Scan(&id, &station, &server, &time)
+		var backfilled bool
+		err := rows.Scan(&id, &station, &server, &time, &backfilled)
 		if err != nil {
 			return []types.WeatherEntry{}, err
 		}
@@ -277,10 +401,12 @@ func FetchEntries(db *sql.DB, condition string, args ...any) ([]types.WeatherEnt
 		}
 
 		entries = append(entries, types.WeatherEntry{
-			Station: station,
-			Server:  server,
-			Time:    time,
-			Sensors: sensors,
+			ID:         int64(id),
+			Station:    station,
+			Server:     server,
+			Time:       time,
+			Sensors:    sensors,
+			Backfilled: backfilled,
 		})
 	}
 
@@ -306,17 +432,22 @@ func LastStationInfoUpdate(db *sql.DB, server string, station string) (time.Time
 	return updated, true, nil
 }
 
+// FetchStationInfo finds the info of a station, and whether it exists. A
+// station that doesn't exist isn't an error.
 func FetchStationInfo(db *sql.DB, server string, station string) (types.StationEntry, bool, error) {
 	query := fmt.Sprintf(`SELECT 
 			server.value, station.value, make.value, model.value, software.value,
 			version.value, latitude, longitude, elevation, district.value, 
-			city.value, region.value, country.value, rapid_weather, updated 
+			city.value, region.value, country.value, rapid_weather,
+			COALESCE(timezone.value, ''), updated 
 		FROM station 
 		%v
+		LEFT JOIN lookup_strings timezone ON station.timezone_id = timezone.id
 		WHERE server.value = ? AND station.value = ? 
 		LIMIT 1;`,
 		GenStringJoins("station", "make", "model", "software", "version",
-			"district", "city", "region", "country", "server", "station"))
+			"district", "city", "region", "country", "server",
+			"station"))
 
 	row := db.QueryRow(query, server, station)
 
@@ -334,14 +465,15 @@ func FetchStationInfo(db *sql.DB, server string, station string) (types.StationE
 	var region string
 	var country string
 	var rapid_weather bool
+	var timezone string
 	var updated time.Time
 
 	err := row.Scan(&server_val, &station_val, &make_val, &model, &software,
 		&version, &latitude, &longitude, &elevation, &district, &city, &region,
-		&country, &rapid_weather, &updated)
+		&country, &rapid_weather, &timezone, &updated)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return types.StationEntry{}, true, err
+			return types.StationEntry{}, false, nil
 		}
 		return types.StationEntry{}, false, err
 	}
@@ -361,6 +493,7 @@ func FetchStationInfo(db *sql.DB, server string, station string) (types.StationE
 		Region:       region,
 		Country:      country,
 		RapidWeather: rapid_weather,
+		Timezone:     timezone,
 		Updated:      updated,
 	}, true, nil
 
@@ -379,12 +512,15 @@ func FetchStationInfos(db *sql.DB, stations []types.StationKey) ([]types.Station
 	query := fmt.Sprintf(`SELECT 
 			server.value, station.value, make.value, model.value, software.value,
 			version.value, latitude, longitude, elevation, district.value, 
-			city.value, region.value, country.value, rapid_weather, updated 
+			city.value, region.value, country.value, rapid_weather,
+			COALESCE(timezone.value, ''), updated 
 		FROM station 
 		%v
+		LEFT JOIN lookup_strings timezone ON station.timezone_id = timezone.id
 		WHERE %v;`,
 		GenStringJoins("station", "make", "model", "software", "version",
-			"district", "city", "region", "country", "server", "station"),
+			"district", "city", "region", "country", "server",
+			"station"),
 		strings.Join(conditions, " OR "))
 
 	rows, err := db.Query(query, args...)
@@ -409,11 +545,12 @@ func FetchStationInfos(db *sql.DB, stations []types.StationKey) ([]types.Station
 		var region string
 		var country string
 		var rapid_weather bool
+		var timezone string
 		var updated time.Time
 
 		err := rows.Scan(&server_val, &station_val, &make_val, &model, &software,
 			&version, &latitude, &longitude, &elevation, &district, &city, &region,
-			&country, &rapid_weather, &updated)
+			&country, &rapid_weather, &timezone, &updated)
 		if err != nil {
 			return nil, err
 		}
@@ -433,6 +570,7 @@ func FetchStationInfos(db *sql.DB, stations []types.StationKey) ([]types.Station
 			Region:       region,
 			Country:      country,
 			RapidWeather: rapid_weather,
+			Timezone:     timezone,
 			Updated:      updated,
 		})
 	}
@@ -452,6 +590,7 @@ func UpdateStationInfo(db *sql.DB, entry types.StationEntry) error {
 		entry.City,
 		entry.Region,
 		entry.Country,
+		entry.Timezone,
 	})
 	query := `SELECT COUNT(station_id) FROM station
 		WHERE server_id = ? AND station_id = ?;`
@@ -478,6 +617,7 @@ func UpdateStationInfo(db *sql.DB, entry types.StationEntry) error {
 			region_id = ?,
 			country_id = ?,
 			rapid_weather = ?,
+			timezone_id = ?,
 			updated = ?
 			WHERE server_id = ? AND station_id = ?;`
 	} else {
@@ -494,18 +634,19 @@ func UpdateStationInfo(db *sql.DB, entry types.StationEntry) error {
 			region_id,
 			country_id,
 			rapid_weather,
+			timezone_id,
 			updated,
 			server_id,
 			station_id)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
 	}
 
 	_, err = db.Exec(query, lookup[entry.Make], lookup[entry.Model],
 		lookup[entry.Software], lookup[entry.Version], entry.Latitude,
 		entry.Longitude, entry.Elevation, lookup[entry.District],
 		lookup[entry.City], lookup[entry.Region], lookup[entry.Country],
-		entry.RapidWeather, entry.Updated, lookup[entry.Server],
-		lookup[entry.Station])
+		entry.RapidWeather, lookup[entry.Timezone], entry.Updated,
+		lookup[entry.Server], lookup[entry.Station])
 	return err
 }
 
@@ -525,11 +666,15 @@ func QueryStationInfos(db *sql.DB, condition string, args ...interface{}) ([]typ
 			region.value,
 			country.value,
 			rapid_weather,
+			COALESCE(timezone.value, ''),
 			updated 
 		FROM station 
-		%v %v;`,
+		%v
+		LEFT JOIN lookup_strings timezone ON station.timezone_id = timezone.id
+		%v;`,
 		GenStringJoins("station", "make", "model", "software", "version",
-			"district", "city", "region", "country", "server", "station"),
+			"district", "city", "region", "country", "server",
+			"station"),
 		condition)
 
 	result := []types.StationEntry{}
@@ -554,11 +699,12 @@ func QueryStationInfos(db *sql.DB, condition string, args ...interface{}) ([]typ
 		var region string
 		var country string
 		var rapid_weather bool
+		var timezone string
 		var updated time.Time
 
 		err := rows.Scan(&server_val, &station_val, &make_val, &model,
 			&software, &version, &latitude, &longitude, &elevation, &district,
-			&city, &region, &country, &rapid_weather, &updated)
+			&city, &region, &country, &rapid_weather, &timezone, &updated)
 		if err != nil {
 			return result, err
 		}
@@ -578,6 +724,7 @@ func QueryStationInfos(db *sql.DB, condition string, args ...interface{}) ([]typ
 			Region:       region,
 			Country:      country,
 			RapidWeather: rapid_weather,
+			Timezone:     timezone,
 			Updated:      updated,
 		}
 		result = append(result, info)
@@ -585,3 +732,56 @@ func QueryStationInfos(db *sql.DB, condition string, args ...interface{}) ([]typ
 
 	return result, nil
 }
+
+func FetchSensorHistory(db *sql.DB, server string, station string, after time.Time, before time.Time, names ...string) (map[string]types.SensorSeries, error) {
+	args := []interface{}{server, station, after, before}
+	name_query := ""
+	if len(names) > 0 {
+		placeholders := make([]string, len(names))
+		for i, name := range names {
+			placeholders[i] = "?"
+			args = append(args, name)
+		}
+		name_query = fmt.Sprintf("AND name.value IN (%v)", strings.Join(placeholders, ", "))
+	}
+
+	query := fmt.Sprintf(`SELECT
+			time, name.value, unit.value, sensor_value.value
+		FROM sensor_value
+		JOIN weather_entry ON sensor_value.entry_id = weather_entry.id
+		%v %v
+		WHERE server.value = ? AND station.value = ?
+			AND time >= ? AND time < ?
+			AND sensor_number = 0
+			%v
+		ORDER BY time ASC;`,
+		GenStringJoins("sensor_value", "name", "unit"),
+		GenStringJoins("weather_entry", "station", "server"),
+		name_query)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := make(map[string]types.SensorSeries)
+
+	for rows.Next() {
+		var time time.Time
+		var name string
+		var unit string
+		var value float64
+		if err := rows.Scan(&time, &name, &unit, &value); err != nil {
+			return nil, err
+		}
+
+		series := history[name]
+		series.Unit = unit
+		series.Times = append(series.Times, time)
+		series.Values = append(series.Values, value)
+		history[name] = series
+	}
+
+	return history, nil
+}
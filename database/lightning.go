@@ -0,0 +1,72 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/ttocsneb/weather/types"
+)
+
+func InsertLightningStrike(db *sql.DB, strike types.LightningStrike) (int64, error) {
+	lookup, err := GetOrInsertLookupStrings(db, []string{
+		strike.Server,
+		strike.Station,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	query := `INSERT INTO lightning_strike
+			(server_id, station_id, time, count, distance)
+			VALUES (?, ?, ?, ?, ?);`
+
+	var distance sql.NullFloat64
+	if strike.Distance != nil {
+		distance = sql.NullFloat64{Float64: *strike.Distance, Valid: true}
+	}
+
+	result, err := db.Exec(query, lookup[strike.Server], lookup[strike.Station],
+		strike.Time.UTC(), strike.Count, distance)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func QueryLightningStrikes(db *sql.DB, condition string, args ...interface{}) ([]types.LightningStrike, error) {
+	query := fmt.Sprintf(`SELECT
+			lightning_strike.id,
+			server.value,
+			station.value,
+			time,
+			count,
+			distance
+		FROM lightning_strike
+		%v %v;`,
+		GenStringJoins("lightning_strike", "server", "station"),
+		condition)
+
+	result := []types.LightningStrike{}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var strike types.LightningStrike
+		var distance sql.NullFloat64
+		err := rows.Scan(&strike.ID, &strike.Server, &strike.Station,
+			&strike.Time, &strike.Count, &distance)
+		if err != nil {
+			return result, err
+		}
+		if distance.Valid {
+			strike.Distance = &distance.Float64
+		}
+		result = append(result, strike)
+	}
+
+	return result, nil
+}
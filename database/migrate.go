@@ -0,0 +1,298 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A Migration brings a database created by an older version up to date. Each
+// is run once and is recorded in the migration table along with a value that
+// it may want to remember. A migration that fails part way is run again, so
+// it should either use a transaction or be safe to repeat.
+type Migration struct {
+	Name string
+	Run  func(db *sql.DB) (int64, error)
+}
+
+var migrations = []Migration{
+	{"legacy-entries", recordLegacyEntries},
+	{"station-timezone", func(db *sql.DB) (int64, error) {
+		return 0, addColumn(db, "station", "timezone_id", "INTEGER")
+	}},
+	{"unique-entries", uniqueEntries},
+	{"entry-backfilled", func(db *sql.DB) (int64, error) {
+		return 0, addColumn(db, "weather_entry", "backfilled", "BOOLEAN DEFAULT 0")
+	}},
+}
+
+// Migrate creates any tables missing from the schema and runs the migrations
+// that haven't been run on the database yet. Migrations from other packages
+// are run after the ones of this package.
+func Migrate(db *sql.DB, schema string, extra ...Migration) error {
+	_, err := db.Exec(schema)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range append(migrations, extra...) {
+		_, applied, err := migrationValue(db, m.Name)
+		if err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+		value, err := m.Run(db)
+		if err != nil {
+			return fmt.Errorf("%v: %w", m.Name, err)
+		}
+		_, err = db.Exec(`INSERT INTO migration (name, applied, value) VALUES (?, ?, ?);`,
+			m.Name, time.Now().UTC(), value)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Migrated the database: %v\n", m.Name)
+	}
+	return nil
+}
+
+type queryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func migrationValue(db queryer, name string) (int64, bool, error) {
+	var value int64
+	err := db.QueryRow(`SELECT value FROM migration WHERE name = ?;`, name).Scan(&value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return value, true, nil
+}
+
+// addColumn adds a column to a table created before the column was added to
+// the schema.
+func addColumn(db *sql.DB, table string, column string, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%v);", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		values := make([]any, len(columns))
+		name := ""
+		for i, c := range columns {
+			if c == "name" {
+				values[i] = &name
+			} else {
+				values[i] = new(any)
+			}
+		}
+		if err := rows.Scan(values...); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %v ADD COLUMN %v %v;", table,
+		column, definition))
+	return err
+}
+
+// recordLegacyEntries remembers the last entry stored before migrations were
+// added, as entries up to it were stored with the bugs of older versions.
+func recordLegacyEntries(db *sql.DB) (int64, error) {
+	var last sql.NullInt64
+	err := db.QueryRow(`SELECT MAX(id) FROM weather_entry;`).Scan(&last)
+	return last.Int64, err
+}
+
+// uniqueEntries makes the entries of a station unique by their time, which
+// older versions didn't enforce. Times used to be stored in whatever time zone
+// they were received in, so they are rewritten in UTC before the duplicates
+// are found. The sensors of duplicates are merged into the first entry at the
+// time, with later values replacing earlier ones as they would on ingest. The
+// number of duplicates that were removed is returned.
+func uniqueEntries(db *sql.DB) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, time FROM weather_entry
+			WHERE time NOT LIKE '%+00:00';`)
+	if err != nil {
+		return 0, err
+	}
+	times := make(map[int64]time.Time)
+	for rows.Next() {
+		var id int64
+		var t time.Time
+		if err := rows.Scan(&id, &t); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		times[id] = t
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for id, t := range times {
+		_, err := tx.Exec(`UPDATE weather_entry SET time = ? WHERE id = ?;`, t.UTC(), id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	rows, err = tx.Query(`SELECT entry.id, duplicates.keep FROM weather_entry entry
+			JOIN (SELECT server_id, station_id, time, MIN(id) AS keep
+				FROM weather_entry
+				GROUP BY server_id, station_id, time
+				HAVING COUNT(*) > 1) duplicates
+			ON entry.server_id = duplicates.server_id
+				AND entry.station_id = duplicates.station_id
+				AND entry.time = duplicates.time
+			WHERE entry.id != duplicates.keep
+			ORDER BY entry.id ASC;`)
+	if err != nil {
+		return 0, err
+	}
+	type duplicate struct {
+		id   int64
+		keep int64
+	}
+	duplicates := []duplicate{}
+	for rows.Next() {
+		var d duplicate
+		if err := rows.Scan(&d.id, &d.keep); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		duplicates = append(duplicates, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, d := range duplicates {
+		_, err := tx.Exec(`INSERT INTO sensor_value
+				(entry_id, name_id, sensor_number, unit_id, value)
+				SELECT ?, name_id, sensor_number, unit_id, value
+					FROM sensor_value WHERE entry_id = ?
+				ON CONFLICT (entry_id, name_id, sensor_number)
+				DO UPDATE SET unit_id = excluded.unit_id, value = excluded.value;`,
+			d.keep, d.id)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(`DELETE FROM sensor_value WHERE entry_id = ?;`, d.id)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(`DELETE FROM weather_entry WHERE id = ?;`, d.id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Tables created since the constraint was added to the schema already
+	// have it
+	var table string
+	err = tx.QueryRow(`SELECT sql FROM sqlite_master
+			WHERE type = 'table' AND name = 'weather_entry';`).Scan(&table)
+	if err != nil {
+		return 0, err
+	}
+	if !strings.Contains(table, "UQ_entry") {
+		_, err = tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS UQ_entry_time
+				ON weather_entry (server_id, station_id, time);`)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(duplicates)), tx.Commit()
+}
+
+// CorrectInchRain fixes the values of a station that reported in inches
+// before they were converted correctly. Inches used to be divided by 25.4
+// rather than multiplied, so they are stored 645.16 times too small. The old
+// entries of a station can't be told apart from ones that were reported in
+// millimeters, so the stations to correct have to be given. Each station is
+// only ever corrected once, and the times of the first and last entries that
+// were corrected are returned.
+func CorrectInchRain(db *sql.DB, server string, station string) (time.Time, time.Time, bool, error) {
+	name := fmt.Sprintf("inch-rain:%v/%v", server, station)
+	_, applied, err := migrationValue(db, name)
+	if err != nil || applied {
+		return time.Time{}, time.Time{}, false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return time.Time{}, time.Time{}, false, err
+	}
+	defer tx.Rollback()
+
+	legacy, _, err := migrationValue(tx, "legacy-entries")
+	if err != nil {
+		return time.Time{}, time.Time{}, false, err
+	}
+
+	entries := `SELECT weather_entry.id FROM weather_entry
+			JOIN lookup_strings server ON weather_entry.server_id = server.id
+			JOIN lookup_strings station ON weather_entry.station_id = station.id
+			WHERE server.value = ? AND station.value = ?
+				AND weather_entry.id <= ?`
+
+	result, err := tx.Exec(fmt.Sprintf(`UPDATE sensor_value SET value = value * 645.16
+			WHERE unit_id IN (SELECT id FROM lookup_strings WHERE value = 'mm')
+				AND entry_id IN (%v);`, entries),
+		server, station, legacy)
+	if err != nil {
+		return time.Time{}, time.Time{}, false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return time.Time{}, time.Time{}, false, err
+	}
+
+	var first, last time.Time
+	if affected > 0 {
+		err = tx.QueryRow(fmt.Sprintf(`SELECT time FROM weather_entry
+				WHERE id IN (%v) ORDER BY time ASC LIMIT 1;`, entries),
+			server, station, legacy).Scan(&first)
+		if err != nil {
+			return time.Time{}, time.Time{}, false, err
+		}
+		err = tx.QueryRow(fmt.Sprintf(`SELECT time FROM weather_entry
+				WHERE id IN (%v) ORDER BY time DESC LIMIT 1;`, entries),
+			server, station, legacy).Scan(&last)
+		if err != nil {
+			return time.Time{}, time.Time{}, false, err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO migration (name, applied, value) VALUES (?, ?, ?);`,
+		name, time.Now().UTC(), affected)
+	if err != nil {
+		return time.Time{}, time.Time{}, false, err
+	}
+	return first, last, affected > 0, tx.Commit()
+}
@@ -0,0 +1,223 @@
+package database
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ttocsneb/weather/types"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDB(t *testing.T) (*sql.DB, string) {
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, string(schema)
+}
+
+// Entries used to be stored without a unique constraint, and in the time zone
+// that they were received in.
+const legacyEntries = `
+CREATE TABLE lookup_strings (id INTEGER PRIMARY KEY AUTOINCREMENT, value TEXT);
+CREATE TABLE sensor_value (
+	entry_id INTEGER,
+	name_id INTEGER,
+	sensor_number INTEGER,
+	unit_id INTEGER,
+	value FLOAT,
+	PRIMARY KEY (entry_id, name_id, sensor_number)
+);
+CREATE TABLE weather_entry (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	station_id INTEGER,
+	server_id INTEGER,
+	time DATETIME
+);
+INSERT INTO lookup_strings (id, value) VALUES
+	(1, 's'), (2, 'a'), (3, 'temperature'), (4, 'c'), (5, 'humidity'), (6, '%');`
+
+func TestUniqueEntries(t *testing.T) {
+	db, schema := openTestDB(t)
+	if _, err := db.Exec(legacyEntries); err != nil {
+		t.Fatal(err)
+	}
+
+	mountain := time.FixedZone("-06:00", -6*60*60)
+	central := time.FixedZone("-05:00", -5*60*60)
+	legacy := []struct {
+		time    time.Time
+		sensors [][3]any
+	}{
+		// The same time from before and after a change in daylight saving
+		{time.Date(2024, 5, 1, 6, 0, 0, 0, mountain), [][3]any{{3, 4, 20.0}}},
+		{time.Date(2024, 5, 1, 7, 0, 0, 0, central), [][3]any{{3, 4, 21.0}, {5, 6, 50.0}}},
+		{time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), [][3]any{{5, 6, 55.0}}},
+		{time.Date(2024, 5, 1, 7, 30, 0, 0, central), [][3]any{{3, 4, 22.0}}},
+	}
+	for i, entry := range legacy {
+		_, err := db.Exec(`INSERT INTO weather_entry (id, station_id, server_id, time)
+				VALUES (?, 2, 1, ?);`, i+1, entry.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sensor := range entry.sensors {
+			_, err := db.Exec(`INSERT INTO sensor_value VALUES (?, ?, 0, ?, ?);`,
+				i+1, sensor[0], sensor[1], sensor[2])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := Migrate(db, schema); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, _, err := migrationValue(db, "unique-entries")
+	if err != nil || removed != 2 {
+		t.Errorf("removed %v duplicates: %v", removed, err)
+	}
+
+	rows, err := db.Query(`SELECT time || '' FROM weather_entry;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var stored string
+		if err := rows.Scan(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(stored, "+00:00") {
+			t.Errorf("%v wasn't rewritten in UTC", stored)
+		}
+	}
+	rows.Close()
+
+	entries, err := FetchEntries(db, "ORDER BY time ASC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string][]types.SensorValue{
+		// Later values replace earlier ones
+		{
+			types.SensorTemperature: {{Unit: "c", Value: 21}},
+			types.SensorHumidity:    {{Unit: "%", Value: 55}},
+		},
+		{types.SensorTemperature: {{Unit: "c", Value: 22}}},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %v entries", len(entries))
+	}
+	if entries[0].ID != 1 {
+		t.Errorf("kept entry %v rather than the first", entries[0].ID)
+	}
+	for i, entry := range entries {
+		if !reflect.DeepEqual(entry.Sensors, want[i]) {
+			t.Errorf("entry %v has %v, want %v", entry.ID, entry.Sensors, want[i])
+		}
+	}
+
+	var orphans int
+	err = db.QueryRow(`SELECT COUNT(*) FROM sensor_value
+			WHERE entry_id NOT IN (SELECT id FROM weather_entry);`).Scan(&orphans)
+	if err != nil || orphans != 0 {
+		t.Errorf("%v sensors of removed entries are left: %v", orphans, err)
+	}
+
+	_, err = db.Exec(`INSERT INTO weather_entry (station_id, server_id, time) VALUES (2, 1, ?);`,
+		time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	if err == nil {
+		t.Errorf("a duplicate could still be inserted")
+	}
+}
+
+func rainEntry(station string, t time.Time, rain float64) types.WeatherEntry {
+	return types.WeatherEntry{
+		Server:  "s",
+		Station: station,
+		Time:    t,
+		Sensors: map[string][]types.SensorValue{
+			types.SensorRain:        {{Unit: "mm", Value: rain}},
+			types.SensorTemperature: {{Unit: "c", Value: 20}},
+		},
+	}
+}
+
+func TestCorrectInchRain(t *testing.T) {
+	db, schema := openTestDB(t)
+	if _, err := db.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	// Only the entries from before migrations were added are corrected
+	for _, entry := range []types.WeatherEntry{
+		rainEntry("a", start, 0.01),
+		rainEntry("b", start, 0.01),
+		rainEntry("a", start.Add(time.Hour), 0.02),
+	} {
+		if _, _, err := InsertWeatherEntry(db, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Migrate(db, schema); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := InsertWeatherEntry(db, rainEntry("a", start.Add(2*time.Hour), 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	rain := func(station string) []float64 {
+		entries, err := FetchEntries(db, "WHERE station.value = ? ORDER BY time ASC", station)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := []float64{}
+		for _, entry := range entries {
+			values = append(values, entry.Sensors[types.SensorRain][0].Value)
+			if entry.Sensors[types.SensorTemperature][0].Value != 20 {
+				t.Errorf("%v's temperature was changed", station)
+			}
+		}
+		return values
+	}
+
+	first, last, corrected, err := CorrectInchRain(db, "s", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !corrected || !first.Equal(start) || !last.Equal(start.Add(time.Hour)) {
+		t.Errorf("corrected %v from %v to %v", corrected, first, last)
+	}
+	want := []float64{0.01 * 645.16, 0.02 * 645.16, 1}
+	got := rain("a")
+	for i := range want {
+		if i >= len(got) || got[i] < want[i]-1e-9 || got[i] > want[i]+1e-9 {
+			t.Fatalf("a has %v, want %v", got, want)
+		}
+	}
+	if got := rain("b"); !reflect.DeepEqual(got, []float64{0.01}) {
+		t.Errorf("b has %v", got)
+	}
+
+	// A station is only corrected once
+	_, _, corrected, err = CorrectInchRain(db, "s", "a")
+	if err != nil || corrected {
+		t.Errorf("corrected again: %v", err)
+	}
+	if got := rain("a"); got[0] > want[0]+1e-9 {
+		t.Errorf("a has %v after correcting again", got)
+	}
+}
@@ -0,0 +1,176 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FetchLatestSensorValue finds the most recent value before the given time of
+// any of the named sensors.
+func FetchLatestSensorValue(db *sql.DB, server string, station string, before time.Time, names ...string) (time.Time, string, float64, bool, error) {
+	placeholders := make([]string, len(names))
+	args := []interface{}{server, station, before}
+	for i, name := range names {
+		placeholders[i] = "?"
+		args = append(args, name)
+	}
+
+	query := fmt.Sprintf(`SELECT
+			time, name.value, sensor_value.value
+		FROM sensor_value
+		JOIN weather_entry ON sensor_value.entry_id = weather_entry.id
+		%v %v
+		WHERE server.value = ? AND station.value = ?
+			AND time < ?
+			AND sensor_number = 0
+			AND name.value IN (%v)
+		ORDER BY time DESC
+		LIMIT 1;`,
+		GenStringJoins("sensor_value", "name"),
+		GenStringJoins("weather_entry", "station", "server"),
+		strings.Join(placeholders, ", "))
+
+	row := db.QueryRow(query, args...)
+
+	var time time.Time
+	var name string
+	var value float64
+	err := row.Scan(&time, &name, &value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return time, "", 0, false, nil
+		}
+		return time, "", 0, false, err
+	}
+	return time, name, value, true, nil
+}
+
+// FetchNextSensorValue finds the earliest value after the given time of any
+// of the named sensors.
+func FetchNextSensorValue(db *sql.DB, server string, station string, after time.Time, names ...string) (time.Time, string, float64, bool, error) {
+	placeholders := make([]string, len(names))
+	args := []interface{}{server, station, after}
+	for i, name := range names {
+		placeholders[i] = "?"
+		args = append(args, name)
+	}
+
+	query := fmt.Sprintf(`SELECT
+			time, name.value, sensor_value.value
+		FROM sensor_value
+		JOIN weather_entry ON sensor_value.entry_id = weather_entry.id
+		%v %v
+		WHERE server.value = ? AND station.value = ?
+			AND time > ?
+			AND sensor_number = 0
+			AND name.value IN (%v)
+		ORDER BY time ASC
+		LIMIT 1;`,
+		GenStringJoins("sensor_value", "name"),
+		GenStringJoins("weather_entry", "station", "server"),
+		strings.Join(placeholders, ", "))
+
+	row := db.QueryRow(query, args...)
+
+	var time time.Time
+	var name string
+	var value float64
+	err := row.Scan(&time, &name, &value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return time, "", 0, false, nil
+		}
+		return time, "", 0, false, err
+	}
+	return time, name, value, true, nil
+}
+
+func AddRainDaily(db *sql.DB, server string, station string, day string, amount float64) error {
+	lookup, err := GetOrInsertLookupStrings(db, []string{server, station})
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO rain_daily (server_id, station_id, day, amount)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT (server_id, station_id, day)
+			DO UPDATE SET amount = amount + excluded.amount;`
+
+	_, err = db.Exec(query, lookup[server], lookup[station], day, amount)
+	return err
+}
+
+// FetchRainDaily fetches the daily rain totals of a station between from and
+// to (inclusive), formatted as 2006-01-02. Days without any rain are omitted.
+func FetchRainDaily(db *sql.DB, server string, station string, from string, to string) (map[string]float64, error) {
+	query := fmt.Sprintf(`SELECT day, amount FROM rain_daily
+			%v
+			WHERE server.value = ? AND station.value = ?
+				AND day >= ? AND day <= ?;`,
+		GenStringJoins("rain_daily", "server", "station"))
+
+	rows, err := db.Query(query, server, station, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := make(map[string]float64)
+	for rows.Next() {
+		var day string
+		var amount float64
+		if err := rows.Scan(&day, &amount); err != nil {
+			return nil, err
+		}
+		days[day] = amount
+	}
+	return days, nil
+}
+
+func SumRainDaily(db *sql.DB, server string, station string, from string, to string) (float64, error) {
+	query := fmt.Sprintf(`SELECT COALESCE(SUM(amount), 0) FROM rain_daily
+			%v
+			WHERE server.value = ? AND station.value = ?
+				AND day >= ? AND day <= ?;`,
+		GenStringJoins("rain_daily", "server", "station"))
+
+	row := db.QueryRow(query, server, station, from, to)
+
+	var total float64
+	err := row.Scan(&total)
+	return total, err
+}
+
+// SetRainDaily replaces the daily rain totals of a station between from and to
+// (inclusive).
+func SetRainDaily(db *sql.DB, server string, station string, from string, to string, days map[string]float64) error {
+	lookup, err := GetOrInsertLookupStrings(db, []string{server, station})
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM rain_daily
+			WHERE server_id = ? AND station_id = ?
+				AND day >= ? AND day <= ?;`,
+		lookup[server], lookup[station], from, to)
+	if err != nil {
+		return err
+	}
+	for day, amount := range days {
+		_, err = tx.Exec(`INSERT INTO rain_daily (server_id, station_id, day, amount)
+				VALUES (?, ?, ?, ?);`,
+			lookup[server], lookup[station], day, amount)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
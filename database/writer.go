@@ -0,0 +1,327 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/ttocsneb/weather/config"
+	"github.com/ttocsneb/weather/types"
+)
+
+// WriterStats describes the throughput and backlog of a writer.
+type WriterStats struct {
+	// Writes waiting to be made
+	Queued   int    `json:"queued"`
+	Capacity int    `json:"capacity"`
+	Batches  uint64 `json:"batches"`
+	Entries  uint64 `json:"entries"`
+	// Writes that failed
+	Errors uint64 `json:"errors"`
+	// Entries written per second over the last minute
+	Throughput    float64 `json:"throughput"`
+	LastBatchSize int     `json:"lastBatchSize"`
+	// How long the last batch took to write in milliseconds
+	LastBatchTime float64 `json:"lastBatchTime"`
+	// Lookup strings that are cached
+	Lookups int `json:"lookups"`
+}
+
+type writeResult struct {
+	ids     []int64
+	created []bool
+	err     error
+}
+
+type writeRequest struct {
+	entries    []types.WeatherEntry
+	backfilled bool
+	done       func(ids []int64, created []bool, err error)
+}
+
+// The window that throughput is measured over
+const throughputWindow = 60
+
+// How many times a batch is tried while the database is locked by another
+// connection, waiting a little longer before each
+const (
+	busyAttempts = 5
+	busyBackoff  = 100 * time.Millisecond
+)
+
+// Writer batches the entries that are being ingested, writing each batch in a
+// single transaction. The entries of each write are stored together, even if
+// another write in the same batch fails.
+type Writer struct {
+	db        *sql.DB
+	batchSize int
+	queue     chan *writeRequest
+	stmts     entryStatements
+	lookup    struct {
+		find   *sql.Stmt
+		insert *sql.Stmt
+	}
+
+	lock  sync.Mutex
+	stats WriterStats
+	// Lookup strings by value, which only the writer's goroutine uses
+	lookups map[string]int
+	// Entries written during each of the last throughputWindow seconds
+	written [throughputWindow]uint64
+	seconds [throughputWindow]int64
+}
+
+func NewWriter(db *sql.DB, conf config.WriterConfig) (*Writer, error) {
+	self := &Writer{
+		db:        db,
+		batchSize: max(conf.BatchSize, 1),
+		queue:     make(chan *writeRequest, max(conf.Queue, 1)),
+		lookups:   make(map[string]int),
+	}
+	var err error
+	self.stmts, err = prepareEntryStatements(db)
+	if err != nil {
+		return nil, err
+	}
+	self.lookup.find, err = db.Prepare(`SELECT id FROM lookup_strings WHERE value = ?;`)
+	if err != nil {
+		return nil, err
+	}
+	self.lookup.insert, err = db.Prepare(`INSERT INTO lookup_strings (value) VALUES (?);`)
+	if err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+// Enqueue queues entries to be written without waiting for them. Once they
+// have been, done is given the ids of the entries along with whether each was
+// created, like InsertWeatherEntry. done is called from the writer's
+// goroutine, so anything slow should be handed off to another. Enqueue only
+// blocks while the queue is full, which slows down ingest rather than
+// dropping entries.
+func (self *Writer) Enqueue(entries []types.WeatherEntry, backfilled bool, done func(ids []int64, created []bool, err error)) {
+	self.queue <- &writeRequest{
+		entries:    entries,
+		backfilled: backfilled,
+		done:       done,
+	}
+}
+
+// Write queues entries to be written and waits until they have been.
+func (self *Writer) Write(entries []types.WeatherEntry, backfilled bool) ([]int64, []bool, error) {
+	written := make(chan writeResult, 1)
+	self.Enqueue(entries, backfilled, func(ids []int64, created []bool, err error) {
+		written <- writeResult{ids: ids, created: created, err: err}
+	})
+	result := <-written
+	return result.ids, result.created, result.err
+}
+
+// Run writes the queued entries in batches.
+func (self *Writer) Run() {
+	for request := range self.queue {
+		batch := []*writeRequest{request}
+		size := len(request.entries)
+	collect:
+		for size < self.batchSize {
+			select {
+			case request := <-self.queue:
+				batch = append(batch, request)
+				size += len(request.entries)
+			default:
+				break collect
+			}
+		}
+
+		start := time.Now()
+		results := self.write(batch)
+		elapsed := time.Since(start)
+
+		written, failed := 0, 0
+		for i, request := range batch {
+			if results[i].err != nil {
+				failed++
+			} else {
+				written += len(request.entries)
+			}
+		}
+		self.record(start, size, written, failed, elapsed)
+		for i, request := range batch {
+			request.done(results[i].ids, results[i].created, results[i].err)
+		}
+	}
+}
+
+// write writes a batch, trying again while the database is locked. When the
+// batch fails as a whole, such as when one of its lookup strings can't be
+// inserted, each request is written on its own so that only the requests at
+// fault fail.
+func (self *Writer) write(batch []*writeRequest) []writeResult {
+	results, err := self.writeBatch(batch)
+	for attempt := 1; attempt < busyAttempts && busy(err); attempt++ {
+		time.Sleep(busyBackoff * time.Duration(attempt))
+		results, err = self.writeBatch(batch)
+	}
+	if err == nil {
+		return results
+	}
+
+	if len(batch) == 1 || busy(err) {
+		for i := range results {
+			results[i] = writeResult{err: err}
+		}
+		return results
+	}
+	for i, request := range batch {
+		results[i] = self.write([]*writeRequest{request})[0]
+	}
+	return results
+}
+
+// busy checks if a write failed because another connection held the lock.
+func busy(err error) bool {
+	var sqlite_err sqlite3.Error
+	if !errors.As(err, &sqlite_err) {
+		return false
+	}
+	return sqlite_err.Code == sqlite3.ErrBusy || sqlite_err.Code == sqlite3.ErrLocked
+}
+
+func (self *Writer) writeBatch(batch []*writeRequest) ([]writeResult, error) {
+	results := make([]writeResult, len(batch))
+
+	tx, err := self.db.Begin()
+	if err != nil {
+		return results, err
+	}
+	defer tx.Rollback()
+
+	// Lookup strings are only cached once they have been committed
+	lookups, err := self.resolveLookups(tx, batch)
+	if err != nil {
+		return results, err
+	}
+
+	stmts := self.stmts.in(tx)
+	for i, request := range batch {
+		results[i] = self.writeRequest(tx, stmts, lookups, request)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return results, err
+	}
+
+	for value, id := range lookups {
+		self.lookups[value] = id
+	}
+	self.lock.Lock()
+	self.stats.Lookups = len(self.lookups)
+	self.lock.Unlock()
+	return results, nil
+}
+
+// writeRequest writes the entries of a request within a savepoint, so that
+// they are either all written or none are.
+func (self *Writer) writeRequest(tx *sql.Tx, stmts entryStatements, lookups map[string]int, request *writeRequest) writeResult {
+	if _, err := tx.Exec("SAVEPOINT write;"); err != nil {
+		return writeResult{err: err}
+	}
+
+	result := writeResult{
+		ids:     make([]int64, len(request.entries)),
+		created: make([]bool, len(request.entries)),
+	}
+	for i, entry := range request.entries {
+		result.ids[i], result.created[i], result.err = stmts.insert(lookups, entry, request.backfilled)
+		if result.err != nil {
+			break
+		}
+	}
+
+	if result.err != nil {
+		tx.Exec("ROLLBACK TO write;")
+		result = writeResult{err: result.err}
+	}
+	if _, err := tx.Exec("RELEASE write;"); err != nil && result.err == nil {
+		result = writeResult{err: err}
+	}
+	return result
+}
+
+// resolveLookups finds the ids of every string that the batch uses, inserting
+// the ones that don't exist yet.
+func (self *Writer) resolveLookups(tx *sql.Tx, batch []*writeRequest) (map[string]int, error) {
+	lookups := make(map[string]int)
+	find := tx.Stmt(self.lookup.find)
+	insert := tx.Stmt(self.lookup.insert)
+
+	for _, request := range batch {
+		for _, value := range entryStrings(request.entries...) {
+			if _, exists := lookups[value]; exists {
+				continue
+			}
+			id, exists := self.lookups[value]
+			if exists {
+				lookups[value] = id
+				continue
+			}
+
+			err := find.QueryRow(value).Scan(&id)
+			if err == sql.ErrNoRows {
+				var result sql.Result
+				result, err = insert.Exec(value)
+				if err == nil {
+					var inserted int64
+					inserted, err = result.LastInsertId()
+					id = int(inserted)
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+			lookups[value] = id
+		}
+	}
+	return lookups, nil
+}
+
+func (self *Writer) record(start time.Time, size int, written int, failed int, elapsed time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.stats.Batches++
+	self.stats.Entries += uint64(written)
+	self.stats.Errors += uint64(failed)
+	self.stats.LastBatchSize = size
+	self.stats.LastBatchTime = float64(elapsed) / float64(time.Millisecond)
+
+	second := start.Unix()
+	i := second % throughputWindow
+	if self.seconds[i] != second {
+		self.seconds[i] = second
+		self.written[i] = 0
+	}
+	self.written[i] += uint64(written)
+}
+
+func (self *Writer) Stats() WriterStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	stats := self.stats
+	stats.Queued = len(self.queue)
+	stats.Capacity = cap(self.queue)
+
+	now := time.Now().Unix()
+	var written uint64
+	for i, second := range self.seconds {
+		if now-second < throughputWindow {
+			written += self.written[i]
+		}
+	}
+	stats.Throughput = float64(written) / throughputWindow
+	return stats
+}
@@ -0,0 +1,245 @@
+package database
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ttocsneb/weather/config"
+	"github.com/ttocsneb/weather/types"
+)
+
+// newTestWriter creates a writer on an empty database. Negative sensor values
+// and the lookup string "broken" can't be inserted, so that writes can be
+// made to fail.
+func newTestWriter(t *testing.T) (*sql.DB, *Writer) {
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := sql.Open("sqlite3", path+"?_txlock=immediate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := Migrate(db, string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		CREATE TRIGGER fail_sensor BEFORE INSERT ON sensor_value
+		WHEN NEW.value < 0
+		BEGIN SELECT RAISE(ABORT, 'negative value'); END;
+
+		CREATE TRIGGER fail_lookup BEFORE INSERT ON lookup_strings
+		WHEN NEW.value = 'broken'
+		BEGIN SELECT RAISE(ABORT, 'broken lookup'); END;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := NewWriter(db, config.WriterConfig{BatchSize: 100, Queue: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, writer
+}
+
+func testEntry(station string, value float64) types.WeatherEntry {
+	return types.WeatherEntry{
+		Server:  "s",
+		Station: station,
+		Time:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Sensors: map[string][]types.SensorValue{
+			types.SensorTemperature: {{Unit: "c", Value: value}},
+		},
+	}
+}
+
+func storedStations(t *testing.T, db *sql.DB) []string {
+	rows, err := db.Query(`SELECT station.value FROM weather_entry
+			JOIN lookup_strings station ON weather_entry.station_id = station.id
+			WHERE EXISTS (SELECT * FROM sensor_value
+				WHERE sensor_value.entry_id = weather_entry.id);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	stations := []string{}
+	for rows.Next() {
+		var station string
+		if err := rows.Scan(&station); err != nil {
+			t.Fatal(err)
+		}
+		stations = append(stations, station)
+	}
+	sort.Strings(stations)
+	return stations
+}
+
+func TestWriterIsolatesRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests [][]types.WeatherEntry
+		failed   []bool
+		stored   []string
+	}{
+		{
+			"every request is written",
+			[][]types.WeatherEntry{
+				{testEntry("a", 20)},
+				{testEntry("b", 21), testEntry("c", 22)},
+			},
+			[]bool{false, false},
+			[]string{"a", "b", "c"},
+		},
+		{
+			"a failed request doesn't affect the others",
+			[][]types.WeatherEntry{
+				{testEntry("a", 20)},
+				{testEntry("b", 21), testEntry("c", -1)},
+				{testEntry("d", 23)},
+			},
+			[]bool{false, true, false},
+			[]string{"a", "d"},
+		},
+		{
+			"every request fails",
+			[][]types.WeatherEntry{
+				{testEntry("a", -1)},
+				{testEntry("b", -1)},
+			},
+			[]bool{true, true},
+			[]string{},
+		},
+	}
+
+	for _, test := range tests {
+		db, writer := newTestWriter(t)
+
+		batch := make([]*writeRequest, len(test.requests))
+		for i, entries := range test.requests {
+			batch[i] = &writeRequest{entries: entries}
+		}
+		results, err := writer.writeBatch(batch)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		for i, result := range results {
+			if (result.err != nil) != test.failed[i] {
+				t.Errorf("%v: request %v got error %v", test.name, i, result.err)
+			}
+			if result.err == nil && len(result.ids) != len(test.requests[i]) {
+				t.Errorf("%v: request %v got %v ids", test.name, i, len(result.ids))
+			}
+		}
+		stored := storedStations(t, db)
+		if !reflect.DeepEqual(stored, test.stored) {
+			t.Errorf("%v: stored %v, want %v", test.name, stored, test.stored)
+		}
+	}
+}
+
+func TestWriterCachesCommittedLookups(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests [][]types.WeatherEntry
+		err      bool
+		cached   []string
+	}{
+		{
+			"committed lookups are cached",
+			[][]types.WeatherEntry{{testEntry("a", 20)}},
+			false,
+			[]string{"a", "s", types.SensorTemperature, "c"},
+		},
+		{
+			"lookups of a failed request are still committed",
+			[][]types.WeatherEntry{{testEntry("a", 20)}, {testEntry("b", -1)}},
+			false,
+			[]string{"a", "b", "s", types.SensorTemperature, "c"},
+		},
+		{
+			"lookups of a failed batch aren't cached",
+			[][]types.WeatherEntry{{testEntry("a", 20)}, {testEntry("broken", 21)}},
+			true,
+			[]string{},
+		},
+	}
+
+	for _, test := range tests {
+		db, writer := newTestWriter(t)
+
+		batch := make([]*writeRequest, len(test.requests))
+		for i, entries := range test.requests {
+			batch[i] = &writeRequest{entries: entries}
+		}
+		_, err := writer.writeBatch(batch)
+		if (err != nil) != test.err {
+			t.Errorf("%v: got error %v", test.name, err)
+		}
+
+		if len(writer.lookups) != len(test.cached) {
+			t.Errorf("%v: cached %v, want %v", test.name, writer.lookups, test.cached)
+		}
+		for _, value := range test.cached {
+			id, exists := writer.lookups[value]
+			if !exists {
+				t.Errorf("%v: %v wasn't cached", test.name, value)
+				continue
+			}
+			var stored int
+			err := db.QueryRow(`SELECT id FROM lookup_strings WHERE value = ?;`, value).Scan(&stored)
+			if err != nil {
+				t.Errorf("%v: %v wasn't committed: %v", test.name, value, err)
+				continue
+			}
+			if stored != id {
+				t.Errorf("%v: cached %v as %v, but it is %v", test.name, value, id, stored)
+			}
+		}
+	}
+}
+
+func TestWriterRetriesRequestsOfFailedBatch(t *testing.T) {
+	db, writer := newTestWriter(t)
+
+	// Queue the requests before the writer runs so they're in one batch
+	stations := []string{"a", "broken", "c"}
+	done := make(chan error, len(stations))
+	errs := make(map[string]error)
+	for _, station := range stations {
+		station := station
+		writer.Enqueue([]types.WeatherEntry{testEntry(station, 20)}, false,
+			func(ids []int64, created []bool, err error) {
+				if err == nil && (len(ids) != 1 || !created[0]) {
+					t.Errorf("%v: got %v, %v", station, ids, created)
+				}
+				errs[station] = err
+				done <- err
+			})
+	}
+	go writer.Run()
+	for range stations {
+		<-done
+	}
+
+	if errs["a"] != nil || errs["c"] != nil {
+		t.Errorf("good requests failed: %v", errs)
+	}
+	if errs["broken"] == nil {
+		t.Errorf("the broken request was written")
+	}
+	if stored := storedStations(t, db); !reflect.DeepEqual(stored, []string{"a", "c"}) {
+		t.Errorf("stored %v", stored)
+	}
+	if stats := writer.Stats(); stats.Batches != 1 || stats.Entries != 2 || stats.Errors != 1 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
@@ -0,0 +1,108 @@
+package events
+
+import (
+	"sync"
+
+	"github.com/ttocsneb/weather/pubsub"
+	"github.com/ttocsneb/weather/types"
+)
+
+// The number of events buffered for each subscriber before the subscription
+// policy kicks in
+const stationBuffer = 16
+
+// Subscribers to every station receive many more events, so they get a larger
+// buffer
+const allBuffer = 1024
+
+type ObservationSubscription = pubsub.Subscription[types.WeatherEntry]
+type StationInfoSubscription = pubsub.Subscription[types.StationEntry]
+
+// Bus carries normalised observations and station info changes from whatever
+// ingested them to anything interested in them, keyed by station.
+//
+// Handlers process every event in the order they were added before it is
+// published to subscribers, so subscribers will see anything the handlers
+// have stored for the event. Handlers are given the event from the goroutine
+// that published it, so they should be quick.
+type Bus struct {
+	lock                sync.RWMutex
+	observationHandlers []func(types.WeatherEntry)
+	stationInfoHandlers []func(types.StationEntry)
+
+	observations *pubsub.Hub[types.StationKey, types.WeatherEntry]
+	stationInfo  *pubsub.Hub[types.StationKey, types.StationEntry]
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		observations: pubsub.NewHub[types.StationKey, types.WeatherEntry]("observations"),
+		stationInfo:  pubsub.NewHub[types.StationKey, types.StationEntry]("station-info"),
+	}
+}
+
+func (self *Bus) HandleObservations(handler func(types.WeatherEntry)) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.observationHandlers = append(self.observationHandlers, handler)
+}
+
+func (self *Bus) HandleStationInfo(handler func(types.StationEntry)) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.stationInfoHandlers = append(self.stationInfoHandlers, handler)
+}
+
+// PublishObservation processes an observation that has been stored, then
+// sends it to its subscribers without blocking.
+func (self *Bus) PublishObservation(entry types.WeatherEntry) {
+	self.lock.RLock()
+	handlers := self.observationHandlers
+	self.lock.RUnlock()
+
+	for _, handler := range handlers {
+		handler(entry)
+	}
+	self.observations.Publish(entry.Key(), entry)
+}
+
+// PublishStationInfo processes a station's info once it has been stored,
+// then sends it to its subscribers without blocking.
+func (self *Bus) PublishStationInfo(info types.StationEntry) {
+	self.lock.RLock()
+	handlers := self.stationInfoHandlers
+	self.lock.RUnlock()
+
+	for _, handler := range handlers {
+		handler(info)
+	}
+	self.stationInfo.Publish(info.Key(), info)
+}
+
+func (self *Bus) SubscribeObservations(key types.StationKey, policy pubsub.Policy) *ObservationSubscription {
+	return self.observations.Subscribe(key, stationBuffer, policy)
+}
+func (self *Bus) UnsubscribeObservations(key types.StationKey, sub *ObservationSubscription) bool {
+	return self.observations.Unsubscribe(key, sub)
+}
+
+func (self *Bus) SubscribeAllObservations(policy pubsub.Policy) *ObservationSubscription {
+	return self.observations.SubscribeAll(allBuffer, policy)
+}
+func (self *Bus) UnsubscribeAllObservations(sub *ObservationSubscription) bool {
+	return self.observations.UnsubscribeAll(sub)
+}
+
+func (self *Bus) SubscribeStationInfo(key types.StationKey, policy pubsub.Policy) *StationInfoSubscription {
+	return self.stationInfo.Subscribe(key, stationBuffer, policy)
+}
+func (self *Bus) UnsubscribeStationInfo(key types.StationKey, sub *StationInfoSubscription) bool {
+	return self.stationInfo.Unsubscribe(key, sub)
+}
+
+func (self *Bus) SubscribeAllStationInfo(policy pubsub.Policy) *StationInfoSubscription {
+	return self.stationInfo.SubscribeAll(allBuffer, policy)
+}
+func (self *Bus) UnsubscribeAllStationInfo(sub *StationInfoSubscription) bool {
+	return self.stationInfo.UnsubscribeAll(sub)
+}
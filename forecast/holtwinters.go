@@ -0,0 +1,221 @@
+package forecast
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Damping applied to the trend so that long forecasts level off
+const damping = 0.98
+
+var (
+	alphas = []float64{0.05, 0.1, 0.2, 0.3, 0.5, 0.7, 0.9}
+	betas  = []float64{0.01, 0.05, 0.1, 0.2}
+	gammas = []float64{0.05, 0.1, 0.2, 0.4}
+)
+
+var ErrNotEnoughData = errors.New("not enough data to fit a model")
+
+// Model is an additive Holt-Winters model with a damped trend. If Period is 0,
+// the model has no seasonal component.
+type Model struct {
+	Alpha    float64
+	Beta     float64
+	Gamma    float64
+	Period   int
+	Level    float64
+	Trend    float64
+	Seasonal []float64
+	Sigma    float64
+	Unit     string
+	Start    time.Time
+	Step     time.Duration
+	Count    int
+}
+
+// Resample averages the samples into buckets of step width starting at start.
+// Empty buckets are linearly interpolated from their neighbours.
+func Resample(times []time.Time, values []float64, start time.Time, step time.Duration, count int) []float64 {
+	sums := make([]float64, count)
+	counts := make([]int, count)
+
+	for i, t := range times {
+		bucket := int(t.Sub(start) / step)
+		if bucket < 0 || bucket >= count {
+			continue
+		}
+		sums[bucket] += values[i]
+		counts[bucket] += 1
+	}
+
+	result := make([]float64, count)
+	last := -1
+	for i := range result {
+		if counts[i] == 0 {
+			result[i] = math.NaN()
+			continue
+		}
+		result[i] = sums[i] / float64(counts[i])
+		if last == -1 {
+			for j := 0; j < i; j++ {
+				result[j] = result[i]
+			}
+		} else {
+			for j := last + 1; j < i; j++ {
+				ratio := float64(j-last) / float64(i-last)
+				result[j] = result[last] + (result[i]-result[last])*ratio
+			}
+		}
+		last = i
+	}
+	if last == -1 {
+		return nil
+	}
+	for j := last + 1; j < count; j++ {
+		result[j] = result[last]
+	}
+
+	return result
+}
+
+func mean(values []float64) float64 {
+	total := 0.0
+	for _, value := range values {
+		total += value
+	}
+	return total / float64(len(values))
+}
+
+func (self *Model) initialize(values []float64) {
+	if self.Period == 0 {
+		self.Level = values[0]
+		self.Trend = values[1] - values[0]
+		self.Seasonal = nil
+		return
+	}
+
+	first := mean(values[:self.Period])
+	second := mean(values[self.Period : 2*self.Period])
+	self.Level = first
+	self.Trend = (second - first) / float64(self.Period)
+	self.Seasonal = make([]float64, self.Period)
+	for i := 0; i < self.Period; i++ {
+		self.Seasonal[i] = values[i] - first
+	}
+}
+
+// run smooths the values through the model and returns the sum of squared
+// one step ahead errors.
+func (self *Model) run(values []float64) float64 {
+	self.initialize(values)
+
+	sse := 0.0
+	for i, value := range values {
+		season := 0.0
+		if self.Period > 0 {
+			season = self.Seasonal[i%self.Period]
+		}
+
+		predicted := self.Level + damping*self.Trend + season
+		err := value - predicted
+		sse += err * err
+
+		level := self.Level
+		self.Level = self.Alpha*(value-season) + (1-self.Alpha)*(level+damping*self.Trend)
+		self.Trend = self.Beta*(self.Level-level) + (1-self.Beta)*damping*self.Trend
+		if self.Period > 0 {
+			self.Seasonal[i%self.Period] = self.Gamma*(value-self.Level) + (1-self.Gamma)*season
+		}
+	}
+
+	return sse
+}
+
+// Fit finds the smoothing parameters that best describe the values. Seasonal
+// models need at least two full periods of data, otherwise the seasonal
+// component is dropped.
+func Fit(values []float64, period int) (*Model, error) {
+	if len(values) < 6 {
+		return nil, ErrNotEnoughData
+	}
+	if len(values) < period*2 {
+		period = 0
+	}
+
+	seasonal_gammas := gammas
+	if period == 0 {
+		seasonal_gammas = []float64{0}
+	}
+
+	best := Model{Period: period}
+	best_sse := math.Inf(1)
+	for _, alpha := range alphas {
+		for _, beta := range betas {
+			for _, gamma := range seasonal_gammas {
+				model := Model{
+					Alpha:  alpha,
+					Beta:   beta,
+					Gamma:  gamma,
+					Period: period,
+				}
+				sse := model.run(values)
+				if sse < best_sse {
+					best_sse = sse
+					best = model
+				}
+			}
+		}
+	}
+
+	best.run(values)
+	best.Sigma = math.Sqrt(best_sse / float64(len(values)))
+	best.Count = len(values)
+
+	return &best, nil
+}
+
+type Prediction struct {
+	Time  time.Time
+	Value float64
+	Lower float64
+	Upper float64
+}
+
+// Predict forecasts the next steps after the data that the model was fit to
+// along with a 95% prediction interval.
+func (self *Model) Predict(steps int) []Prediction {
+	predictions := make([]Prediction, steps)
+
+	trend := 0.0
+	phi := 1.0
+	variance := 0.0
+	for h := 1; h <= steps; h++ {
+		phi *= damping
+		trend += phi * self.Trend
+
+		season := 0.0
+		if self.Period > 0 {
+			season = self.Seasonal[(self.Count+h-1)%self.Period]
+		}
+
+		if h > 1 {
+			c := self.Alpha * (1 + self.Beta*float64(h-1))
+			if self.Period > 0 && (h-1)%self.Period == 0 {
+				c += self.Gamma * (1 - self.Alpha)
+			}
+			variance += c * c
+		}
+		spread := 1.96 * self.Sigma * math.Sqrt(1+variance)
+
+		value := self.Level + trend + season
+		predictions[h-1] = Prediction{
+			Time:  self.Start.Add(time.Duration(self.Count+h-1) * self.Step),
+			Value: value,
+			Lower: value - spread,
+			Upper: value + spread,
+		}
+	}
+
+	return predictions
+}
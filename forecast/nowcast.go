@@ -0,0 +1,190 @@
+package forecast
+
+import (
+	"math"
+	"time"
+)
+
+// Zambretti forecast texts, indexed by letter from A to Z
+var zambrettiForecasts = []string{
+	"Settled fine",
+	"Fine weather",
+	"Becoming fine",
+	"Fine, becoming less settled",
+	"Fine, possible showers",
+	"Fairly fine, improving",
+	"Fairly fine, possible showers early",
+	"Fairly fine, showery later",
+	"Showery early, improving",
+	"Changeable, mending",
+	"Fairly fine, showers likely",
+	"Rather unsettled clearing later",
+	"Unsettled, probably improving",
+	"Showery, bright intervals",
+	"Showery, becoming less settled",
+	"Changeable, some rain",
+	"Unsettled, short fine intervals",
+	"Unsettled, rain later",
+	"Unsettled, some rain",
+	"Mostly very unsettled",
+	"Occasional rain, worsening",
+	"Rain at times, very unsettled",
+	"Rain at frequent intervals",
+	"Rain, very unsettled",
+	"Stormy, may improve",
+	"Stormy, much rain",
+}
+
+// Lookup tables from the pressure band to the forecast letter
+var (
+	zambrettiRising  = []int{25, 25, 25, 24, 24, 19, 16, 12, 11, 9, 8, 6, 5, 2, 1, 1, 0, 0, 0, 0, 0, 0}
+	zambrettiSteady  = []int{25, 25, 25, 25, 25, 25, 23, 23, 22, 18, 15, 13, 10, 4, 1, 1, 0, 0, 0, 0, 0, 0}
+	zambrettiFalling = []int{25, 25, 25, 25, 25, 25, 25, 25, 23, 23, 21, 20, 17, 14, 7, 3, 1, 1, 1, 0, 0, 0}
+)
+
+// Pressure adjustment for the wind direction in percent of the barometer
+// range, starting at north and going clockwise in 22.5° steps
+var zambrettiWind = []float64{
+	6, 5, 5, 2, -0.5, -2, -5, -8.5, -12, -10, -6, -4.5, -3, -0.5, 1.5, 3,
+}
+
+const (
+	zambrettiLow  = 950.0
+	zambrettiHigh = 1050.0
+)
+
+const (
+	TrendSteady = iota
+	TrendRising
+	TrendFalling
+)
+
+// PressureTendency classifies a 3 hour change in pressure (hPa) using the
+// Met Office's barometric tendency descriptions.
+func PressureTendency(delta float64) (int, string) {
+	magnitude := math.Abs(delta)
+
+	var description string
+	switch {
+	case magnitude < 0.1:
+		return TrendSteady, "steady"
+	case magnitude < 1.6:
+		description = "slowly"
+	case magnitude < 3.6:
+		description = ""
+	case magnitude < 6.0:
+		description = "quickly"
+	default:
+		description = "very rapidly"
+	}
+
+	trend := TrendRising
+	name := "rising"
+	if delta < 0 {
+		trend = TrendFalling
+		name = "falling"
+	}
+	if description != "" {
+		name += " " + description
+	}
+
+	// Slow changes are not enough to change the outlook
+	if magnitude < 1.6 {
+		trend = TrendSteady
+	}
+
+	return trend, name
+}
+
+// SeaLevelPressure reduces the pressure (hPa) measured at a station to sea
+// level using the hypsometric formula. elevation is in meters and
+// temperature is the air temperature at the station (°C), which may be NaN
+// if it is not known in which case the standard atmosphere is assumed.
+func SeaLevelPressure(pressure float64, elevation float64, temperature float64) float64 {
+	if math.IsNaN(temperature) {
+		temperature = 15 - 0.0065*elevation
+	}
+	return pressure * math.Pow(1-0.0065*elevation/(temperature+0.0065*elevation+273.15), -5.257)
+}
+
+// Zambretti produces a forecast letter and text from the sea level pressure
+// (hPa) and its trend. windDirection is in degrees and may be NaN if it is
+// not known.
+func Zambretti(pressure float64, trend int, windDirection float64, month time.Month, northern bool) (string, string) {
+	pressure_range := zambrettiHigh - zambrettiLow
+
+	if !math.IsNaN(windDirection) {
+		if !northern {
+			windDirection += 180
+		}
+		index := int(math.Floor(math.Mod(windDirection+11.25, 360) / 22.5))
+		if index < 0 {
+			index += len(zambrettiWind)
+		}
+		pressure += zambrettiWind[index%len(zambrettiWind)] / 100 * pressure_range
+	}
+
+	summer := month >= time.April && month <= time.September
+	if !northern {
+		summer = !summer
+	}
+	if summer {
+		switch trend {
+		case TrendRising:
+			pressure += 7.0 / 100 * pressure_range
+		case TrendFalling:
+			pressure -= 7.0 / 100 * pressure_range
+		}
+	}
+
+	if pressure >= zambrettiHigh {
+		pressure = zambrettiHigh - 1
+	}
+
+	options := zambrettiSteady
+	switch trend {
+	case TrendRising:
+		options = zambrettiRising
+	case TrendFalling:
+		options = zambrettiFalling
+	}
+
+	band := int(math.Floor((pressure - zambrettiLow) / (pressure_range / 22)))
+	if band < 0 {
+		band = 0
+	}
+	if band >= len(options) {
+		band = len(options) - 1
+	}
+
+	index := options[band]
+	return string(rune('A' + index)), zambrettiForecasts[index]
+}
+
+var beaufortLimits = []float64{0.5, 1.6, 3.4, 5.5, 8.0, 10.8, 13.9, 17.2, 20.8, 24.5, 28.5, 32.7}
+
+var beaufortDescriptions = []string{
+	"Calm",
+	"Light air",
+	"Light breeze",
+	"Gentle breeze",
+	"Moderate breeze",
+	"Fresh breeze",
+	"Strong breeze",
+	"Near gale",
+	"Gale",
+	"Strong gale",
+	"Storm",
+	"Violent storm",
+	"Hurricane force",
+}
+
+// Beaufort converts a wind speed in m/s to the Beaufort scale.
+func Beaufort(speed float64) (int, string) {
+	for i, limit := range beaufortLimits {
+		if speed < limit {
+			return i, beaufortDescriptions[i]
+		}
+	}
+	return len(beaufortLimits), beaufortDescriptions[len(beaufortLimits)]
+}
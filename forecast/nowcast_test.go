@@ -0,0 +1,127 @@
+package forecast
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestZambretti(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name      string
+		pressure  float64
+		trend     int
+		direction float64
+		month     time.Month
+		northern  bool
+		letter    string
+	}{
+		{"high and steady", 1030, TrendSteady, nan, time.January, true, "A"},
+		{"falling", 1002, TrendFalling, nan, time.January, true, "U"},
+		{"rising", 980, TrendRising, nan, time.January, true, "Q"},
+		{"rising in summer", 980, TrendRising, nan, time.July, true, "L"},
+		{"rising in the southern summer", 980, TrendRising, nan, time.January, false, "L"},
+		{"steady", 1002, TrendSteady, nan, time.January, true, "N"},
+		{"northerly wind", 1002, TrendSteady, 0, time.January, true, "K"},
+		{"wind just west of north", 1002, TrendSteady, 350, time.January, true, "K"},
+		{"wind given below zero", 1002, TrendSteady, -10, time.January, true, "K"},
+		{"southerly wind", 1002, TrendSteady, 180, time.January, true, "W"},
+		{"northerly wind in the south", 1002, TrendSteady, 0, time.January, false, "W"},
+		{"at the top of the range", 1050, TrendSteady, nan, time.January, true, "A"},
+		{"above the range", 1060, TrendSteady, nan, time.January, true, "A"},
+		{"below the range", 940, TrendFalling, nan, time.January, true, "Z"},
+	}
+
+	for _, test := range tests {
+		letter, text := Zambretti(test.pressure, test.trend, test.direction,
+			test.month, test.northern)
+		if letter != test.letter {
+			t.Errorf("%v: got %v, want %v", test.name, letter, test.letter)
+		}
+		if text != zambrettiForecasts[letter[0]-'A'] {
+			t.Errorf("%v: %v doesn't match %v", test.name, text, letter)
+		}
+	}
+}
+
+func TestPressureTendency(t *testing.T) {
+	// Changes on either side of each of the Met Office's limits
+	names := map[float64]string{
+		0:     "steady",
+		0.09:  "steady",
+		-0.09: "steady",
+		0.1:   "rising slowly",
+		-1.59: "falling slowly",
+		1.6:   "rising",
+		-3.59: "falling",
+		3.6:   "rising quickly",
+		-5.99: "falling quickly",
+		6:     "rising very rapidly",
+		-20:   "falling very rapidly",
+	}
+
+	for delta, want := range names {
+		trend, name := PressureTendency(delta)
+		if name != want {
+			t.Errorf("%v: got %v, want %v", delta, name, want)
+		}
+		// Only changes of at least 1.6 hPa are a trend
+		switch {
+		case math.Abs(delta) < 1.6 && trend != TrendSteady,
+			delta >= 1.6 && trend != TrendRising,
+			delta <= -1.6 && trend != TrendFalling:
+			t.Errorf("%v: got trend %v", delta, trend)
+		}
+	}
+}
+
+func TestSeaLevelPressure(t *testing.T) {
+	if p := SeaLevelPressure(1013.25, 0, 15); p != 1013.25 {
+		t.Errorf("got %v at sea level", p)
+	}
+	// The standard atmosphere is 8.5°C at 1000m
+	if p := SeaLevelPressure(900, 1000, math.NaN()); math.Abs(p-1014.69) > 0.01 {
+		t.Errorf("got %v without a temperature", p)
+	}
+	if a, b := SeaLevelPressure(900, 1000, math.NaN()), SeaLevelPressure(900, 1000, 8.5); a != b {
+		t.Errorf("without a temperature got %v, want %v", a, b)
+	}
+
+	// Colder air is denser, so more pressure is added for the same height
+	previous := 0.0
+	for elevation := 0.0; elevation <= 3000; elevation += 500 {
+		warm := SeaLevelPressure(900, elevation, 30)
+		cold := SeaLevelPressure(900, elevation, -10)
+		if cold < warm {
+			t.Errorf("at %vm: cold %v is less than warm %v", elevation, cold, warm)
+		}
+		if warm <= previous && elevation > 0 {
+			t.Errorf("at %vm: %v doesn't increase with elevation", elevation, warm)
+		}
+		previous = warm
+	}
+}
+
+func TestBeaufort(t *testing.T) {
+	tests := []struct {
+		speed  float64
+		number int
+	}{
+		{0, 0},
+		{0.49, 0},
+		{0.5, 1},
+		{10.8, 6},
+		{32.69, 11},
+		{32.7, 12},
+		{100, 12},
+	}
+
+	for _, test := range tests {
+		number, description := Beaufort(test.speed)
+		if number != test.number || description != beaufortDescriptions[test.number] {
+			t.Errorf("%v m/s: got %v %v, want %v", test.speed, number, description,
+				test.number)
+		}
+	}
+}
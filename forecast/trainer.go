@@ -0,0 +1,167 @@
+package forecast
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/types"
+)
+
+const (
+	modelStep   = time.Hour
+	modelPeriod = 24
+)
+
+type StationModels struct {
+	Trained time.Time
+	Sensors map[string]*Model
+}
+
+const (
+	ModelsReady = iota
+	// The station's models are being trained in the background
+	ModelsTraining
+	// The station doesn't have enough history to train any models
+	ModelsUnavailable
+)
+
+// Trainer keeps a forecasting model for every sensor of every station and
+// periodically retrains them from the stored history.
+type Trainer struct {
+	db       *sql.DB
+	interval time.Duration
+	history  time.Duration
+	lock     sync.RWMutex
+	models   map[types.StationKey]StationModels
+	// Stations that are being trained, or that didn't have enough history
+	// when they were last trained
+	training    map[types.StationKey]bool
+	unavailable map[types.StationKey]bool
+}
+
+func NewTrainer(db *sql.DB, interval time.Duration, history time.Duration) *Trainer {
+	return &Trainer{
+		db:          db,
+		interval:    interval,
+		history:     history,
+		models:      make(map[types.StationKey]StationModels),
+		training:    make(map[types.StationKey]bool),
+		unavailable: make(map[types.StationKey]bool),
+	}
+}
+
+// Train fits new models for a station from its history.
+func (self *Trainer) Train(key types.StationKey) (StationModels, error) {
+	end := time.Now().UTC().Truncate(modelStep)
+	start := end.Add(-self.history)
+	count := int(self.history / modelStep)
+
+	history, err := database.FetchSensorHistory(self.db, key.Server,
+		key.Station, start, end)
+	if err != nil {
+		return StationModels{}, err
+	}
+
+	models := StationModels{
+		Trained: time.Now(),
+		Sensors: make(map[string]*Model),
+	}
+
+	for name, series := range history {
+		// Angles can't be smoothed linearly
+		if series.Unit == "deg" || series.Unit == "rad" {
+			continue
+		}
+		values := Resample(series.Times, series.Values, start, modelStep, count)
+		if values == nil {
+			continue
+		}
+		// Don't extrapolate from before the station started reporting
+		first := int(series.Times[0].Sub(start) / modelStep)
+		if first > 0 {
+			values = values[first:]
+		}
+
+		model, err := Fit(values, modelPeriod)
+		if err != nil {
+			continue
+		}
+		model.Unit = series.Unit
+		model.Step = modelStep
+		model.Start = start.Add(time.Duration(first) * modelStep)
+		models.Sensors[name] = model
+	}
+
+	// Only stations with something to forecast are kept
+	self.lock.Lock()
+	if len(models.Sensors) > 0 {
+		self.models[key] = models
+		delete(self.unavailable, key)
+	} else {
+		delete(self.models, key)
+		self.unavailable[key] = true
+	}
+	self.lock.Unlock()
+
+	return models, nil
+}
+
+func (self *Trainer) TrainAll() error {
+	stations, err := database.QueryStationInfos(self.db, "")
+	if err != nil {
+		return err
+	}
+
+	for _, station := range stations {
+		key := types.StationKey{Server: station.Server, Station: station.Station}
+		_, err := self.Train(key)
+		if err != nil {
+			fmt.Printf("Could not train forecast for %v: %v\n", station.MapId(), err)
+		}
+	}
+	return nil
+}
+
+// Models returns the trained models for a station along with whether they
+// are ready. Stations that haven't been trained yet are trained in the
+// background, so only known stations should be asked for.
+func (self *Trainer) Models(key types.StationKey) (StationModels, int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if models, exists := self.models[key]; exists {
+		return models, ModelsReady
+	}
+	if self.unavailable[key] {
+		return StationModels{}, ModelsUnavailable
+	}
+	if !self.training[key] {
+		self.training[key] = true
+		go func() {
+			_, err := self.Train(key)
+			if err != nil {
+				fmt.Printf("Could not train forecast for %v/%v: %v\n", key.Server, key.Station, err)
+			}
+			self.lock.Lock()
+			delete(self.training, key)
+			self.lock.Unlock()
+		}()
+	}
+	return StationModels{}, ModelsTraining
+}
+
+func (self *Trainer) Run() {
+	for {
+		start := time.Now()
+		err := self.TrainAll()
+		if err != nil {
+			fmt.Printf("Could not train forecasts: %v\n", err)
+		} else {
+			fmt.Printf("Trained forecasts in %v\n", time.Since(start))
+		}
+		time.Sleep(self.interval)
+	}
+}
@@ -0,0 +1,68 @@
+package influx
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ttocsneb/weather/types"
+)
+
+// Observation is the readings of a station at a single time.
+type Observation struct {
+	Server  string
+	Message types.WeatherMessage
+}
+
+// Observations gathers points into observations. The station is given by the
+// station tag, and the server by the server tag, or the measurement if there
+// isn't one. Fields are the names of sensors in the units they are stored in,
+// and points of the same station and time are merged.
+func Observations(points []Point, now time.Time) ([]Observation, error) {
+	type key struct {
+		server  string
+		station string
+		time    int64
+	}
+	indices := make(map[key]int)
+	observations := []Observation{}
+
+	for i, point := range points {
+		station := point.Tags["station"]
+		if station == "" {
+			return nil, fmt.Errorf("point %v has no station tag", i+1)
+		}
+		server := point.Tags["server"]
+		if server == "" {
+			server = point.Measurement
+		}
+		t := point.Time
+		if t.IsZero() {
+			t = now
+		}
+
+		k := key{server, station, t.UnixNano()}
+		index, exists := indices[k]
+		if !exists {
+			index = len(observations)
+			indices[k] = index
+			observations = append(observations, Observation{
+				Server: server,
+				Message: types.WeatherMessage{
+					Time:    t,
+					ID:      station,
+					Sensors: make(map[string][]types.SensorValue),
+				},
+			})
+		}
+
+		sensors := observations[index].Message.Sensors
+		for name, value := range point.Fields {
+			sensors[name] = []types.SensorValue{{
+				Unit:  types.MetricUnits[name],
+				Value: value,
+			}}
+		}
+	}
+
+	return observations, nil
+}
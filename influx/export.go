@@ -0,0 +1,155 @@
+package influx
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ttocsneb/weather/config"
+	"github.com/ttocsneb/weather/types"
+)
+
+// Lines are written once there are this many, even if the interval hasn't
+// passed
+const maxBatch = 5000
+
+// The most lines kept while the write endpoint is unavailable
+const maxPending = 100000
+
+// Exporter mirrors every stored observation as line protocol to a file
+// and/or a write endpoint. Entries are queued as they are stored, including
+// backfilled and out of order ones, and written in the background so that
+// a slow endpoint doesn't hold up ingest.
+type Exporter struct {
+	conf   config.InfluxConfig
+	client *http.Client
+	file   *os.File
+
+	lock  sync.Mutex
+	batch []string
+	// Signalled once the batch is full
+	full chan struct{}
+
+	// Lines that couldn't be written to the endpoint, which only Run uses
+	pending []string
+}
+
+func NewExporter(conf config.InfluxConfig) (*Exporter, error) {
+	if conf.Interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive, not %v", conf.Interval)
+	}
+	self := &Exporter{
+		conf:   conf,
+		client: &http.Client{Timeout: 30 * time.Second},
+		full:   make(chan struct{}, 1),
+	}
+	if conf.File != "" {
+		file, err := os.OpenFile(conf.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		self.file = file
+	}
+	return self, nil
+}
+
+// Export queues stored entries to be written without waiting for them to be.
+func (self *Exporter) Export(entries []types.WeatherEntry) {
+	lines := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		point := FromEntry(self.conf.Measurement, entry)
+		if len(point.Fields) == 0 {
+			continue
+		}
+		lines = append(lines, point.Encode())
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	self.lock.Lock()
+	self.batch = append(self.batch, lines...)
+	full := len(self.batch) >= maxBatch
+	self.lock.Unlock()
+
+	if full {
+		select {
+		case self.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (self *Exporter) post(lines []string) error {
+	body := strings.Join(lines, "\n") + "\n"
+	req, err := http.NewRequest("POST", self.conf.URL, bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if self.conf.Token != "" {
+		req.Header.Set("Authorization", "Token "+self.conf.Token)
+	}
+
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("write endpoint responded with %v", resp.Status)
+	}
+	return nil
+}
+
+func (self *Exporter) flush() {
+	self.lock.Lock()
+	batch := self.batch
+	self.batch = nil
+	self.lock.Unlock()
+
+	if len(batch) == 0 && len(self.pending) == 0 {
+		return
+	}
+
+	if self.file != nil && len(batch) > 0 {
+		_, err := self.file.WriteString(strings.Join(batch, "\n") + "\n")
+		if err != nil {
+			fmt.Printf("Could not export to %v: %v\n", self.conf.File, err)
+		}
+	}
+
+	if self.conf.URL == "" {
+		return
+	}
+	// Lines that couldn't be written before are retried first
+	self.pending = append(self.pending, batch...)
+	if err := self.post(self.pending); err != nil {
+		fmt.Printf("Could not export to %v: %v\n", self.conf.URL, err)
+		if len(self.pending) > maxPending {
+			dropped := len(self.pending) - maxPending
+			self.pending = self.pending[dropped:]
+			fmt.Printf("Dropped %v lines that couldn't be exported\n", dropped)
+		}
+		return
+	}
+	self.pending = nil
+}
+
+// Run writes the queued entries until the program exits.
+func (self *Exporter) Run() {
+	ticker := time.NewTicker(self.conf.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-self.full:
+		case <-ticker.C:
+		}
+		self.flush()
+	}
+}
@@ -0,0 +1,143 @@
+package influx
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ttocsneb/weather/config"
+	"github.com/ttocsneb/weather/types"
+)
+
+func TestObservations(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	now := at.Add(time.Hour)
+	points := []Point{
+		{Measurement: "weather", Tags: map[string]string{"station": "a"},
+			Fields: map[string]float64{types.SensorTemperature: 20}, Time: at},
+		// Fields of the same station and time are merged
+		{Measurement: "weather", Tags: map[string]string{"station": "a"},
+			Fields: map[string]float64{types.SensorHumidity: 40}, Time: at},
+		{Measurement: "weather", Tags: map[string]string{"server": "home", "station": "a"},
+			Fields: map[string]float64{types.SensorTemperature: 21}, Time: at},
+		// Points without a time were made now
+		{Measurement: "weather", Tags: map[string]string{"station": "a"},
+			Fields: map[string]float64{types.SensorTemperature: 22}},
+	}
+
+	observations, err := Observations(points, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Observation{
+		{"weather", types.WeatherMessage{Time: at, ID: "a", Sensors: map[string][]types.SensorValue{
+			types.SensorTemperature: {{Unit: "c", Value: 20}},
+			types.SensorHumidity:    {{Unit: "%", Value: 40}},
+		}}},
+		{"home", types.WeatherMessage{Time: at, ID: "a", Sensors: map[string][]types.SensorValue{
+			types.SensorTemperature: {{Unit: "c", Value: 21}},
+		}}},
+		{"weather", types.WeatherMessage{Time: now, ID: "a", Sensors: map[string][]types.SensorValue{
+			types.SensorTemperature: {{Unit: "c", Value: 22}},
+		}}},
+	}
+	if !reflect.DeepEqual(observations, want) {
+		t.Errorf("got %+v, want %+v", observations, want)
+	}
+
+	points = append(points, Point{Measurement: "weather", Fields: map[string]float64{"x": 1}})
+	if _, err := Observations(points, now); err == nil || !strings.Contains(err.Error(), "point 5") {
+		t.Errorf("a point without a station gave %v", err)
+	}
+}
+
+func TestFromEntry(t *testing.T) {
+	point := FromEntry("weather", types.WeatherEntry{
+		Server:  "home",
+		Station: "a",
+		Time:    time.Unix(1700000000, 0).UTC(),
+		Sensors: map[string][]types.SensorValue{
+			types.SensorTemperature: {{Unit: "c", Value: 20}, {Unit: "c", Value: 18}},
+			types.SensorUV:          {{Unit: "uv", Value: math.NaN()}},
+			types.SensorHumidity:    {{Unit: "%", Value: math.Inf(1)}, {Unit: "%", Value: 40}},
+		},
+	})
+	want := "weather,server=home,station=a humidity_1=40,temperature=20,temperature_1=18 1700000000000000000"
+	if line := point.Encode(); line != want {
+		t.Errorf("got %v, want %v", line, want)
+	}
+}
+
+func TestExporter(t *testing.T) {
+	if _, err := NewExporter(config.InfluxConfig{}); err == nil {
+		t.Errorf("an exporter without an interval was created")
+	}
+
+	// The endpoint is down for the first write
+	var lock sync.Mutex
+	requests := []string{}
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		requests = append(requests, string(body))
+		if r.Header.Get("Authorization") != "Token secret" {
+			w.WriteHeader(401)
+		} else if len(requests) == 1 {
+			w.WriteHeader(503)
+		} else {
+			w.WriteHeader(204)
+		}
+	}))
+	defer endpoint.Close()
+
+	file := filepath.Join(t.TempDir(), "export.lp")
+	exporter, err := NewExporter(config.InfluxConfig{
+		Measurement: "weather",
+		File:        file,
+		URL:         endpoint.URL,
+		Token:       "secret",
+		Interval:    time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := func(station string, sensors map[string][]types.SensorValue) types.WeatherEntry {
+		return types.WeatherEntry{Server: "s", Station: station, Time: time.Unix(1, 0).UTC(), Sensors: sensors}
+	}
+	temperature := map[string][]types.SensorValue{types.SensorTemperature: {{Unit: "c", Value: 20}}}
+	a := "weather,server=s,station=a temperature=20 1000000000"
+	b := "weather,server=s,station=b temperature=20 1000000000"
+
+	// Entries without any fields aren't exported
+	exporter.Export([]types.WeatherEntry{entry("a", temperature), entry("empty", nil)})
+	exporter.flush()
+	exporter.Export([]types.WeatherEntry{entry("b", temperature)})
+	exporter.flush()
+	// Nothing new is written when there is nothing to export
+	exporter.flush()
+
+	written, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != a+"\n"+b+"\n" {
+		t.Errorf("wrote %q", written)
+	}
+	// The lines that couldn't be written are retried with the next batch
+	want := []string{a + "\n", a + "\n" + b + "\n"}
+	lock.Lock()
+	defer lock.Unlock()
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("posted %q, want %q", requests, want)
+	}
+}
@@ -0,0 +1,224 @@
+package influx
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ttocsneb/weather/types"
+)
+
+// Point is a single line of line protocol. Only numeric fields are kept, as
+// sensors can't hold anything else.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]float64
+	// Zero if the line had no timestamp
+	Time time.Time
+}
+
+// Precision converts the precision parameter of a write into the unit of its
+// timestamps, which defaults to nanoseconds.
+func Precision(value string) (time.Duration, error) {
+	switch value {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ", "µs":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("Unknown precision %v", value)
+}
+
+// split splits a string on a separator that hasn't been escaped with a
+// backslash or, if quotes is set, isn't inside a quoted string.
+func split(value string, sep byte, quotes bool, limit int) []string {
+	parts := []string{}
+	start := 0
+	quoted := false
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '\\':
+			i++
+		case quotes && value[i] == '"':
+			quoted = !quoted
+		case value[i] == sep && !quoted:
+			if limit > 0 && len(parts) == limit-1 {
+				continue
+			}
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
+
+func unescape(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+	var builder strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+		}
+		builder.WriteByte(value[i])
+	}
+	return builder.String()
+}
+
+func parseField(value string) (float64, bool) {
+	if value == "" || value[0] == '"' {
+		return 0, false
+	}
+	switch value {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true
+	}
+	if last := value[len(value)-1]; last == 'i' || last == 'u' {
+		i, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		return float64(i), err == nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	return f, err == nil
+}
+
+// ParseLine parses a single line of line protocol.
+func ParseLine(line string, precision time.Duration) (Point, error) {
+	sections := split(line, ' ', true, 3)
+	if len(sections) < 2 {
+		return Point{}, fmt.Errorf("Line has no fields")
+	}
+
+	series := split(sections[0], ',', false, 0)
+	point := Point{
+		Measurement: unescape(series[0]),
+		Tags:        make(map[string]string),
+		Fields:      make(map[string]float64),
+	}
+	if point.Measurement == "" {
+		return Point{}, fmt.Errorf("Line has no measurement")
+	}
+	for _, tag := range series[1:] {
+		kv := split(tag, '=', false, 2)
+		if len(kv) != 2 {
+			return Point{}, fmt.Errorf("Invalid tag %v", tag)
+		}
+		point.Tags[unescape(kv[0])] = unescape(kv[1])
+	}
+
+	for _, field := range split(sections[1], ',', true, 0) {
+		kv := split(field, '=', true, 2)
+		if len(kv) != 2 {
+			return Point{}, fmt.Errorf("Invalid field %v", field)
+		}
+		if value, ok := parseField(kv[1]); ok {
+			point.Fields[unescape(kv[0])] = value
+		}
+	}
+
+	if len(sections) == 3 && strings.TrimSpace(sections[2]) != "" {
+		timestamp, err := strconv.ParseInt(strings.TrimSpace(sections[2]), 10, 64)
+		if err != nil {
+			return Point{}, fmt.Errorf("Invalid timestamp %v", sections[2])
+		}
+		point.Time = time.Unix(0, timestamp*int64(precision)).UTC()
+	}
+
+	return point, nil
+}
+
+// Parse parses every line of a write, skipping blank lines and comments.
+func Parse(data string, precision time.Duration) ([]Point, error) {
+	points := []Point{}
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		point, err := ParseLine(line, precision)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", i+1, err)
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+var keyEscaper = strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ")
+var measurementEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ")
+
+func sortedKeys[T any](values map[string]T) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Encode formats a point as a line of line protocol, without a newline.
+func (self *Point) Encode() string {
+	var builder strings.Builder
+	builder.WriteString(measurementEscaper.Replace(self.Measurement))
+	for _, key := range sortedKeys(self.Tags) {
+		if self.Tags[key] == "" {
+			continue
+		}
+		builder.WriteString(fmt.Sprintf(",%v=%v",
+			keyEscaper.Replace(key), keyEscaper.Replace(self.Tags[key])))
+	}
+	for i, key := range sortedKeys(self.Fields) {
+		sep := ","
+		if i == 0 {
+			sep = " "
+		}
+		builder.WriteString(fmt.Sprintf("%v%v=%v", sep, keyEscaper.Replace(key),
+			strconv.FormatFloat(self.Fields[key], 'f', -1, 64)))
+	}
+	if !self.Time.IsZero() {
+		builder.WriteString(fmt.Sprintf(" %v", self.Time.UnixNano()))
+	}
+	return builder.String()
+}
+
+// FromEntry converts an entry into a point. When a sensor has several values,
+// the values after the first are suffixed by their index.
+func FromEntry(measurement string, entry types.WeatherEntry) Point {
+	point := Point{
+		Measurement: measurement,
+		Tags: map[string]string{
+			"server":  entry.Server,
+			"station": entry.Station,
+		},
+		Fields: make(map[string]float64),
+		Time:   entry.Time,
+	}
+	for name, values := range entry.Sensors {
+		for i, value := range values {
+			// Line protocol can't represent these
+			if math.IsNaN(value.Value) || math.IsInf(value.Value, 0) {
+				continue
+			}
+			key := name
+			if i > 0 {
+				key = fmt.Sprintf("%v_%v", name, i)
+			}
+			point.Fields[key] = value.Value
+		}
+	}
+	return point
+}
@@ -0,0 +1,117 @@
+package influx
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line      string
+		precision time.Duration
+		point     Point
+		err       bool
+	}{
+		{
+			"weather,station=abc temperature=21.5,humidity=40i 1700000000000000000",
+			time.Nanosecond,
+			Point{
+				Measurement: "weather",
+				Tags:        map[string]string{"station": "abc"},
+				Fields:      map[string]float64{"temperature": 21.5, "humidity": 40},
+				Time:        time.Unix(1700000000, 0).UTC(),
+			},
+			false,
+		},
+		{
+			"weather temperature=1 1700000000",
+			time.Second,
+			Point{
+				Measurement: "weather",
+				Tags:        map[string]string{},
+				Fields:      map[string]float64{"temperature": 1},
+				Time:        time.Unix(1700000000, 0).UTC(),
+			},
+			false,
+		},
+		{
+			`my\ weather,station\,id=a\ b\=c wind\ speed=3,note="a, b=c",raining=t`,
+			time.Nanosecond,
+			Point{
+				Measurement: "my weather",
+				Tags:        map[string]string{"station,id": "a b=c"},
+				// Strings can't be sensors, so they are skipped
+				Fields: map[string]float64{"wind speed": 3, "raining": 1},
+			},
+			false,
+		},
+		{"weather", time.Nanosecond, Point{}, true},
+		{",station=abc temperature=1", time.Nanosecond, Point{}, true},
+		{"weather,station temperature=1", time.Nanosecond, Point{}, true},
+		{"weather temperature", time.Nanosecond, Point{}, true},
+		{"weather temperature=1 soon", time.Nanosecond, Point{}, true},
+	}
+
+	for _, test := range tests {
+		point, err := ParseLine(test.line, test.precision)
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: expected an error", test.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(point, test.point) {
+			t.Errorf("%v: got %+v, want %+v", test.line, point, test.point)
+		}
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	points := []Point{
+		{
+			Measurement: "weather",
+			Tags:        map[string]string{"server": "home", "station": "abc"},
+			Fields:      map[string]float64{"temperature": 21.5, "rain-counter": 0.25},
+			Time:        time.Unix(1700000000, 123).UTC(),
+		},
+		{
+			Measurement: "my weather",
+			Tags:        map[string]string{"station,id": "a b=c"},
+			Fields:      map[string]float64{"wind speed": -3, "pressure": 1013.25},
+		},
+		{
+			Measurement: "weather",
+			Tags:        map[string]string{},
+			Fields:      map[string]float64{"uv": 1e-7},
+			Time:        time.Unix(0, 1).UTC(),
+		},
+	}
+
+	for _, point := range points {
+		line := point.Encode()
+		parsed, err := ParseLine(line, time.Nanosecond)
+		if err != nil {
+			t.Errorf("%v: %v", line, err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, point) {
+			t.Errorf("%v: got %+v, want %+v", line, parsed, point)
+		}
+	}
+}
+
+func TestEncodeSkipsEmptyTags(t *testing.T) {
+	point := Point{
+		Measurement: "weather",
+		Tags:        map[string]string{"server": "", "station": "abc"},
+		Fields:      map[string]float64{"b": 2, "a": 1},
+	}
+	if line := point.Encode(); line != "weather,station=abc a=1,b=2" {
+		t.Errorf("encoded %v", line)
+	}
+}
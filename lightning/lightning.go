@@ -0,0 +1,111 @@
+package lightning
+
+import (
+	"database/sql"
+	"math"
+	"time"
+
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/types"
+	"github.com/ttocsneb/weather/util"
+)
+
+func sensorValue(sensors map[string][]types.SensorValue, name string) (float64, bool) {
+	values, exists := sensors[name]
+	if !exists || len(values) == 0 {
+		return 0, false
+	}
+	value, _ := util.SensorToMetric(values[0].Value, values[0].Unit, name)
+	return value, true
+}
+
+// HasLightning checks whether a station reports lightning.
+func HasLightning(sensors map[string][]types.SensorValue) bool {
+	_, counter := sensors[types.SensorLightningCounter]
+	_, strikes := sensors[types.SensorLightning]
+	return counter || strikes
+}
+
+// Detect finds how many strikes a station has detected since its previous
+// message.
+func Detect(db *sql.DB, entry types.WeatherEntry) (int, error) {
+	if strikes, exists := sensorValue(entry.Sensors, types.SensorLightning); exists {
+		return int(math.Max(strikes, 0)), nil
+	}
+
+	count, exists := sensorValue(entry.Sensors, types.SensorLightningCounter)
+	if !exists {
+		return 0, nil
+	}
+
+	_, _, prev, exists, err := database.FetchLatestSensorValue(db, entry.Server,
+		entry.Station, entry.Time.UTC(), types.SensorLightningCounter)
+	if err != nil || !exists {
+		return 0, err
+	}
+	if count < prev {
+		// The station was reset
+		return int(count), nil
+	}
+	return int(count - prev), nil
+}
+
+// Record stores any lightning that a station detected in an entry.
+func Record(db *sql.DB, entry types.WeatherEntry) (types.LightningStrike, bool, error) {
+	count, err := Detect(db, entry)
+	if err != nil || count == 0 {
+		return types.LightningStrike{}, false, err
+	}
+
+	strike := types.LightningStrike{
+		Server:  entry.Server,
+		Station: entry.Station,
+		Time:    entry.Time.UTC(),
+		Count:   count,
+	}
+	if distance, exists := sensorValue(entry.Sensors, types.SensorLightningDistance); exists {
+		strike.Distance = &distance
+	}
+
+	strike.ID, err = database.InsertLightningStrike(db, strike)
+	if err != nil {
+		return strike, false, err
+	}
+	return strike, true, nil
+}
+
+// FetchStrikes fetches the lightning that a station has detected since a
+// given time.
+func FetchStrikes(db *sql.DB, server string, station string, after time.Time) ([]types.LightningStrike, error) {
+	return database.QueryLightningStrikes(db, `WHERE server.value = ?
+			AND station.value = ?
+			AND time >= ?
+		ORDER BY time ASC`,
+		server, station, after.UTC())
+}
+
+type Summary struct {
+	Count int
+	// Strikes per minute
+	Rate float64
+	// Distance of the nearest strike in km
+	Nearest *float64
+	Last    *time.Time
+}
+
+func Summarize(strikes []types.LightningStrike, window time.Duration) Summary {
+	var summary Summary
+	for _, strike := range strikes {
+		summary.Count += strike.Count
+		if strike.Distance != nil && (summary.Nearest == nil || *strike.Distance < *summary.Nearest) {
+			distance := *strike.Distance
+			summary.Nearest = &distance
+		}
+		if summary.Last == nil || strike.Time.After(*summary.Last) {
+			t := strike.Time
+			summary.Last = &t
+		}
+	}
+	summary.Rate = float64(summary.Count) / window.Minutes()
+	return summary
+}
@@ -0,0 +1,114 @@
+package lightning
+
+import (
+	"math"
+
+	"github.com/ttocsneb/weather/util"
+)
+
+// Observation is how far a station thinks a storm is from it.
+type Observation struct {
+	Latitude  float64
+	Longitude float64
+	// km
+	Distance float64
+}
+
+type Storm struct {
+	Latitude  float64
+	Longitude float64
+	// Root mean square difference between the observed and estimated distances
+	// in km
+	Error    float64
+	Stations int
+}
+
+// Distance of a degree of latitude in km
+const kmPerDegree = 111.32
+
+// LocateStorm estimates where a storm is by finding the point whose distance
+// to each station best matches the distance that station observed. A single
+// distance only describes a ring around a station, so at least three stations
+// are needed.
+func LocateStorm(observations []Observation) (Storm, bool) {
+	if len(observations) < 3 {
+		return Storm{}, false
+	}
+
+	// Work on a flat plane centered on the stations, which is accurate enough
+	// over the range of a lightning detector
+	lat0 := 0.0
+	lon0 := 0.0
+	for _, obs := range observations {
+		lat0 += obs.Latitude
+		lon0 += obs.Longitude
+	}
+	lat0 /= float64(len(observations))
+	lon0 /= float64(len(observations))
+	scale := math.Cos(lat0 * math.Pi / 180)
+
+	xs := make([]float64, len(observations))
+	ys := make([]float64, len(observations))
+	for i, obs := range observations {
+		xs[i] = (obs.Longitude - lon0) * kmPerDegree * scale
+		ys[i] = (obs.Latitude - lat0) * kmPerDegree
+	}
+
+	// Start at the station with the closest strike, offset slightly so that
+	// the gradient is defined
+	x, y := 0.0, 0.0
+	closest := math.Inf(1)
+	for i, obs := range observations {
+		if obs.Distance < closest {
+			closest = obs.Distance
+			x, y = xs[i]+0.1, ys[i]+0.1
+		}
+	}
+
+	// Gauss-Newton iterations on the range residuals
+	for iter := 0; iter < 50; iter++ {
+		var a11, a12, a22, b1, b2 float64
+		for i, obs := range observations {
+			dx := x - xs[i]
+			dy := y - ys[i]
+			r := math.Max(math.Hypot(dx, dy), 1e-6)
+			jx := dx / r
+			jy := dy / r
+			residual := r - obs.Distance
+
+			a11 += jx * jx
+			a12 += jx * jy
+			a22 += jy * jy
+			b1 += jx * residual
+			b2 += jy * residual
+		}
+
+		det := a11*a22 - a12*a12
+		if math.Abs(det) < 1e-12 {
+			// The stations are in a line, so there are two equally good
+			// solutions
+			return Storm{}, false
+		}
+		step_x := (a22*b1 - a12*b2) / det
+		step_y := (a11*b2 - a12*b1) / det
+		x -= step_x
+		y -= step_y
+		if math.Hypot(step_x, step_y) < 0.01 {
+			break
+		}
+	}
+
+	storm := Storm{
+		Latitude:  lat0 + y/kmPerDegree,
+		Longitude: util.ModBounds(lon0+x/(kmPerDegree*scale)+180, 360) - 180,
+		Stations:  len(observations),
+	}
+	sum := 0.0
+	for _, obs := range observations {
+		d := util.HarvesineDistance(storm.Latitude, storm.Longitude, obs.Latitude, obs.Longitude)
+		sum += math.Pow(d-obs.Distance, 2)
+	}
+	storm.Error = math.Sqrt(sum / float64(len(observations)))
+
+	return storm, true
+}
@@ -1,19 +1,99 @@
 package main
 
 import (
+	_ "embed"
 	"fmt"
+	"strings"
+	"time"
 
 	"os"
 
 	"github.com/ttocsneb/weather/config"
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/events"
+	"github.com/ttocsneb/weather/forecast"
+	"github.com/ttocsneb/weather/influx"
+	"github.com/ttocsneb/weather/rain"
+	"github.com/ttocsneb/weather/rtl433"
 	"github.com/ttocsneb/weather/server"
 	"github.com/ttocsneb/weather/stations"
+	"github.com/ttocsneb/weather/tz"
 
 	"database/sql"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+//go:embed schema.sql
+var schema string
+
+// correctInchRain fixes the rain of stations that reported in inches before
+// inches were converted correctly, and rebuilds their daily totals.
+func correctInchRain(db *sql.DB, keys []string) error {
+	for _, key := range keys {
+		server, station, found := strings.Cut(key, "/")
+		if !found {
+			return fmt.Errorf("%v must be given as server/station", key)
+		}
+		first, last, corrected, err := database.CorrectInchRain(db, server, station)
+		if err != nil {
+			return err
+		}
+		if !corrected {
+			continue
+		}
+		loc, err := tz.StationLocation(db, server, station)
+		if err != nil {
+			return err
+		}
+		err = rain.Recompute(db, server, station, first, last, loc)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Corrected the rain of %v from %v to %v\n", key,
+			first.Format(time.DateOnly), last.Format(time.DateOnly))
+	}
+	return nil
+}
+
+// startRtl433 ingests the readings of rtl_433 from a broker and/or a file.
+func startRtl433(db *sql.DB, bus *events.Bus, brokers map[string]stations.Broker, conf config.Rtl433Config) error {
+	adapter, err := rtl433.NewAdapter(db, bus, conf)
+	if err != nil {
+		return err
+	}
+
+	if conf.Broker != "" {
+		broker, exists := brokers[conf.Broker]
+		if !exists {
+			return fmt.Errorf("rtl_433 broker %v is not configured", conf.Broker)
+		}
+		if err := adapter.Subscribe(&broker); err != nil {
+			return err
+		}
+	}
+
+	if conf.File != "" {
+		reader := os.Stdin
+		if conf.File != "-" {
+			file, err := os.Open(conf.File)
+			if err != nil {
+				return err
+			}
+			reader = file
+		}
+		go func() {
+			defer reader.Close()
+			if err := adapter.Read(reader); err != nil {
+				fmt.Printf("Could not read rtl_433 output: %v\n", err)
+			}
+			fmt.Println("Finished reading rtl_433 output")
+		}()
+	}
+
+	return nil
+}
+
 func main() {
 	args := os.Args
 	path := "config.toml"
@@ -32,7 +112,15 @@ func main() {
 		return
 	}
 
-	db, err := sql.Open("sqlite3", conf.Database)
+	// Transactions take the write lock as they begin, rather than failing
+	// with SQLITE_BUSY part way through when another connection wrote first
+	dsn := conf.Database
+	if strings.Contains(dsn, "?") {
+		dsn += "&_txlock=immediate"
+	} else {
+		dsn += "?_txlock=immediate"
+	}
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		panic(err)
 	}
@@ -40,19 +128,73 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	err = database.Migrate(db, schema,
+		database.Migration{Name: "station-timezones-boundaries", Run: tz.UpdateTimezones})
+	if err != nil {
+		fmt.Printf("Could not migrate the database: %v\n", err)
+		return
+	}
+	err = correctInchRain(db, conf.Migrate.InchRain)
+	if err != nil {
+		fmt.Printf("Could not correct inch rain: %v\n", err)
+		return
+	}
+
+	// Let streams keep reading while observations are being written
+	_, err = db.Exec("PRAGMA journal_mode=WAL;")
+	if err != nil {
+		panic(err)
+	}
+
+	writer, err := database.NewWriter(db, conf.Writer)
+	if err != nil {
+		panic(err)
+	}
+	go writer.Run()
+
+	var exporter stations.Exporter
+	if conf.Influx.File != "" || conf.Influx.URL != "" {
+		influx_exporter, err := influx.NewExporter(conf.Influx)
+		if err != nil {
+			fmt.Printf("Invalid influx config: %v\n", err)
+			return
+		}
+		go influx_exporter.Run()
+		exporter = influx_exporter
+	}
+
+	if err := stations.ConfigureIngest(conf.Ingest, writer, exporter); err != nil {
+		fmt.Printf("Invalid ingest config: %v\n", err)
+		return
+	}
+
+	bus := events.NewBus()
+	stations.Process(db, bus)
 
 	brokers := make(map[string]stations.Broker)
 
 	for broker, server := range conf.Brokers {
-		server, err := stations.NewBroker(db, conf.Id, broker, server)
+		id := stations.ClientId(server.ClientId, conf.Id, conf.Instance, broker)
+		server, err := stations.NewBroker(db, bus, id, broker, server)
 		if err != nil {
-			panic(err)
+			fmt.Printf("Could not configure broker %v: %v\n", broker, err)
+			return
 		}
 		brokers[broker] = server
 		defer brokers[broker].Client.Disconnect(500)
 	}
 
+	if conf.Rtl433.Broker != "" || conf.Rtl433.File != "" {
+		err = startRtl433(db, bus, brokers, conf.Rtl433)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	trainer := forecast.NewTrainer(db, conf.Forecast.Interval, conf.Forecast.History)
+	go trainer.Run()
+
 	fmt.Println("Started Server")
 
-	server.Serve(conf.Port, db, brokers)
+	server.Serve(conf.Port, db, brokers, bus, trainer, conf.Tokens)
 }
@@ -0,0 +1,44 @@
+package protocols
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/ttocsneb/weather/types"
+)
+
+var ecowittFields = []field{
+	{types.SensorTemperature, "f", []string{"tempf"}},
+	{types.SensorHumidity, "%", []string{"humidity"}},
+	{types.SensorIndoorTemperature, "f", []string{"tempinf"}},
+	{types.SensorIndoorHumidity, "%", []string{"humidityin"}},
+	{types.SensorPressure, "inhg", []string{"baromabsin"}},
+	{types.SensorSeaLevelPressure, "inhg", []string{"baromrelin"}},
+	{types.SensorWindSpeed, "mph", []string{"windspeedmph"}},
+	{types.SensorWindGust, "mph", []string{"windgustmph"}},
+	{types.SensorWindDirection, "deg", []string{"winddir"}},
+	{types.SensorSolarRadiation, "w/m2", []string{"solarradiation"}},
+	{types.SensorUV, "uv", []string{"uv"}},
+	// Piezo gauges report under their own names
+	{types.SensorRainCounter, "in", []string{"totalrainin", "train_piezo"}},
+	{types.SensorRainDaily, "in", []string{"dailyrainin", "drain_piezo"}},
+	{types.SensorPM25, "ug/m3", []string{"pm25_ch1", "pm25_co2"}},
+	{types.SensorPM10, "ug/m3", []string{"pm10_co2"}},
+	{types.SensorCO2, "ppm", []string{"co2"}},
+	{types.SensorLightningCounter, "", []string{"lightning_num"}},
+	{types.SensorLightningDistance, "km", []string{"lightning"}},
+}
+
+// Ecowitt parses the form of an Ecowitt upload, using the console's PASSKEY as
+// the station id. The sensors are left in the units they were sent in.
+func Ecowitt(values url.Values) (types.WeatherMessage, error) {
+	message := types.WeatherMessage{
+		Time:    parseDate(values.Get("dateutc")),
+		ID:      values.Get("PASSKEY"),
+		Sensors: parseFields(values, ecowittFields),
+	}
+	if len(message.Sensors) == 0 {
+		return message, errors.New("No readings were given")
+	}
+	return message, nil
+}
@@ -0,0 +1,53 @@
+package protocols
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ttocsneb/weather/types"
+)
+
+// Consoles send this in place of readings they don't have
+const missingValue = -9999
+
+// field maps the parameters of an upload protocol onto a sensor. The first of
+// the keys that has a value is used.
+type field struct {
+	sensor string
+	unit   string
+	keys   []string
+}
+
+func parseFields(values url.Values, fields []field) map[string][]types.SensorValue {
+	sensors := make(map[string][]types.SensorValue)
+	for _, field := range fields {
+		for _, key := range field.keys {
+			value, err := strconv.ParseFloat(strings.TrimSpace(values.Get(key)), 64)
+			if err != nil || value <= missingValue {
+				continue
+			}
+			sensors[field.sensor] = []types.SensorValue{{
+				Unit:  field.unit,
+				Value: value,
+			}}
+			break
+		}
+	}
+	return sensors
+}
+
+// parseDate parses the dateutc parameter which is either "now" or a UTC time
+// such as "2006-01-02 15:04:05".
+func parseDate(value string) time.Time {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.EqualFold(value, "now") {
+		return time.Now()
+	}
+	t, err := time.Parse("2006-01-02 15:04:05", value)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
@@ -0,0 +1,161 @@
+package protocols
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ttocsneb/weather/types"
+)
+
+func TestParseFields(t *testing.T) {
+	fields := []field{
+		{types.SensorTemperature, "f", []string{"tempf"}},
+		{types.SensorRainDaily, "in", []string{"dailyrainin", "drain_piezo"}},
+		{types.SensorUV, "uv", []string{"UV", "uv"}},
+	}
+
+	tests := []struct {
+		name    string
+		query   string
+		sensors map[string][]types.SensorValue
+	}{
+		{
+			"every field",
+			"tempf=70.5&dailyrainin=0.12&UV=3",
+			map[string][]types.SensorValue{
+				types.SensorTemperature: {{Unit: "f", Value: 70.5}},
+				types.SensorRainDaily:   {{Unit: "in", Value: 0.12}},
+				types.SensorUV:          {{Unit: "uv", Value: 3}},
+			},
+		},
+		{
+			"the first key with a value wins",
+			"dailyrainin=0.1&drain_piezo=0.2&uv=4",
+			map[string][]types.SensorValue{
+				types.SensorRainDaily: {{Unit: "in", Value: 0.1}},
+				types.SensorUV:        {{Unit: "uv", Value: 4}},
+			},
+		},
+		{
+			"later keys fill in for missing ones",
+			"dailyrainin=-9999&drain_piezo=0.2",
+			map[string][]types.SensorValue{
+				types.SensorRainDaily: {{Unit: "in", Value: 0.2}},
+			},
+		},
+		{
+			"missing and invalid values are skipped",
+			"tempf=-9999&dailyrainin=&UV=abc&other=1",
+			map[string][]types.SensorValue{},
+		},
+		{
+			"values may be padded",
+			"tempf=+32+",
+			map[string][]types.SensorValue{
+				types.SensorTemperature: {{Unit: "f", Value: 32}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		values, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		sensors := parseFields(values, fields)
+		if !reflect.DeepEqual(sensors, test.sensors) {
+			t.Errorf("%v: got %v, want %v", test.name, sensors, test.sensors)
+		}
+	}
+}
+
+func TestPressure(t *testing.T) {
+	tests := []struct {
+		name    string
+		parse   func(url.Values) (types.WeatherMessage, error)
+		query   string
+		sensors map[string][]types.SensorValue
+	}{
+		{
+			"ecowitt keeps station and sea level pressure apart",
+			Ecowitt,
+			"PASSKEY=abc&baromrelin=30.01&baromabsin=29.12",
+			map[string][]types.SensorValue{
+				types.SensorPressure:         {{Unit: "inhg", Value: 29.12}},
+				types.SensorSeaLevelPressure: {{Unit: "inhg", Value: 30.01}},
+			},
+		},
+		{
+			"ecowitt without station pressure",
+			Ecowitt,
+			"PASSKEY=abc&baromrelin=30.01",
+			map[string][]types.SensorValue{
+				types.SensorSeaLevelPressure: {{Unit: "inhg", Value: 30.01}},
+			},
+		},
+		{
+			"wunderground reports sea level pressure",
+			Wunderground,
+			"ID=abc&baromin=30.01",
+			map[string][]types.SensorValue{
+				types.SensorSeaLevelPressure: {{Unit: "inhg", Value: 30.01}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		values, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		message, err := test.parse(values)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(message.Sensors, test.sensors) {
+			t.Errorf("%v: got %v, want %v", test.name, message.Sensors, test.sensors)
+		}
+	}
+}
+
+func TestUploads(t *testing.T) {
+	values, _ := url.ParseQuery("ID=abc&PASSWORD=secret&dateutc=2024-05-01+12:30:00&tempf=70")
+	message, err := Wunderground(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.ID != "abc" {
+		t.Errorf("got id %v", message.ID)
+	}
+	if want := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC); !message.Time.Equal(want) {
+		t.Errorf("got time %v, want %v", message.Time, want)
+	}
+
+	// Consoles without a clock send "now", and invalid dates are treated the
+	// same, as the upload has only just been made
+	for _, date := range []string{"now", "NOW", "", "yesterday"} {
+		values, _ := url.ParseQuery("PASSKEY=abc&tempf=70")
+		values.Set("dateutc", date)
+		before := time.Now()
+		message, err := Ecowitt(values)
+		if err != nil {
+			t.Errorf("%q: %v", date, err)
+			continue
+		}
+		if message.ID != "abc" || message.Time.Before(before) || message.Time.After(time.Now()) {
+			t.Errorf("%q: got %v at %v", date, message.ID, message.Time)
+		}
+	}
+
+	values, _ = url.ParseQuery("PASSKEY=abc&dateutc=now&tempf=-9999&stationtype=GW1000")
+	if _, err := Ecowitt(values); err == nil {
+		t.Errorf("ecowitt accepted an upload without readings")
+	}
+	values, _ = url.ParseQuery("ID=abc&action=updateraw")
+	if _, err := Wunderground(values); err == nil {
+		t.Errorf("wunderground accepted an upload without readings")
+	}
+}
@@ -0,0 +1,41 @@
+package protocols
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/ttocsneb/weather/types"
+)
+
+var wundergroundFields = []field{
+	{types.SensorTemperature, "f", []string{"tempf"}},
+	{types.SensorHumidity, "%", []string{"humidity"}},
+	{types.SensorDewPoint, "f", []string{"dewptf"}},
+	{types.SensorWindSpeed, "mph", []string{"windspeedmph"}},
+	{types.SensorWindGust, "mph", []string{"windgustmph"}},
+	{types.SensorWindDirection, "deg", []string{"winddir"}},
+	// Weather Underground only takes the pressure reduced to sea level
+	{types.SensorSeaLevelPressure, "inhg", []string{"baromin"}},
+	{types.SensorRainDaily, "in", []string{"dailyrainin"}},
+	{types.SensorSolarRadiation, "w/m2", []string{"solarradiation"}},
+	{types.SensorUV, "uv", []string{"UV", "uv"}},
+	{types.SensorIndoorTemperature, "f", []string{"indoortempf"}},
+	{types.SensorIndoorHumidity, "%", []string{"indoorhumidity"}},
+	{types.SensorPM25, "ug/m3", []string{"AqPM2.5"}},
+	{types.SensorPM10, "ug/m3", []string{"AqPM10"}},
+}
+
+// Wunderground parses the query of a Weather Underground
+// updateweatherstation.php upload. The sensors are left in the units they
+// were sent in.
+func Wunderground(values url.Values) (types.WeatherMessage, error) {
+	message := types.WeatherMessage{
+		Time:    parseDate(values.Get("dateutc")),
+		ID:      values.Get("ID"),
+		Sensors: parseFields(values, wundergroundFields),
+	}
+	if len(message.Sensors) == 0 {
+		return message, errors.New("No readings were given")
+	}
+	return message, nil
+}
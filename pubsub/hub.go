@@ -0,0 +1,237 @@
+package pubsub
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Policy decides what happens to a message when a subscriber's buffer is
+// full. Publishing never blocks, so a slow subscriber can't hold up the
+// publisher or any other subscriber.
+type Policy int
+
+const (
+	// Drop the message being published
+	DropNewest Policy = iota
+	// Drop the oldest buffered message to make room
+	DropOldest
+	// Only keep the latest message, for subscribers that only care about the
+	// current state
+	Coalesce
+)
+
+type Subscription[T any] struct {
+	// Closed once the subscription is unsubscribed
+	C       <-chan T
+	ch      chan T
+	policy  Policy
+	dropped atomic.Uint64
+}
+
+// Dropped is the number of messages this subscriber has missed.
+func (self *Subscription[T]) Dropped() uint64 {
+	return self.dropped.Load()
+}
+
+func (self *Subscription[T]) deliver(message T) bool {
+	switch self.policy {
+	case DropOldest, Coalesce:
+		for {
+			select {
+			case self.ch <- message:
+				return true
+			default:
+			}
+			select {
+			case <-self.ch:
+				self.dropped.Add(1)
+			default:
+			}
+		}
+	default:
+		select {
+		case self.ch <- message:
+			return true
+		default:
+			self.dropped.Add(1)
+			return false
+		}
+	}
+}
+
+type Stats struct {
+	Subscribers int    `json:"subscribers"`
+	Published   uint64 `json:"published"`
+	Delivered   uint64 `json:"delivered"`
+	Dropped     uint64 `json:"dropped"`
+}
+
+type statter interface {
+	Stats() Stats
+}
+
+var (
+	hubs     = make(map[string]statter)
+	hubsLock sync.Mutex
+)
+
+// Hub fans out messages published under a key to every subscriber of that
+// key, as well as to the subscribers of every key.
+type Hub[K comparable, T any] struct {
+	lock        sync.RWMutex
+	subscribers map[K]map[*Subscription[T]]bool
+	all         map[*Subscription[T]]bool
+
+	published atomic.Uint64
+	delivered atomic.Uint64
+	// Messages dropped by subscribers that have since unsubscribed
+	dropped atomic.Uint64
+}
+
+// NewHub creates a hub whose stats are reported under the given name.
+func NewHub[K comparable, T any](name string) *Hub[K, T] {
+	self := &Hub[K, T]{
+		subscribers: make(map[K]map[*Subscription[T]]bool),
+		all:         make(map[*Subscription[T]]bool),
+	}
+	hubsLock.Lock()
+	hubs[name] = self
+	hubsLock.Unlock()
+	return self
+}
+
+func newSubscription[T any](size int, policy Policy) *Subscription[T] {
+	if policy == Coalesce || size < 1 {
+		size = 1
+	}
+	ch := make(chan T, size)
+	return &Subscription[T]{C: ch, ch: ch, policy: policy}
+}
+
+// Subscribe receives the messages published under a key, buffering up to size
+// of them.
+func (self *Hub[K, T]) Subscribe(key K, size int, policy Policy) *Subscription[T] {
+	sub := newSubscription[T](size, policy)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	subs, exists := self.subscribers[key]
+	if !exists {
+		subs = make(map[*Subscription[T]]bool)
+		self.subscribers[key] = subs
+	}
+	subs[sub] = true
+	return sub
+}
+
+// SubscribeAll receives every message published to the hub.
+func (self *Hub[K, T]) SubscribeAll(size int, policy Policy) *Subscription[T] {
+	sub := newSubscription[T](size, policy)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.all[sub] = true
+	return sub
+}
+
+func (self *Hub[K, T]) close(sub *Subscription[T]) {
+	self.dropped.Add(sub.Dropped())
+	close(sub.ch)
+}
+
+// Unsubscribe stops a subscription and closes its channel. Returns false if
+// the subscription wasn't subscribed to the key.
+func (self *Hub[K, T]) Unsubscribe(key K, sub *Subscription[T]) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	subs, exists := self.subscribers[key]
+	if !exists || !subs[sub] {
+		return false
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(self.subscribers, key)
+	}
+	self.close(sub)
+	return true
+}
+
+func (self *Hub[K, T]) UnsubscribeAll(sub *Subscription[T]) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.all[sub] {
+		return false
+	}
+	delete(self.all, sub)
+	self.close(sub)
+	return true
+}
+
+// Publish sends a message to the subscribers of its key without blocking.
+func (self *Hub[K, T]) Publish(key K, message T) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	self.published.Add(1)
+	for sub := range self.subscribers[key] {
+		if sub.deliver(message) {
+			self.delivered.Add(1)
+		}
+	}
+	for sub := range self.all {
+		if sub.deliver(message) {
+			self.delivered.Add(1)
+		}
+	}
+}
+
+// Subscribers counts the subscribers of a key, not including those that
+// subscribe to every key.
+func (self *Hub[K, T]) Subscribers(key K) int {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return len(self.subscribers[key])
+}
+
+func (self *Hub[K, T]) Stats() Stats {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	stats := Stats{
+		Subscribers: len(self.all),
+		Published:   self.published.Load(),
+		Delivered:   self.delivered.Load(),
+		Dropped:     self.dropped.Load(),
+	}
+	for _, subs := range self.subscribers {
+		stats.Subscribers += len(subs)
+		for sub := range subs {
+			stats.Dropped += sub.Dropped()
+		}
+	}
+	for sub := range self.all {
+		stats.Dropped += sub.Dropped()
+	}
+	return stats
+}
+
+// AllStats collects the stats of every hub by name.
+func AllStats() map[string]Stats {
+	hubsLock.Lock()
+	names := make([]string, 0, len(hubs))
+	for name := range hubs {
+		names = append(names, name)
+	}
+	hubsLock.Unlock()
+	sort.Strings(names)
+
+	stats := make(map[string]Stats)
+	for _, name := range names {
+		hubsLock.Lock()
+		hub := hubs[name]
+		hubsLock.Unlock()
+		stats[name] = hub.Stats()
+	}
+	return stats
+}
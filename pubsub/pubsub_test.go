@@ -0,0 +1,144 @@
+package pubsub
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func drain(sub *Subscription[int]) []int {
+	result := []int{}
+	for {
+		select {
+		case message := <-sub.C:
+			result = append(result, message)
+		default:
+			return result
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   Policy
+		size     int
+		publish  []int
+		received []int
+		dropped  uint64
+	}{
+		{"drop newest keeps the first", DropNewest, 2, []int{1, 2, 3, 4}, []int{1, 2}, 2},
+		{"drop oldest keeps the last", DropOldest, 2, []int{1, 2, 3, 4}, []int{3, 4}, 2},
+		{"coalesce keeps the latest", Coalesce, 5, []int{1, 2, 3}, []int{3}, 2},
+		{"nothing dropped with room", DropNewest, 4, []int{1, 2, 3}, []int{1, 2, 3}, 0},
+		{"a size below one still buffers one", DropOldest, 0, []int{1, 2}, []int{2}, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hub := NewHub[string, int]("test")
+			sub := hub.Subscribe("key", test.size, test.policy)
+			for _, message := range test.publish {
+				hub.Publish("key", message)
+			}
+
+			if received := drain(sub); !reflect.DeepEqual(received, test.received) {
+				t.Errorf("received %v, want %v", received, test.received)
+			}
+			if sub.Dropped() != test.dropped {
+				t.Errorf("dropped %v, want %v", sub.Dropped(), test.dropped)
+			}
+			stats := hub.Stats()
+			if stats.Published != uint64(len(test.publish)) {
+				t.Errorf("published %v, want %v", stats.Published, len(test.publish))
+			}
+			if stats.Dropped != test.dropped {
+				t.Errorf("stats dropped %v, want %v", stats.Dropped, test.dropped)
+			}
+		})
+	}
+}
+
+func TestHubKeys(t *testing.T) {
+	hub := NewHub[string, int]("test")
+	a := hub.Subscribe("a", 4, DropNewest)
+	b := hub.Subscribe("b", 4, DropNewest)
+	all := hub.SubscribeAll(4, DropNewest)
+
+	hub.Publish("a", 1)
+	hub.Publish("b", 2)
+	hub.Publish("c", 3)
+
+	if received := drain(a); !reflect.DeepEqual(received, []int{1}) {
+		t.Errorf("a received %v", received)
+	}
+	if received := drain(b); !reflect.DeepEqual(received, []int{2}) {
+		t.Errorf("b received %v", received)
+	}
+	if received := drain(all); !reflect.DeepEqual(received, []int{1, 2, 3}) {
+		t.Errorf("all received %v", received)
+	}
+	if delivered := hub.Stats().Delivered; delivered != 5 {
+		t.Errorf("delivered %v, want 5", delivered)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	hub := NewHub[string, int]("test")
+	sub := hub.Subscribe("a", 1, DropNewest)
+	hub.Publish("a", 1)
+	hub.Publish("a", 2)
+
+	if hub.Unsubscribe("b", sub) {
+		t.Errorf("unsubscribed from a key that wasn't subscribed to")
+	}
+	if !hub.Unsubscribe("a", sub) {
+		t.Fatalf("could not unsubscribe")
+	}
+	if hub.Subscribers("a") != 0 {
+		t.Errorf("%v subscribers left", hub.Subscribers("a"))
+	}
+	// The buffered message is still received before the channel closes
+	if message, ok := <-sub.C; !ok || message != 1 {
+		t.Errorf("received %v, %v", message, ok)
+	}
+	if _, ok := <-sub.C; ok {
+		t.Errorf("channel wasn't closed")
+	}
+	// Drops are still counted after unsubscribing
+	if dropped := hub.Stats().Dropped; dropped != 1 {
+		t.Errorf("dropped %v, want 1", dropped)
+	}
+}
+
+// Subscribers may leave while messages are being published to them, which
+// mustn't send on their closed channels.
+func TestPublishWhileUnsubscribing(t *testing.T) {
+	hub := NewHub[int, int]("test")
+	var wg sync.WaitGroup
+	for publisher := 0; publisher < 4; publisher++ {
+		wg.Add(1)
+		go func(key int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				hub.Publish(key, i)
+			}
+		}(publisher)
+	}
+	for i := 0; i < 200; i++ {
+		sub := hub.Subscribe(i%4, 1, DropOldest)
+		all := hub.SubscribeAll(1, Coalesce)
+		if !hub.Unsubscribe(i%4, sub) || !hub.UnsubscribeAll(all) {
+			t.Fatalf("could not unsubscribe")
+		}
+		if hub.UnsubscribeAll(all) {
+			t.Fatalf("unsubscribed twice")
+		}
+	}
+	wg.Wait()
+
+	stats := hub.Stats()
+	if stats.Published != 4000 || stats.Subscribers != 0 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
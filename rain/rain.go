@@ -0,0 +1,277 @@
+package rain
+
+import (
+	"database/sql"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/types"
+	"github.com/ttocsneb/weather/util"
+)
+
+const DayFormat = "2006-01-02"
+
+// The window that the rain rate is measured over
+const rateWindow = 15 * time.Minute
+
+// The ways that a station can report rain, in order of preference
+var Kinds = []string{
+	types.SensorRainCounter,
+	types.SensorRainDaily,
+	types.SensorRain,
+}
+
+type Reading struct {
+	Time  time.Time
+	Kind  string
+	Value float64
+}
+
+func Day(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format(DayFormat)
+}
+
+func ReadingFromSensors(t time.Time, sensors map[string][]types.SensorValue) (Reading, bool) {
+	for _, kind := range Kinds {
+		values, exists := sensors[kind]
+		if exists && len(values) > 0 {
+			value, _ := util.SensorToMetric(values[0].Value, values[0].Unit, kind)
+			return Reading{Time: t, Kind: kind, Value: value}, true
+		}
+	}
+	return Reading{}, false
+}
+
+// Increment finds how much rain fell between the previous reading and the
+// current one. prev may be nil if there is no previous reading.
+func Increment(prev *Reading, cur Reading, loc *time.Location) float64 {
+	if prev != nil && prev.Kind != cur.Kind {
+		prev = nil
+	}
+
+	switch cur.Kind {
+	case types.SensorRain:
+		return math.Max(cur.Value, 0)
+	case types.SensorRainCounter:
+		if prev == nil {
+			return 0
+		}
+		if cur.Value < prev.Value {
+			// The counter has been reset or has rolled over
+			return math.Max(cur.Value, 0)
+		}
+		return cur.Value - prev.Value
+	case types.SensorRainDaily:
+		if prev == nil || Day(prev.Time, loc) != Day(cur.Time, loc) || cur.Value < prev.Value {
+			return math.Max(cur.Value, 0)
+		}
+		return cur.Value - prev.Value
+	}
+	return 0
+}
+
+func fetchPrevious(db *sql.DB, server string, station string, before time.Time, kind string) (*Reading, error) {
+	t, _, value, exists, err := database.FetchLatestSensorValue(db, server,
+		station, before.UTC(), kind)
+	if err != nil || !exists {
+		return nil, err
+	}
+	return &Reading{Time: t, Kind: kind, Value: value}, nil
+}
+
+// Record adds the rain from a newly stored entry to the daily totals.
+func Record(db *sql.DB, entry types.WeatherEntry, loc *time.Location) error {
+	reading, exists := ReadingFromSensors(entry.Time, entry.Sensors)
+	if !exists {
+		return nil
+	}
+
+	prev, err := fetchPrevious(db, entry.Server, entry.Station, entry.Time, reading.Kind)
+	if err != nil {
+		return err
+	}
+
+	increment := Increment(prev, reading, loc)
+	if increment <= 0 {
+		return nil
+	}
+
+	return database.AddRainDaily(db, entry.Server, entry.Station,
+		Day(entry.Time, loc), increment)
+}
+
+// Recompute rebuilds the daily totals of a station from its stored readings,
+// for when readings have been inserted into its past. Every day from the day
+// of from through the day of to is rebuilt, along with the day of the first
+// reading after to, as it now follows a different reading.
+func Recompute(db *sql.DB, server string, station string, from time.Time, to time.Time, loc *time.Location) error {
+	local := from.In(loc)
+	start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+
+	next, _, _, exists, err := database.FetchNextSensorValue(db, server, station,
+		to.UTC(), Kinds...)
+	if err != nil {
+		return err
+	}
+	if exists {
+		to = next
+	}
+	local = to.In(loc)
+	end := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, loc)
+
+	history, err := database.FetchSensorHistory(db, server, station, start.UTC(),
+		end.UTC(), Kinds...)
+	if err != nil {
+		return err
+	}
+
+	// Each entry is counted by its preferred kind of reading, as in Record
+	by_time := make(map[int64]Reading)
+	for _, kind := range Kinds {
+		series := history[kind]
+		for i, t := range series.Times {
+			if _, exists := by_time[t.UnixNano()]; exists {
+				continue
+			}
+			value, _ := util.SensorToMetric(series.Values[i], series.Unit, kind)
+			by_time[t.UnixNano()] = Reading{Time: t, Kind: kind, Value: value}
+		}
+	}
+	readings := make([]Reading, 0, len(by_time))
+	for _, reading := range by_time {
+		readings = append(readings, reading)
+	}
+	sort.Slice(readings, func(i, j int) bool {
+		return readings[i].Time.Before(readings[j].Time)
+	})
+
+	prev := make(map[string]*Reading)
+	days := make(map[string]float64)
+	for _, reading := range readings {
+		last, exists := prev[reading.Kind]
+		if !exists {
+			last, err = fetchPrevious(db, server, station, start.UTC(), reading.Kind)
+			if err != nil {
+				return err
+			}
+		}
+		if increment := Increment(last, reading, loc); increment > 0 {
+			days[Day(reading.Time, loc)] += increment
+		}
+		current := reading
+		prev[reading.Kind] = &current
+	}
+
+	return database.SetRainDaily(db, server, station, Day(start, loc),
+		Day(end.AddDate(0, 0, -1), loc), days)
+}
+
+type Accumulation struct {
+	Rate  float64
+	Hour  float64
+	Day   float64
+	Today float64
+	Storm float64
+	Month float64
+	Year  float64
+}
+
+func (self Accumulation) Sensors() map[string]types.SensorValue {
+	return map[string]types.SensorValue{
+		types.SensorRainRate:  {Unit: "mm/h", Value: self.Rate},
+		types.SensorRainHour:  {Unit: "mm", Value: self.Hour},
+		types.SensorRain24h:   {Unit: "mm", Value: self.Day},
+		types.SensorRainToday: {Unit: "mm", Value: self.Today},
+		types.SensorRainStorm: {Unit: "mm", Value: self.Storm},
+		types.SensorRainMonth: {Unit: "mm", Value: self.Month},
+		types.SensorRainYear:  {Unit: "mm", Value: self.Year},
+	}
+}
+
+// Accumulate calculates the rain totals of a station at the given time. If the
+// station has never reported rain, false is returned.
+func Accumulate(db *sql.DB, server string, station string, now time.Time, loc *time.Location) (Accumulation, bool, error) {
+	var acc Accumulation
+
+	start := now.Add(-24 * time.Hour)
+	history, err := database.FetchSensorHistory(db, server, station, start.UTC(),
+		now.Add(time.Second).UTC(), Kinds...)
+	if err != nil {
+		return acc, false, err
+	}
+
+	kind := ""
+	for _, k := range Kinds {
+		if _, exists := history[k]; exists {
+			kind = k
+			break
+		}
+	}
+	if kind == "" {
+		_, _, _, exists, err := database.FetchLatestSensorValue(db, server,
+			station, now.Add(time.Second).UTC(), Kinds...)
+		if err != nil || !exists {
+			return acc, false, err
+		}
+	} else {
+		prev, err := fetchPrevious(db, server, station, start, kind)
+		if err != nil {
+			return acc, false, err
+		}
+
+		series := history[kind]
+		for i, t := range series.Times {
+			reading := Reading{Time: t, Kind: kind, Value: series.Values[i]}
+			increment := Increment(prev, reading, loc)
+			prev = &reading
+
+			acc.Day += increment
+			if now.Sub(t) < time.Hour {
+				acc.Hour += increment
+			}
+			if now.Sub(t) < rateWindow {
+				acc.Rate += increment
+			}
+		}
+		acc.Rate *= float64(time.Hour) / float64(rateWindow)
+	}
+
+	local := now.In(loc)
+	today := local.Format(DayFormat)
+	month := time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, loc).Format(DayFormat)
+	year := time.Date(local.Year(), 1, 1, 0, 0, 0, 0, loc).Format(DayFormat)
+
+	acc.Month, err = database.SumRainDaily(db, server, station, month, today)
+	if err != nil {
+		return acc, true, err
+	}
+	acc.Year, err = database.SumRainDaily(db, server, station, year, today)
+	if err != nil {
+		return acc, true, err
+	}
+
+	// A storm is the most recent run of days with rain, and is over once a
+	// full day has gone by without any.
+	days, err := database.FetchRainDaily(db, server, station,
+		local.AddDate(0, 0, -60).Format(DayFormat), today)
+	if err != nil {
+		return acc, true, err
+	}
+	acc.Today = days[today]
+	day := local
+	if acc.Today <= 0 {
+		day = day.AddDate(0, 0, -1)
+	}
+	for {
+		amount := days[day.Format(DayFormat)]
+		if amount <= 0 {
+			break
+		}
+		acc.Storm += amount
+		day = day.AddDate(0, 0, -1)
+	}
+
+	return acc, true, nil
+}
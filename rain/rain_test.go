@@ -0,0 +1,142 @@
+package rain
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/types"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestIncrement(t *testing.T) {
+	loc := time.FixedZone("-06:00", -6*60*60)
+	at := func(day int, hour int) time.Time {
+		return time.Date(2024, 5, day, hour, 0, 0, 0, loc)
+	}
+	reading := func(t time.Time, kind string, value float64) *Reading {
+		return &Reading{Time: t, Kind: kind, Value: value}
+	}
+
+	tests := []struct {
+		name string
+		prev *Reading
+		cur  *Reading
+		want float64
+	}{
+		{"rain is counted as is", nil, reading(at(1, 1), types.SensorRain, 1.5), 1.5},
+		{"negative rain", nil, reading(at(1, 1), types.SensorRain, -1), 0},
+		{"first counter reading", nil, reading(at(1, 1), types.SensorRainCounter, 10), 0},
+		{"counter",
+			reading(at(1, 1), types.SensorRainCounter, 10),
+			reading(at(1, 2), types.SensorRainCounter, 12.5), 2.5},
+		{"counter reset",
+			reading(at(1, 1), types.SensorRainCounter, 10),
+			reading(at(1, 2), types.SensorRainCounter, 1), 1},
+		{"different kinds aren't compared",
+			reading(at(1, 1), types.SensorRainDaily, 10),
+			reading(at(1, 2), types.SensorRainCounter, 12), 0},
+		{"daily",
+			reading(at(1, 1), types.SensorRainDaily, 2),
+			reading(at(1, 2), types.SensorRainDaily, 3), 1},
+		{"daily on a new day",
+			reading(at(1, 23), types.SensorRainDaily, 2),
+			reading(at(2, 0), types.SensorRainDaily, 0.5), 0.5},
+		// 05:00 UTC is still the day before in the station's time zone
+		{"daily uses the station's day",
+			reading(at(1, 22), types.SensorRainDaily, 2),
+			reading(time.Date(2024, 5, 2, 5, 0, 0, 0, time.UTC), types.SensorRainDaily, 3), 1},
+	}
+
+	for _, test := range tests {
+		got := Increment(test.prev, *test.cur, loc)
+		if got != test.want {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRecompute(t *testing.T) {
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := database.Migrate(db, string(schema)); err != nil {
+		t.Fatal(err)
+	}
+
+	loc := time.FixedZone("-06:00", -6*60*60)
+	counter := func(day int, hour int, value float64) types.WeatherEntry {
+		return types.WeatherEntry{
+			Server:  "s",
+			Station: "a",
+			Time:    time.Date(2024, 5, day, hour, 0, 0, 0, loc).UTC(),
+			Sensors: map[string][]types.SensorValue{
+				types.SensorRainCounter: {{Unit: "mm", Value: value}},
+			},
+		}
+	}
+	insert := func(entry types.WeatherEntry) {
+		if _, _, err := database.InsertWeatherEntry(db, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, entry := range []types.WeatherEntry{
+		counter(1, 19, 0.2),
+		counter(1, 20, 0.5),
+		counter(2, 10, 1),
+		counter(2, 12, 3),
+		counter(3, 1, 4),
+	} {
+		insert(entry)
+		if err := Record(db, entry, loc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	days, err := database.FetchRainDaily(db, "s", "a", "2024-05-01", "2024-05-03")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"2024-05-01": 0.3, "2024-05-02": 2.5, "2024-05-03": 1}
+	if !closeTo(days, want) {
+		t.Fatalf("recorded %v, want %v", days, want)
+	}
+
+	// A reading stored late on the 2nd splits the rain of the 3rd, which is
+	// rebuilt as it follows the new reading. The 1st is left alone.
+	late := counter(2, 23, 3.5)
+	insert(late)
+	if err := Recompute(db, "s", "a", late.Time, late.Time, loc); err != nil {
+		t.Fatal(err)
+	}
+	days, err = database.FetchRainDaily(db, "s", "a", "2024-05-01", "2024-05-03")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]float64{"2024-05-01": 0.3, "2024-05-02": 3, "2024-05-03": 0.5}
+	if !closeTo(days, want) {
+		t.Errorf("recomputed %v, want %v", days, want)
+	}
+}
+
+func closeTo(got map[string]float64, want map[string]float64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for day, value := range want {
+		if d := got[day] - value; d < -1e-9 || d > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
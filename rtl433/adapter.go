@@ -0,0 +1,221 @@
+package rtl433
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/ttocsneb/weather/config"
+	"github.com/ttocsneb/weather/events"
+	"github.com/ttocsneb/weather/stations"
+	"github.com/ttocsneb/weather/types"
+)
+
+// Adapter gathers the readings of rtl_433 devices into messages for the
+// stations they belong to, and ingests them as if they came from a broker.
+type Adapter struct {
+	db   *sql.DB
+	bus  *events.Bus
+	conf config.Rtl433Config
+	// The time zone of event times without an offset
+	loc *time.Location
+
+	lock    sync.Mutex
+	pending map[string]*batch
+	// Devices that have been logged as unknown
+	unknown map[string]bool
+}
+
+// batch is the message of a station that is still gathering readings.
+type batch struct {
+	message types.WeatherMessage
+	// The time of the first reading in the message
+	start time.Time
+	// Sends the message once the window has passed, which is nil when
+	// reading from a file
+	timer *time.Timer
+}
+
+func NewAdapter(db *sql.DB, bus *events.Bus, conf config.Rtl433Config) (*Adapter, error) {
+	loc := time.Local
+	if conf.TimeZone != "" {
+		var err error
+		loc, err = time.LoadLocation(conf.TimeZone)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Adapter{
+		db:      db,
+		bus:     bus,
+		conf:    conf,
+		loc:     loc,
+		pending: make(map[string]*batch),
+		unknown: make(map[string]bool),
+	}, nil
+}
+
+// Station finds the station that a device belongs to.
+func (self *Adapter) Station(device string) (string, bool) {
+	if station, exists := self.conf.Stations[device]; exists {
+		return station, true
+	}
+	// Ids often change when batteries are replaced
+	if i := strings.LastIndex(device, "/"); i >= 0 {
+		if station, exists := self.conf.Stations[device[:i]+"/*"]; exists {
+			return station, true
+		}
+	}
+	if self.conf.AllDevices {
+		return strings.ReplaceAll(device, "/", "-"), true
+	}
+	return "", false
+}
+
+// Handle adds a line of rtl_433's output to the message of its station, which
+// is sent once the window has passed.
+func (self *Adapter) Handle(line []byte) {
+	self.handle(line, true)
+}
+
+// handle adds a reading to the message of its station. Messages are sent once
+// a reading arrives after their window, or when timed is set once the window
+// has passed on the server's clock. Output read from a file may be much older
+// than the server's clock, so it has to be batched by the time of its events.
+func (self *Adapter) handle(line []byte, timed bool) {
+	reading, err := Parse(line, self.loc)
+	if err != nil {
+		fmt.Printf("Could not parse rtl_433 event: %v\n", err)
+		return
+	}
+	if reading.Time.IsZero() {
+		reading.Time = time.Now()
+	}
+
+	self.lock.Lock()
+	station, exists := self.Station(reading.Device)
+	if !exists {
+		if !self.unknown[reading.Device] {
+			self.unknown[reading.Device] = true
+			fmt.Printf("Ignoring unknown rtl_433 device %v\n", reading.Device)
+		}
+		self.lock.Unlock()
+		return
+	}
+
+	var full *batch
+	current, exists := self.pending[station]
+	if exists && reading.Time.Sub(current.start) >= self.conf.Window {
+		full = current
+		self.take(station, current)
+		exists = false
+	}
+	if !exists {
+		current = &batch{
+			message: types.WeatherMessage{
+				ID:      station,
+				Sensors: make(map[string][]types.SensorValue),
+			},
+			start: reading.Time,
+		}
+		self.pending[station] = current
+		if timed {
+			pending := current
+			current.timer = time.AfterFunc(self.conf.Window, func() {
+				self.send(station, pending)
+			})
+		}
+	}
+	// Devices repeat their transmissions, so later readings replace earlier
+	// ones
+	if reading.Time.After(current.message.Time) {
+		current.message.Time = reading.Time
+	}
+	for name, values := range reading.Sensors {
+		current.message.Sensors[name] = values
+	}
+	self.lock.Unlock()
+
+	if full != nil {
+		self.ingest(station, full.message)
+	}
+}
+
+// take removes a batch from the pending messages if it is still pending. It
+// must be called with the lock held.
+func (self *Adapter) take(station string, pending *batch) bool {
+	if self.pending[station] != pending {
+		return false
+	}
+	delete(self.pending, station)
+	if pending.timer != nil {
+		pending.timer.Stop()
+	}
+	return true
+}
+
+func (self *Adapter) send(station string, pending *batch) {
+	self.lock.Lock()
+	taken := self.take(station, pending)
+	self.lock.Unlock()
+	if taken {
+		self.ingest(station, pending.message)
+	}
+}
+
+func (self *Adapter) ingest(station string, message types.WeatherMessage) {
+	_, err := stations.Ingest(self.db, self.bus, self.conf.Server, stations.Normalize(message))
+	if errors.Is(err, stations.ErrDuplicate) {
+		return
+	}
+	if err != nil {
+		fmt.Printf("Unable to save message to db: %v\n", err)
+		return
+	}
+	fmt.Printf("Received rtl_433 readings for %v - %v\n", self.conf.Server, station)
+}
+
+// Flush sends every pending message without waiting for its window.
+func (self *Adapter) Flush() {
+	self.lock.Lock()
+	pending := make(map[string]*batch, len(self.pending))
+	for station, current := range self.pending {
+		pending[station] = current
+		self.take(station, current)
+	}
+	self.lock.Unlock()
+
+	for station, current := range pending {
+		self.ingest(station, current.message)
+	}
+}
+
+// Subscribe handles the events that rtl_433 publishes to a broker.
+func (self *Adapter) Subscribe(broker *stations.Broker) error {
+	return broker.Subscribe(self.conf.Topic, 0,
+		func(client mqtt.Client, msg mqtt.Message) {
+			self.Handle(msg.Payload())
+		})
+}
+
+// Read handles the lines of rtl_433's output until the reader ends. Readings
+// are batched by the times of their events, so the last message of a station
+// is only sent once another of its readings arrives or the reader ends.
+func (self *Adapter) Read(reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		self.handle(line, false)
+	}
+	self.Flush()
+	return scanner.Err()
+}
@@ -0,0 +1,132 @@
+package rtl433
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ttocsneb/weather/config"
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/events"
+	"github.com/ttocsneb/weather/types"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestAdapterStation(t *testing.T) {
+	adapter, err := NewAdapter(nil, nil, config.Rtl433Config{
+		Stations: map[string]string{
+			"Acurite-Tower/A/1234": "porch",
+			"Fineoffset-WH65B/*":   "garden",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stations := map[string]string{
+		"Acurite-Tower/A/1234": "porch",
+		"Fineoffset-WH65B/77":  "garden",
+		// A new id after the batteries were replaced
+		"Fineoffset-WH65B/78":  "garden",
+		"Acurite-Tower/A/999":  "",
+		"Acurite-Tower/B/1234": "",
+	}
+	for device, want := range stations {
+		station, ok := adapter.Station(device)
+		if station != want || ok != (want != "") {
+			t.Errorf("%v: got %v, %v", device, station, ok)
+		}
+	}
+
+	adapter.conf.AllDevices = true
+	if station, ok := adapter.Station("Acurite-Tower/B/1234"); !ok || station != "Acurite-Tower-B-1234" {
+		t.Errorf("all devices: got %v, %v", station, ok)
+	}
+
+	if _, err := NewAdapter(nil, nil, config.Rtl433Config{TimeZone: "Nowhere/Special"}); err == nil {
+		t.Errorf("an unknown time zone was accepted")
+	}
+}
+
+// Output read from a file is batched by the times of its events rather than
+// the server's clock.
+func TestAdapterReadBatchesByEventTime(t *testing.T) {
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := database.Migrate(db, string(schema)); err != nil {
+		t.Fatal(err)
+	}
+
+	adapter, err := NewAdapter(db, events.NewBus(), config.Rtl433Config{
+		Server:   "rtl433",
+		Window:   time.Minute,
+		TimeZone: "UTC",
+		Stations: map[string]string{
+			"Acurite-Tower/1":     "porch",
+			"Fineoffset-WH65B/77": "porch",
+			"Acurite-Tower/2":     "shed",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := strings.Join([]string{
+		`{"time":"2024-05-01 12:00:00","model":"Acurite-Tower","id":1,"temperature_C":20}`,
+		`{"time":"2024-05-01 12:00:10","model":"Fineoffset-WH65B","id":77,"wind_avg_m_s":2}`,
+		`{"time":"2024-05-01 12:00:20","model":"Acurite-Tower","id":2,"temperature_C":15}`,
+		// A repeated transmission replaces the reading
+		`{"time":"2024-05-01 12:00:30","model":"Acurite-Tower","id":1,"temperature_C":21}`,
+		``,
+		`{"time":"2024-05-01 12:01:05","model":"Acurite-Tower","id":1,"temperature_C":22}`,
+		`{"time":"2024-05-01 12:01:06","model":"Unknown","id":1,"temperature_C":0}`,
+	}, "\n")
+	if err := adapter.Read(strings.NewReader(output)); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := database.FetchEntries(db, "ORDER BY station.value, time")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type stored struct {
+		station string
+		time    time.Time
+		sensors map[string][]types.SensorValue
+	}
+	got := make([]stored, len(entries))
+	for i, entry := range entries {
+		got[i] = stored{entry.Station, entry.Time.UTC(), entry.Sensors}
+	}
+	at := func(minute int, second int) time.Time {
+		return time.Date(2024, 5, 1, 12, minute, second, 0, time.UTC)
+	}
+	want := []stored{
+		{"porch", at(0, 30), map[string][]types.SensorValue{
+			types.SensorTemperature: {{Unit: "c", Value: 21}},
+			// Readings are normalised to metric units
+			types.SensorWindSpeed: {{Unit: "mps", Value: 2}},
+		}},
+		{"porch", at(1, 5), map[string][]types.SensorValue{
+			types.SensorTemperature: {{Unit: "c", Value: 22}},
+		}},
+		{"shed", at(0, 20), map[string][]types.SensorValue{
+			types.SensorTemperature: {{Unit: "c", Value: 15}},
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("stored %+v, want %+v", got, want)
+	}
+}
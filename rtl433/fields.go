@@ -0,0 +1,166 @@
+package rtl433
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ttocsneb/weather/types"
+)
+
+type field struct {
+	sensor string
+	unit   string
+}
+
+// The fields that rtl_433 decoders output, following its naming conventions
+// of a field name with a unit suffix
+var fields = map[string]field{
+	"temperature_C": {types.SensorTemperature, "c"},
+	"temperature_F": {types.SensorTemperature, "f"},
+	"humidity":      {types.SensorHumidity, "%"},
+	"pressure_hPa":  {types.SensorPressure, "hpa"},
+	"pressure_inHg": {types.SensorPressure, "inhg"},
+
+	"wind_avg_km_h":   {types.SensorWindSpeed, "km/h"},
+	"wind_avg_m_s":    {types.SensorWindSpeed, "m/s"},
+	"wind_avg_mi_h":   {types.SensorWindSpeed, "mph"},
+	"wind_speed_km_h": {types.SensorWindSpeed, "km/h"},
+	"wind_max_km_h":   {types.SensorWindGust, "km/h"},
+	"wind_max_m_s":    {types.SensorWindGust, "m/s"},
+	"wind_max_mi_h":   {types.SensorWindGust, "mph"},
+	"wind_dir_deg":    {types.SensorWindDirection, "deg"},
+
+	// Rain is reported as a counter since the sensor was powered on
+	"rain_mm": {types.SensorRainCounter, "mm"},
+	"rain_in": {types.SensorRainCounter, "in"},
+
+	"uv":            {types.SensorUV, "uv"},
+	"uvi":           {types.SensorUV, "uv"},
+	"light_lux":     {types.SensorSolarRadiation, "lux"},
+	"strike_count":  {types.SensorLightningCounter, ""},
+	"storm_dist":    {types.SensorLightningDistance, "km"},
+	"storm_dist_km": {types.SensorLightningDistance, "km"},
+
+	"pm2_5_ug_m3":  {types.SensorPM25, "ug/m3"},
+	"pm10_ug_m3":   {types.SensorPM10, "ug/m3"},
+	"pm10_0_ug_m3": {types.SensorPM10, "ug/m3"},
+	"co2_ppm":      {types.SensorCO2, "ppm"},
+}
+
+// Reading is a single decoded transmission from a device.
+type Reading struct {
+	// The device identified as "model/channel/id", or "model/id" if it
+	// doesn't have a channel
+	Device string
+	// When the transmission was received, which is zero if rtl_433 didn't
+	// output a time
+	Time    time.Time
+	Sensors map[string][]types.SensorValue
+}
+
+// rtl_433 outputs ids and channels as either numbers or strings depending on
+// the decoder
+func stringValue(value any) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return ""
+}
+
+func floatValue(value any) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// The formats of rtl_433's time option, which leaves out the offset unless it
+// is asked for
+var timeLayouts = []string{
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02 15:04:05Z0700",
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+}
+
+// timeValue parses the time of an event, where times without an offset are
+// in loc. Unix times are output as numbers or strings.
+func timeValue(value any, loc *time.Location) (time.Time, bool) {
+	if s, ok := value.(string); ok {
+		for _, layout := range timeLayouts {
+			t, err := time.ParseInLocation(layout, strings.TrimSpace(s), loc)
+			if err == nil {
+				return t, true
+			}
+		}
+	}
+	seconds, ok := floatValue(value)
+	if !ok {
+		return time.Time{}, false
+	}
+	whole, fraction := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(fraction*1e9)), true
+}
+
+// Parse reads a line of rtl_433's JSON output, where times without an offset
+// are in loc.
+func Parse(line []byte, loc *time.Location) (Reading, error) {
+	var event map[string]any
+	if err := json.Unmarshal(line, &event); err != nil {
+		return Reading{}, err
+	}
+
+	model := stringValue(event["model"])
+	if model == "" {
+		return Reading{}, errors.New("Event has no model")
+	}
+	parts := []string{model}
+	if channel := stringValue(event["channel"]); channel != "" {
+		parts = append(parts, channel)
+	}
+	if id := stringValue(event["id"]); id != "" {
+		parts = append(parts, id)
+	}
+
+	reading := Reading{
+		Device:  strings.Join(parts, "/"),
+		Sensors: make(map[string][]types.SensorValue),
+	}
+	if value, exists := event["time"]; exists {
+		if t, ok := timeValue(value, loc); ok {
+			reading.Time = t
+		}
+	}
+	for name, value := range event {
+		field, exists := fields[name]
+		if !exists {
+			continue
+		}
+		f, ok := floatValue(value)
+		if !ok {
+			continue
+		}
+		reading.Sensors[field.sensor] = []types.SensorValue{{
+			Unit:  field.unit,
+			Value: f,
+		}}
+	}
+	if len(reading.Sensors) == 0 {
+		return reading, fmt.Errorf("%v has no readings", reading.Device)
+	}
+	return reading, nil
+}
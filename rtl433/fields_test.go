@@ -0,0 +1,119 @@
+package rtl433
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ttocsneb/weather/types"
+)
+
+func TestParse(t *testing.T) {
+	loc := time.FixedZone("UTC-6", -6*60*60)
+
+	tests := []struct {
+		name    string
+		line    string
+		reading Reading
+		err     bool
+	}{
+		{
+			"numeric id and channel",
+			`{"time":"2024-05-01 12:00:00","model":"Acurite-Tower","id":1234,"channel":"A","temperature_C":21.5,"humidity":40,"battery_ok":1}`,
+			Reading{
+				Device: "Acurite-Tower/A/1234",
+				Time:   time.Date(2024, 5, 1, 12, 0, 0, 0, loc),
+				Sensors: map[string][]types.SensorValue{
+					types.SensorTemperature: {{Unit: "c", Value: 21.5}},
+					types.SensorHumidity:    {{Unit: "%", Value: 40}},
+				},
+			},
+			false,
+		},
+		{
+			"no channel",
+			`{"model":"Fineoffset-WH65B","id":"77","wind_avg_m_s":2.5,"wind_dir_deg":270,"rain_mm":12.3,"uvi":"3.1"}`,
+			Reading{
+				Device: "Fineoffset-WH65B/77",
+				Sensors: map[string][]types.SensorValue{
+					types.SensorWindSpeed:     {{Unit: "m/s", Value: 2.5}},
+					types.SensorWindDirection: {{Unit: "deg", Value: 270}},
+					types.SensorRainCounter:   {{Unit: "mm", Value: 12.3}},
+					types.SensorUV:            {{Unit: "uv", Value: 3.1}},
+				},
+			},
+			false,
+		},
+		{
+			"utc time with an offset",
+			`{"time":"2024-05-01T12:00:00.123+0000","model":"Acurite-Tower","id":1,"temperature_C":20}`,
+			Reading{
+				Device: "Acurite-Tower/1",
+				Time:   time.Date(2024, 5, 1, 12, 0, 0, 123000000, time.UTC),
+				Sensors: map[string][]types.SensorValue{
+					types.SensorTemperature: {{Unit: "c", Value: 20}},
+				},
+			},
+			false,
+		},
+		{
+			"unix time",
+			`{"time":"1714564800.5","model":"Acurite-Tower","id":1,"temperature_C":20}`,
+			Reading{
+				Device: "Acurite-Tower/1",
+				Time:   time.Unix(1714564800, 500000000),
+				Sensors: map[string][]types.SensorValue{
+					types.SensorTemperature: {{Unit: "c", Value: 20}},
+				},
+			},
+			false,
+		},
+		{
+			"unix time as a number",
+			`{"time":1714564800,"model":"Acurite-Tower","id":1,"temperature_C":20}`,
+			Reading{
+				Device: "Acurite-Tower/1",
+				Time:   time.Unix(1714564800, 0),
+				Sensors: map[string][]types.SensorValue{
+					types.SensorTemperature: {{Unit: "c", Value: 20}},
+				},
+			},
+			false,
+		},
+		{
+			"invalid time",
+			`{"time":"yesterday","model":"Acurite-Tower","id":1,"temperature_C":20}`,
+			Reading{
+				Device: "Acurite-Tower/1",
+				Sensors: map[string][]types.SensorValue{
+					types.SensorTemperature: {{Unit: "c", Value: 20}},
+				},
+			},
+			false,
+		},
+		{"no model", `{"id":1,"temperature_C":20}`, Reading{}, true},
+		{"no readings", `{"model":"Doorbell","id":1,"button":1}`, Reading{}, true},
+		{"invalid json", `temperature_C=20`, Reading{}, true},
+	}
+
+	for _, test := range tests {
+		reading, err := Parse([]byte(test.line), loc)
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if !reading.Time.Equal(test.reading.Time) {
+			t.Errorf("%v: got %v, want %v", test.name, reading.Time, test.reading.Time)
+		}
+		reading.Time = test.reading.Time
+		if !reflect.DeepEqual(reading, test.reading) {
+			t.Errorf("%v: got %+v, want %+v", test.name, reading, test.reading)
+		}
+	}
+}
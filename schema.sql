@@ -1,9 +1,9 @@
-CREATE TABLE lookup_strings (
+CREATE TABLE IF NOT EXISTS lookup_strings (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     value TEXT 
 );
 
-CREATE TABLE sensor_value (
+CREATE TABLE IF NOT EXISTS sensor_value (
     entry_id INTEGER,
     name_id INTEGER,
     sensor_number INTEGER,
@@ -15,16 +15,18 @@ CREATE TABLE sensor_value (
     CONSTRAINT FK_unit FOREIGN KEY (unit_id) REFERENCES weather_entry(id)
 );
 
-CREATE TABLE weather_entry (
+CREATE TABLE IF NOT EXISTS weather_entry (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     station_id INTEGER,
     server_id INTEGER,
     time DATETIME,
+    backfilled BOOLEAN DEFAULT 0,
+    CONSTRAINT UQ_entry UNIQUE (server_id, station_id, time),
     CONSTRAINT FK_station FOREIGN KEY (station_id) REFERENCES lookup_strings(id),
     CONSTRAINT FK_server FOREIGN KEY (server_id) REFERENCES lookup_strings(id)
 );
 
-CREATE TABLE station (
+CREATE TABLE IF NOT EXISTS station (
     server_id INTEGER,
     station_id INTEGER,
     make_id INTEGER,
@@ -39,6 +41,7 @@ CREATE TABLE station (
     region_id INTEGER,
     country_id INTEGER,
     rapid_weather BOOLEAN,
+    timezone_id INTEGER,
     updated DATETIME,
     PRIMARY KEY (station_id, server_id),
     CONSTRAINT FK_station FOREIGN KEY (station_id) REFERENCES lookup_strings(id),
@@ -52,3 +55,92 @@ CREATE TABLE station (
     CONSTRAINT FK_region FOREIGN KEY (region_id) REFERENCES lookup_strings(id),
     CONSTRAINT FK_country FOREIGN KEY (country_id) REFERENCES lookup_strings(id)
 );
+
+
+CREATE TABLE IF NOT EXISTS alert_rule (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name_id INTEGER,
+    sensor_id INTEGER,
+    operator_id INTEGER,
+    threshold FLOAT,
+    unit_id INTEGER,
+    scope_id INTEGER,
+    server_id INTEGER,
+    station_id INTEGER,
+    latitude FLOAT,
+    longitude FLOAT,
+    radius FLOAT,
+    district_id INTEGER,
+    city_id INTEGER,
+    region_id INTEGER,
+    country_id INTEGER,
+    enabled BOOLEAN,
+    created DATETIME,
+    CONSTRAINT FK_name FOREIGN KEY (name_id) REFERENCES lookup_strings(id),
+    CONSTRAINT FK_sensor FOREIGN KEY (sensor_id) REFERENCES lookup_strings(id),
+    CONSTRAINT FK_operator FOREIGN KEY (operator_id) REFERENCES lookup_strings(id),
+    CONSTRAINT FK_unit FOREIGN KEY (unit_id) REFERENCES lookup_strings(id),
+    CONSTRAINT FK_scope FOREIGN KEY (scope_id) REFERENCES lookup_strings(id),
+    CONSTRAINT FK_server FOREIGN KEY (server_id) REFERENCES lookup_strings(id),
+    CONSTRAINT FK_station FOREIGN KEY (station_id) REFERENCES lookup_strings(id),
+    CONSTRAINT FK_district FOREIGN KEY (district_id) REFERENCES lookup_strings(id),
+    CONSTRAINT FK_city FOREIGN KEY (city_id) REFERENCES lookup_strings(id),
+    CONSTRAINT FK_region FOREIGN KEY (region_id) REFERENCES lookup_strings(id),
+    CONSTRAINT FK_country FOREIGN KEY (country_id) REFERENCES lookup_strings(id)
+);
+
+CREATE TABLE IF NOT EXISTS alert_event (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    rule_id INTEGER,
+    server_id INTEGER,
+    station_id INTEGER,
+    time DATETIME,
+    firing BOOLEAN,
+    value FLOAT,
+    unit_id INTEGER,
+    CONSTRAINT FK_rule FOREIGN KEY (rule_id) REFERENCES alert_rule(id),
+    CONSTRAINT FK_server FOREIGN KEY (server_id) REFERENCES lookup_strings(id),
+    CONSTRAINT FK_station FOREIGN KEY (station_id) REFERENCES lookup_strings(id),
+    CONSTRAINT FK_unit FOREIGN KEY (unit_id) REFERENCES lookup_strings(id)
+);
+
+CREATE TABLE IF NOT EXISTS alert_active (
+    rule_id INTEGER,
+    server_id INTEGER,
+    station_id INTEGER,
+    since DATETIME,
+    value FLOAT,
+    unit_id INTEGER,
+    PRIMARY KEY (rule_id, server_id, station_id),
+    CONSTRAINT FK_rule FOREIGN KEY (rule_id) REFERENCES alert_rule(id),
+    CONSTRAINT FK_server FOREIGN KEY (server_id) REFERENCES lookup_strings(id),
+    CONSTRAINT FK_station FOREIGN KEY (station_id) REFERENCES lookup_strings(id),
+    CONSTRAINT FK_unit FOREIGN KEY (unit_id) REFERENCES lookup_strings(id)
+);
+
+CREATE TABLE IF NOT EXISTS rain_daily (
+    server_id INTEGER,
+    station_id INTEGER,
+    day TEXT,
+    amount FLOAT,
+    PRIMARY KEY (server_id, station_id, day),
+    CONSTRAINT FK_server FOREIGN KEY (server_id) REFERENCES lookup_strings(id),
+    CONSTRAINT FK_station FOREIGN KEY (station_id) REFERENCES lookup_strings(id)
+);
+
+CREATE TABLE IF NOT EXISTS lightning_strike (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    server_id INTEGER,
+    station_id INTEGER,
+    time DATETIME,
+    count INTEGER,
+    distance FLOAT,
+    CONSTRAINT FK_server FOREIGN KEY (server_id) REFERENCES lookup_strings(id),
+    CONSTRAINT FK_station FOREIGN KEY (station_id) REFERENCES lookup_strings(id)
+);
+
+CREATE TABLE IF NOT EXISTS migration (
+    name TEXT PRIMARY KEY,
+    applied DATETIME,
+    value INTEGER
+);
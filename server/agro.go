@@ -0,0 +1,234 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ttocsneb/weather/agro"
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/rain"
+	"github.com/ttocsneb/weather/types"
+	"github.com/ttocsneb/weather/tz"
+	"github.com/ttocsneb/weather/util"
+)
+
+type agroDay struct {
+	Date           string             `json:"date"`
+	Partial        bool               `json:"partial"`
+	TemperatureMin *types.SensorValue `json:"temperatureMin"`
+	TemperatureMax *types.SensorValue `json:"temperatureMax"`
+	Solar          *types.SensorValue `json:"solar"`
+	SolarEstimated bool               `json:"solarEstimated"`
+	ET0            *types.SensorValue `json:"et0"`
+	ETc            *types.SensorValue `json:"etc"`
+	GDD            *float64           `json:"gdd"`
+	ChillHours     float64            `json:"chillHours"`
+	Rain           types.SensorValue  `json:"rain"`
+	SoilWater      types.SensorValue  `json:"soilWater"`
+	Deficit        types.SensorValue  `json:"deficit"`
+	Drainage       types.SensorValue  `json:"drainage"`
+}
+
+type agroTotals struct {
+	ET0        types.SensorValue `json:"et0"`
+	ETc        types.SensorValue `json:"etc"`
+	GDD        float64           `json:"gdd"`
+	ChillHours float64           `json:"chillHours"`
+	Rain       types.SensorValue `json:"rain"`
+}
+
+type agroResponse struct {
+	Timezone string            `json:"timezone"`
+	Base     types.SensorValue `json:"base"`
+	Cap      types.SensorValue `json:"cap"`
+	Capacity types.SensorValue `json:"capacity"`
+	Kc       float64           `json:"kc"`
+	Days     []agroDay         `json:"days"`
+	Totals   agroTotals        `json:"totals"`
+}
+
+func imperialSensor(value float64, unit string, name string) types.SensorValue {
+	value, unit = util.SensorToImperial(value, unit, name)
+	return types.SensorValue{Unit: unit, Value: value}
+}
+
+func queryFloat(q url.Values, name string, fallback float64) (float64, error) {
+	if !q.Has(name) {
+		return fallback, nil
+	}
+	value, err := strconv.ParseFloat(q.Get(name), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%v must be a number", name)
+	}
+	return value, nil
+}
+
+func StationAgroRoute(db *sql.DB, r *mux.Router) {
+	r.HandleFunc("/station/{server}/{station}/agro/",
+		func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+			server := vars["server"]
+			station := vars["station"]
+
+			w.Header().Set("Cache-Control", "no-cache")
+
+			q := r.URL.Query()
+
+			days := 7
+			if q.Has("days") {
+				var err error
+				days, err = strconv.Atoi(q.Get("days"))
+				if err != nil || days < 1 || days > 90 {
+					ErrorMessage(w, 400, "days must be between 1 and 90")
+					return
+				}
+			}
+
+			// Parameters are given in imperial units, like the response
+			base, err := queryFloat(q, "base", 50)
+			if err != nil {
+				ErrorMessage(w, 400, err.Error())
+				return
+			}
+			cap, err := queryFloat(q, "cap", 86)
+			if err != nil {
+				ErrorMessage(w, 400, err.Error())
+				return
+			}
+			capacity, err := queryFloat(q, "capacity", 4)
+			if err != nil {
+				ErrorMessage(w, 400, err.Error())
+				return
+			}
+			kc, err := queryFloat(q, "kc", 1)
+			if err != nil {
+				ErrorMessage(w, 400, err.Error())
+				return
+			}
+			if cap <= base || capacity <= 0 || kc < 0 {
+				ErrorMessage(w, 400, "cap must be above base, capacity must be positive and kc must not be negative")
+				return
+			}
+
+			base_c, _ := util.SensorToMetric(base, "f", types.SensorTemperature)
+			cap_c, _ := util.SensorToMetric(cap, "f", types.SensorTemperature)
+			capacity_mm, _ := util.SensorToMetric(capacity, "in", types.SensorRain)
+
+			info, exists, err := database.FetchStationInfo(db, server, station)
+			if err != nil {
+				ErrorMessage(w, 500, "Could not fetch station info")
+				fmt.Printf("Could not fetch station info: %v\n", err)
+				return
+			}
+			if !exists {
+				ErrorMessage(w, 404, "No station found")
+				return
+			}
+
+			timezone := info.Timezone
+			if timezone == "" {
+				timezone = tz.Lookup(info.Latitude, info.Longitude)
+			}
+			loc := tz.Location(timezone)
+
+			now := time.Now()
+			start := now.In(loc).AddDate(0, 0, -(days - 1))
+			start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+
+			history, err := database.FetchSensorHistory(db, server, station,
+				start.UTC(), now.UTC(), agro.Sensors...)
+			if err != nil {
+				ErrorMessage(w, 500, "Could not fetch history")
+				fmt.Printf("Could not fetch history: %v\n", err)
+				return
+			}
+
+			rainfall, err := database.FetchRainDaily(db, server, station,
+				start.Format(rain.DayFormat), now.In(loc).Format(rain.DayFormat))
+			if err != nil {
+				ErrorMessage(w, 500, "Could not fetch rain")
+				fmt.Printf("Could not fetch rain: %v\n", err)
+				return
+			}
+
+			// The soil is assumed to be at field capacity at the start
+			soil := agro.SoilWater{Capacity: capacity_mm, Water: capacity_mm}
+
+			response := agroResponse{
+				Timezone: timezone,
+				Base:     types.SensorValue{Unit: "f", Value: base},
+				Cap:      types.SensorValue{Unit: "f", Value: cap},
+				Capacity: types.SensorValue{Unit: "in", Value: capacity},
+				Kc:       kc,
+			}
+			var total_et0, total_etc, total_rain float64
+
+			for _, day := range agro.Summarize(history, start, now, loc) {
+				date := day.Start.Format(rain.DayFormat)
+				amount := rainfall[date]
+
+				result := agroDay{
+					Date:           date,
+					Partial:        day.Partial,
+					SolarEstimated: day.SolarEstimated,
+					ChillHours:     day.ChillHours,
+					Rain:           imperialSensor(amount, "mm", types.SensorRain),
+				}
+
+				et := 0.0
+				if day.Complete {
+					weather := day.Weather
+					min := imperialSensor(weather.TempMin, "c", types.SensorTemperature)
+					max := imperialSensor(weather.TempMax, "c", types.SensorTemperature)
+					result.TemperatureMin = &min
+					result.TemperatureMax = &max
+
+					if !math.IsNaN(weather.Solar) {
+						result.Solar = &types.SensorValue{Unit: "mj/m2", Value: weather.Solar}
+					}
+
+					// Degree days are in the same scale as the base
+					gdd := agro.GrowingDegreeDays(weather.TempMin, weather.TempMax,
+						base_c, cap_c) * 9 / 5
+					result.GDD = &gdd
+					response.Totals.GDD += gdd
+				}
+
+				// FAO-56 is for whole days, so the day in progress has no
+				// evapotranspiration and only its rain goes into the soil
+				if day.Complete && !day.Partial {
+					et0 := agro.ReferenceET(day.Weather, info.Latitude, info.Elevation,
+						day.Start.YearDay())
+					et = et0 * kc
+					et0_value := imperialSensor(et0, "mm", types.SensorRain)
+					etc_value := imperialSensor(et, "mm", types.SensorRain)
+					result.ET0 = &et0_value
+					result.ETc = &etc_value
+					total_et0 += et0
+					total_etc += et
+				}
+
+				drainage := soil.Step(amount, et)
+				result.SoilWater = imperialSensor(soil.Water, "mm", types.SensorRain)
+				result.Deficit = imperialSensor(soil.Deficit(), "mm", types.SensorRain)
+				result.Drainage = imperialSensor(drainage, "mm", types.SensorRain)
+
+				response.Totals.ChillHours += day.ChillHours
+				total_rain += amount
+
+				response.Days = append(response.Days, result)
+			}
+
+			response.Totals.ET0 = imperialSensor(total_et0, "mm", types.SensorRain)
+			response.Totals.ETc = imperialSensor(total_etc, "mm", types.SensorRain)
+			response.Totals.Rain = imperialSensor(total_rain, "mm", types.SensorRain)
+
+			writeJson(w, 200, response)
+		})
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ttocsneb/weather/alerts"
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/types"
+)
+
+func alertRuleStations(db *sql.DB, rule types.AlertRule) ([]types.StationEntry, error) {
+	switch rule.Scope {
+	case types.AlertScopeStation:
+		info, exists, err := database.FetchStationInfo(db, rule.Server, rule.Station)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return []types.StationEntry{}, nil
+		}
+		return []types.StationEntry{info}, nil
+	case types.AlertScopeRadius:
+		stations, _, err := findNearestStations(db, rule.Latitude,
+			rule.Longitude, rule.Range)
+		return stations, err
+	case types.AlertScopeRegion:
+		return findRegionStations(db, rule.District, rule.City, rule.Region,
+			rule.Country)
+	}
+	return []types.StationEntry{}, nil
+}
+
+func testAlertRule(db *sql.DB, w http.ResponseWriter, rule types.AlertRule) {
+	stations, err := alertRuleStations(db, rule)
+	if err != nil {
+		ErrorMessage(w, 500, "Internal Server Error")
+		fmt.Printf("Could not find alert rule stations: %v\n", err)
+		return
+	}
+
+	events, err := alerts.TestRule(db, rule, stations, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		ErrorMessage(w, 500, "Internal Server Error")
+		fmt.Printf("Could not test alert rule: %v\n", err)
+		return
+	}
+
+	writeJson(w, 200, events)
+}
+
+func parseAlertRuleId(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		ErrorMessage(w, 400, "id must be a number")
+		return 0, false
+	}
+	return id, true
+}
+
+func fetchAlertRule(db *sql.DB, w http.ResponseWriter, r *http.Request) (types.AlertRule, bool) {
+	id, ok := parseAlertRuleId(w, r)
+	if !ok {
+		return types.AlertRule{}, false
+	}
+
+	rule, exists, err := database.FetchAlertRule(db, id)
+	if err != nil {
+		ErrorMessage(w, 500, "Internal Server Error")
+		fmt.Printf("Could not fetch alert rule: %v\n", err)
+		return types.AlertRule{}, false
+	}
+	if !exists {
+		ErrorMessage(w, 404, "Alert rule not found")
+		return types.AlertRule{}, false
+	}
+	return rule, true
+}
+
+func AlertRulesRoute(db *sql.DB, tokens map[string]string, r *mux.Router) {
+	r.HandleFunc("/alerts/rules/",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "no-cache")
+
+			rules, err := database.QueryAlertRules(db, "ORDER BY alert_rule.id ASC")
+			if err != nil {
+				ErrorMessage(w, 500, "Internal Server Error")
+				fmt.Printf("Could not fetch alert rules: %v\n", err)
+				return
+			}
+
+			writeJson(w, 200, rules)
+		}).Methods("GET")
+
+	r.HandleFunc("/alerts/rules/",
+		func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := authorize(w, r, tokens); !ok {
+				return
+			}
+
+			rule := types.AlertRule{Enabled: true}
+			if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+				ErrorMessage(w, 400, fmt.Sprintf("Invalid rule: %v", err))
+				return
+			}
+			if err := alerts.Validate(rule); err != nil {
+				ErrorMessage(w, 400, err.Error())
+				return
+			}
+			rule.Created = time.Now()
+
+			id, err := database.InsertAlertRule(db, rule)
+			if err != nil {
+				ErrorMessage(w, 500, "Internal Server Error")
+				fmt.Printf("Could not insert alert rule: %v\n", err)
+				return
+			}
+			rule.ID = id
+
+			writeJson(w, 201, rule)
+		}).Methods("POST")
+}
+
+func AlertRuleRoute(db *sql.DB, tokens map[string]string, r *mux.Router) {
+	r.HandleFunc("/alerts/rules/{id:[0-9]+}/",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "no-cache")
+
+			rule, ok := fetchAlertRule(db, w, r)
+			if !ok {
+				return
+			}
+
+			writeJson(w, 200, rule)
+		}).Methods("GET")
+
+	r.HandleFunc("/alerts/rules/{id:[0-9]+}/",
+		func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := authorize(w, r, tokens); !ok {
+				return
+			}
+
+			rule, ok := fetchAlertRule(db, w, r)
+			if !ok {
+				return
+			}
+
+			// Fields missing from the body keep their current values
+			id := rule.ID
+			created := rule.Created
+			if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+				ErrorMessage(w, 400, fmt.Sprintf("Invalid rule: %v", err))
+				return
+			}
+			rule.ID = id
+			rule.Created = created
+			if err := alerts.Validate(rule); err != nil {
+				ErrorMessage(w, 400, err.Error())
+				return
+			}
+
+			_, err := database.UpdateAlertRule(db, rule)
+			if err != nil {
+				ErrorMessage(w, 500, "Internal Server Error")
+				fmt.Printf("Could not update alert rule: %v\n", err)
+				return
+			}
+
+			writeJson(w, 200, rule)
+		}).Methods("PUT")
+
+	r.HandleFunc("/alerts/rules/{id:[0-9]+}/",
+		func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := authorize(w, r, tokens); !ok {
+				return
+			}
+
+			id, ok := parseAlertRuleId(w, r)
+			if !ok {
+				return
+			}
+
+			deleted, err := database.DeleteAlertRule(db, id)
+			if err != nil {
+				ErrorMessage(w, 500, "Internal Server Error")
+				fmt.Printf("Could not delete alert rule: %v\n", err)
+				return
+			}
+			if !deleted {
+				ErrorMessage(w, 404, "Alert rule not found")
+				return
+			}
+
+			w.WriteHeader(204)
+		}).Methods("DELETE")
+}
+
+func AlertRuleTestRoute(db *sql.DB, r *mux.Router) {
+	r.HandleFunc("/alerts/rules/{id:[0-9]+}/test/",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "no-cache")
+
+			rule, ok := fetchAlertRule(db, w, r)
+			if !ok {
+				return
+			}
+
+			testAlertRule(db, w, rule)
+		}).Methods("GET", "POST")
+
+	// Allows a rule to be tried out before it is saved
+	r.HandleFunc("/alerts/rules/test/",
+		func(w http.ResponseWriter, r *http.Request) {
+			rule := types.AlertRule{Enabled: true}
+			if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+				ErrorMessage(w, 400, fmt.Sprintf("Invalid rule: %v", err))
+				return
+			}
+			if err := alerts.Validate(rule); err != nil {
+				ErrorMessage(w, 400, err.Error())
+				return
+			}
+
+			testAlertRule(db, w, rule)
+		}).Methods("POST")
+}
+
+func AlertHistoryRoute(db *sql.DB, r *mux.Router) {
+	r.HandleFunc("/alerts/history/",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "no-cache")
+
+			q := r.URL.Query()
+
+			conditions := []string{}
+			args := []interface{}{}
+
+			if q.Has("rule") {
+				rule, err := strconv.ParseInt(q.Get("rule"), 10, 64)
+				if err != nil {
+					ErrorMessage(w, 400, "rule must be a number")
+					return
+				}
+				conditions = append(conditions, "rule_id = ?")
+				args = append(args, rule)
+			}
+			if q.Has("server") {
+				conditions = append(conditions, "server.value = ?")
+				args = append(args, q.Get("server"))
+			}
+			if q.Has("station") {
+				conditions = append(conditions, "station.value = ?")
+				args = append(args, q.Get("station"))
+			}
+
+			count, err := strconv.Atoi(q.Get("count"))
+			if err != nil {
+				count = 25
+			}
+			args = append(args, count)
+
+			where := ""
+			if len(conditions) > 0 {
+				where = fmt.Sprintf("WHERE %v", strings.Join(conditions, " AND "))
+			}
+
+			events, err := database.QueryAlertEvents(db, fmt.Sprintf(`%v
+				ORDER BY time DESC
+				LIMIT ?`, where), args...)
+			if err != nil {
+				ErrorMessage(w, 500, "Internal Server Error")
+				fmt.Printf("Could not fetch alert history: %v\n", err)
+				return
+			}
+
+			writeJson(w, 200, events)
+		}).Methods("GET")
+}
+
+func AlertActiveRoute(db *sql.DB, r *mux.Router) {
+	r.HandleFunc("/alerts/active/",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "no-cache")
+
+			q := r.URL.Query()
+
+			conditions := []string{}
+			args := []interface{}{}
+
+			if q.Has("server") {
+				conditions = append(conditions, "server.value = ?")
+				args = append(args, q.Get("server"))
+			}
+			if q.Has("station") {
+				conditions = append(conditions, "station.value = ?")
+				args = append(args, q.Get("station"))
+			}
+
+			where := ""
+			if len(conditions) > 0 {
+				where = fmt.Sprintf("WHERE %v", strings.Join(conditions, " AND "))
+			}
+
+			active, err := database.QueryActiveAlerts(db,
+				fmt.Sprintf("%v ORDER BY since DESC", where), args...)
+			if err != nil {
+				ErrorMessage(w, 500, "Internal Server Error")
+				fmt.Printf("Could not fetch active alerts: %v\n", err)
+				return
+			}
+
+			writeJson(w, 200, active)
+		}).Methods("GET")
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ttocsneb/weather/astro"
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/tz"
+)
+
+type sunInfo struct {
+	Sunrise          *time.Time `json:"sunrise"`
+	Sunset           *time.Time `json:"sunset"`
+	SolarNoon        time.Time  `json:"solarNoon"`
+	DayLength        float64    `json:"dayLength"`
+	CivilDawn        *time.Time `json:"civilDawn"`
+	CivilDusk        *time.Time `json:"civilDusk"`
+	NauticalDawn     *time.Time `json:"nauticalDawn"`
+	NauticalDusk     *time.Time `json:"nauticalDusk"`
+	AstronomicalDawn *time.Time `json:"astronomicalDawn"`
+	AstronomicalDusk *time.Time `json:"astronomicalDusk"`
+	Elevation        float64    `json:"elevation"`
+	Azimuth          float64    `json:"azimuth"`
+}
+
+type moonInfo struct {
+	Moonrise     *time.Time `json:"moonrise"`
+	Moonset      *time.Time `json:"moonset"`
+	Phase        float64    `json:"phase"`
+	PhaseName    string     `json:"phaseName"`
+	Illumination float64    `json:"illumination"`
+	Age          float64    `json:"age"`
+	Elevation    float64    `json:"elevation"`
+	Azimuth      float64    `json:"azimuth"`
+	Distance     float64    `json:"distance"`
+}
+
+type astroInfo struct {
+	Date      string    `json:"date"`
+	Timezone  string    `json:"timezone"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Time      time.Time `json:"time"`
+	Sun       sunInfo   `json:"sun"`
+	Moon      moonInfo  `json:"moon"`
+}
+
+func calculateAstro(latitude float64, longitude float64, timezone string, date time.Time, now time.Time) astroInfo {
+	loc := tz.Location(timezone)
+	date = date.In(loc)
+	now = now.In(loc)
+
+	start := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, loc)
+	end := start.AddDate(0, 0, 1)
+
+	sun := astro.Sun(date.Year(), date.Month(), date.Day(), loc, latitude, longitude)
+	sun_elevation, sun_azimuth := astro.SunPosition(now, latitude, longitude)
+
+	moonrise, moonset := astro.MoonTimes(start, end, latitude, longitude)
+	localize := func(t *time.Time) *time.Time {
+		if t == nil {
+			return nil
+		}
+		local := t.In(loc)
+		return &local
+	}
+	illumination, phase := astro.MoonIllumination(now)
+	moon_elevation, moon_azimuth, moon_distance := astro.MoonPosition(now, latitude, longitude)
+
+	return astroInfo{
+		Date:      start.Format("2006-01-02"),
+		Timezone:  timezone,
+		Latitude:  latitude,
+		Longitude: longitude,
+		Time:      now,
+		Sun: sunInfo{
+			Sunrise:          sun.Sunrise,
+			Sunset:           sun.Sunset,
+			SolarNoon:        sun.SolarNoon,
+			DayLength:        sun.DayLength.Seconds(),
+			CivilDawn:        sun.CivilDawn,
+			CivilDusk:        sun.CivilDusk,
+			NauticalDawn:     sun.NauticalDawn,
+			NauticalDusk:     sun.NauticalDusk,
+			AstronomicalDawn: sun.AstronomicalDawn,
+			AstronomicalDusk: sun.AstronomicalDusk,
+			Elevation:        sun_elevation,
+			Azimuth:          sun_azimuth,
+		},
+		Moon: moonInfo{
+			Moonrise:     localize(moonrise),
+			Moonset:      localize(moonset),
+			Phase:        phase,
+			PhaseName:    astro.MoonPhaseName(phase),
+			Illumination: illumination,
+			Age:          astro.MoonAge(phase),
+			Elevation:    moon_elevation,
+			Azimuth:      moon_azimuth,
+			Distance:     moon_distance,
+		},
+	}
+}
+
+func parseAstroDate(w http.ResponseWriter, r *http.Request, timezone string) (time.Time, bool) {
+	q := r.URL.Query()
+	if !q.Has("date") {
+		return time.Now(), true
+	}
+	date, err := time.ParseInLocation("2006-01-02", q.Get("date"), tz.Location(timezone))
+	if err != nil {
+		ErrorMessage(w, 400, "date must be formatted as YYYY-MM-DD")
+		return time.Time{}, false
+	}
+	return date, true
+}
+
+func StationAstroRoute(db *sql.DB, r *mux.Router) {
+	r.HandleFunc("/station/{server}/{station}/astro/",
+		func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+			server := vars["server"]
+			station := vars["station"]
+
+			w.Header().Set("Cache-Control", "no-cache")
+
+			info, exists, err := database.FetchStationInfo(db, server, station)
+			if err != nil {
+				ErrorMessage(w, 500, "Could not fetch station info")
+				fmt.Printf("Could not fetch station info: %v\n", err)
+				return
+			}
+			if !exists {
+				ErrorMessage(w, 404, "No station found")
+				return
+			}
+
+			timezone := info.Timezone
+			if timezone == "" {
+				timezone = tz.Lookup(info.Latitude, info.Longitude)
+			}
+
+			date, ok := parseAstroDate(w, r, timezone)
+			if !ok {
+				return
+			}
+
+			writeJson(w, 200, calculateAstro(info.Latitude, info.Longitude,
+				timezone, date, time.Now()))
+		})
+}
+
+func LocationAstroRoute(r *mux.Router) {
+	r.HandleFunc("/location/astro/",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "no-cache")
+
+			q := r.URL.Query()
+
+			if !q.Has("lat") || !q.Has("lon") {
+				ErrorMessage(w, 400, "lat and lon are required parameters")
+				return
+			}
+
+			lat, err := strconv.ParseFloat(q.Get("lat"), 64)
+			if err != nil {
+				ErrorMessage(w, 400, "lat must be a number")
+				return
+			}
+			lon, err := strconv.ParseFloat(q.Get("lon"), 64)
+			if err != nil {
+				ErrorMessage(w, 400, "lon must be a number")
+				return
+			}
+
+			timezone := tz.Lookup(lat, lon)
+			if q.Has("tz") {
+				timezone = q.Get("tz")
+				if _, err := time.LoadLocation(timezone); err != nil {
+					ErrorMessage(w, 400, fmt.Sprintf("tz: %v", err))
+					return
+				}
+			}
+
+			date, ok := parseAstroDate(w, r, timezone)
+			if !ok {
+				return
+			}
+
+			writeJson(w, 200, calculateAstro(lat, lon, timezone, date, time.Now()))
+		})
+}
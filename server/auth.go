@@ -0,0 +1,57 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// checkToken finds the name of the client that a token belongs to.
+func checkToken(tokens map[string]string, token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	for name, valid := range tokens {
+		if valid != "" && subtle.ConstantTimeCompare([]byte(token), []byte(valid)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="weather"`)
+	ErrorMessage(w, 401, "A valid token is required")
+}
+
+// authorize checks the token of a request against the configured tokens and
+// finds the name of the client it belongs to. The token is usually given as a
+// bearer token or as the password of basic auth, but may also be given in the token query parameter for
+// clients such as EventSource that can't set headers, or in the path for
+// consoles that can only be given a path to upload to. If the token isn't
+// valid, an error is written and false is returned.
+func authorize(w http.ResponseWriter, r *http.Request, tokens map[string]string) (string, bool) {
+	token := ""
+	header := r.Header.Get("Authorization")
+	_, password, basic := r.BasicAuth()
+	if strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	} else if strings.HasPrefix(header, "Token ") {
+		// InfluxDB clients send their tokens this way
+		token = strings.TrimSpace(strings.TrimPrefix(header, "Token "))
+	} else if basic {
+		token = password
+	} else if r.URL.Query().Has("token") {
+		token = r.URL.Query().Get("token")
+	} else {
+		token = mux.Vars(r)["token"]
+	}
+
+	name, ok := checkToken(tokens, token)
+	if !ok {
+		unauthorized(w)
+	}
+	return name, ok
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/ttocsneb/weather/stations"
+)
+
+func BrokersRoute(brokers map[string]stations.Broker, r *mux.Router) {
+	r.HandleFunc("/brokers/",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "no-cache")
+
+			states := make([]stations.BrokerState, 0, len(brokers))
+			for _, broker := range brokers {
+				states = append(states, broker.State())
+			}
+			sort.Slice(states, func(i, j int) bool {
+				return states[i].Name < states[j].Name
+			})
+
+			writeJson(w, 200, states)
+		}).Methods("GET")
+}
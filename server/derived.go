@@ -0,0 +1,110 @@
+package server
+
+import (
+	"database/sql"
+
+	"github.com/ttocsneb/weather/aqi"
+	"github.com/ttocsneb/weather/astro"
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/rain"
+	"github.com/ttocsneb/weather/types"
+	"github.com/ttocsneb/weather/tz"
+)
+
+// deriveSensors adds the sensors that are calculated from a station's history
+// to an entry. The sensors are added to a copy so that entries shared with
+// other listeners are left untouched. It takes several queries per entry, so
+// it is only used by the endpoints of a single station, and not for the
+// stations of a location or region.
+func deriveSensors(db *sql.DB, entry *types.WeatherEntry) error {
+	sensors := make(map[string][]types.SensorValue)
+	for name, values := range entry.Sensors {
+		sensors[name] = append([]types.SensorValue{}, values...)
+	}
+	entry.Sensors = sensors
+
+	loc, err := tz.StationLocation(db, entry.Server, entry.Station)
+	if err != nil {
+		return err
+	}
+
+	acc, exists, err := rain.Accumulate(db, entry.Server, entry.Station, entry.Time, loc)
+	if err != nil {
+		return err
+	}
+	if exists {
+		for name, value := range acc.Sensors() {
+			sensors[name] = []types.SensorValue{value}
+		}
+	}
+
+	if err := deriveAirQuality(db, entry); err != nil {
+		return err
+	}
+
+	return deriveSolar(db, entry)
+}
+
+// deriveAirQuality adds the rolling averages of a station's pollutants and
+// the air quality indices that are calculated from them.
+func deriveAirQuality(db *sql.DB, entry *types.WeatherEntry) error {
+	latest := make(map[string]types.SensorValue)
+	for _, pollutant := range aqi.Pollutants {
+		values, exists := entry.Sensors[pollutant]
+		if exists && len(values) > 0 {
+			latest[pollutant] = values[0]
+		}
+	}
+	if len(latest) == 0 {
+		return nil
+	}
+
+	averages, err := aqi.Averages(db, entry.Server, entry.Station, entry.Time)
+	if err != nil {
+		return err
+	}
+	for name, value := range averages {
+		latest[name] = value
+		entry.Sensors[name] = []types.SensorValue{value}
+	}
+
+	for name, value := range aqi.CalculateIndices(latest) {
+		entry.Sensors[name] = []types.SensorValue{value}
+	}
+
+	return nil
+}
+
+// deriveSolar compares a station's solar radiation to the clear-sky model to
+// estimate how cloudy it is.
+func deriveSolar(db *sql.DB, entry *types.WeatherEntry) error {
+	radiation, exists := metricSensor(entry.Sensors, types.SensorSolarRadiation)
+	if !exists {
+		return nil
+	}
+
+	info, exists, err := database.FetchStationInfo(db, entry.Server, entry.Station)
+	if err != nil || !exists {
+		return err
+	}
+
+	clear := astro.ClearSkyRadiation(entry.Time, info.Latitude, info.Longitude, info.Elevation)
+	entry.Sensors[types.SensorSolarClearSky] = []types.SensorValue{
+		{Unit: "w/m2", Value: clear},
+	}
+
+	elevation, _ := astro.SunPosition(entry.Time, info.Latitude, info.Longitude)
+	if elevation < astro.MinClearSkyElevation {
+		return nil
+	}
+
+	index := radiation / clear
+	entry.Sensors[types.SensorClearSkyIndex] = []types.SensorValue{
+		{Unit: "", Value: index},
+	}
+	entry.Sensors[types.SensorCloudCover] = []types.SensorValue{
+		{Unit: "%", Value: astro.CloudCover(index) * 100},
+	}
+
+	return nil
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/events"
+	"github.com/ttocsneb/weather/pubsub"
+	"github.com/ttocsneb/weather/types"
+)
+
+// How long the location of a station is trusted before it is looked up again
+const firehoseInfoTTL = 10 * time.Minute
+
+type firehoseObservation struct {
+	Server  string                         `json:"server"`
+	Station string                         `json:"station"`
+	Time    time.Time                      `json:"time"`
+	Sensors map[string][]types.SensorValue `json:"sensors"`
+}
+
+type firehoseFilter struct {
+	units string
+	// min lon, min lat, max lon, max lat
+	bbox     []float64
+	sensors  map[string]bool
+	stations map[string]bool
+}
+
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseFirehoseFilter(q url.Values) (firehoseFilter, error) {
+	filter := firehoseFilter{units: UnitsImperial}
+
+	if q.Has("units") {
+		filter.units = q.Get("units")
+		if filter.units != UnitsImperial && filter.units != UnitsMetric {
+			return filter, fmt.Errorf("units must be %v or %v", UnitsImperial, UnitsMetric)
+		}
+	}
+
+	if q.Has("bbox") {
+		items := splitList(q.Get("bbox"))
+		if len(items) != 4 {
+			return filter, fmt.Errorf("bbox must be formatted as min_lon,min_lat,max_lon,max_lat")
+		}
+		for _, item := range items {
+			value, err := strconv.ParseFloat(item, 64)
+			if err != nil {
+				return filter, fmt.Errorf("bbox must be formatted as min_lon,min_lat,max_lon,max_lat")
+			}
+			filter.bbox = append(filter.bbox, value)
+		}
+		if filter.bbox[1] > filter.bbox[3] {
+			return filter, fmt.Errorf("bbox min_lat must not be greater than max_lat")
+		}
+	}
+
+	if q.Has("sensors") {
+		filter.sensors = make(map[string]bool)
+		for _, sensor := range splitList(q.Get("sensors")) {
+			filter.sensors[sensor] = true
+		}
+	}
+
+	// Stations are either given as server/station, or just station to match
+	// it on any server
+	if q.Has("stations") {
+		filter.stations = make(map[string]bool)
+		for _, station := range splitList(q.Get("stations")) {
+			filter.stations[station] = true
+		}
+	}
+
+	return filter, nil
+}
+
+func (self *firehoseFilter) inBBox(latitude float64, longitude float64) bool {
+	if latitude < self.bbox[1] || latitude > self.bbox[3] {
+		return false
+	}
+	// A bbox may cross the antimeridian
+	if self.bbox[0] <= self.bbox[2] {
+		return longitude >= self.bbox[0] && longitude <= self.bbox[2]
+	}
+	return longitude >= self.bbox[0] || longitude <= self.bbox[2]
+}
+
+// firehose filters the observations of every station for a single client.
+type firehose struct {
+	db     *sql.DB
+	filter firehoseFilter
+
+	infos   map[string]types.StationEntry
+	fetched map[string]time.Time
+}
+
+func (self *firehose) stationInfo(server string, station string) (types.StationEntry, bool) {
+	id := types.MapId(server, station)
+	if fetched, exists := self.fetched[id]; exists && time.Since(fetched) < firehoseInfoTTL {
+		info, exists := self.infos[id]
+		return info, exists
+	}
+
+	info, exists, err := database.FetchStationInfo(self.db, server, station)
+	if err != nil {
+		fmt.Printf("Could not fetch station info: %v\n", err)
+	}
+	self.fetched[id] = time.Now()
+	if !exists || err != nil {
+		delete(self.infos, id)
+		return types.StationEntry{}, false
+	}
+	self.infos[id] = info
+	return info, true
+}
+
+// observation converts an entry into what the client asked for. False is
+// returned if the client doesn't want the entry.
+func (self *firehose) observation(entry types.WeatherEntry) (firehoseObservation, bool) {
+	filter := &self.filter
+	if filter.stations != nil &&
+		!filter.stations[entry.Station] &&
+		!filter.stations[entry.Server+"/"+entry.Station] {
+		return firehoseObservation{}, false
+	}
+
+	if filter.bbox != nil {
+		info, exists := self.stationInfo(entry.Server, entry.Station)
+		if !exists || !filter.inBBox(info.Latitude, info.Longitude) {
+			return firehoseObservation{}, false
+		}
+	}
+
+	sensors := entry.Sensors
+	if filter.sensors != nil {
+		sensors = make(map[string][]types.SensorValue)
+		for name, values := range entry.Sensors {
+			if filter.sensors[name] {
+				sensors[name] = values
+			}
+		}
+		if len(sensors) == 0 {
+			return firehoseObservation{}, false
+		}
+	}
+
+	return firehoseObservation{
+		Server:  entry.Server,
+		Station: entry.Station,
+		Time:    entry.Time,
+		Sensors: convertSensors(sensors, filter.units),
+	}, true
+}
+
+func (self *firehose) streamEvents(bus *events.Bus, w http.ResponseWriter, r *http.Request) {
+	updates := bus.SubscribeAllObservations(pubsub.DropOldest)
+	defer bus.UnsubscribeAllObservations(updates)
+
+	stream := startEventStream(w)
+
+	send := func(entry types.WeatherEntry) {
+		observation, ok := self.observation(entry)
+		if !ok {
+			return
+		}
+		if err := stream.Send(EventObservation, entry.ID, observation); err != nil {
+			fmt.Printf("Could not send message: %v\n", err)
+		}
+	}
+
+	// Entry ids are shared by every server, so the whole network can be
+	// replayed from the last id the client saw
+	last_id, replay := lastEventId(r)
+	if replay {
+		entries, err := database.FetchEntries(self.db, `WHERE weather_entry.id > ?
+				AND NOT weather_entry.backfilled
+			ORDER BY weather_entry.id ASC
+			LIMIT ?`,
+			last_id, maxReplay+1)
+		if err != nil {
+			fmt.Printf("Could not fetch entries: %v\n", err)
+		}
+		if len(entries) > maxReplay {
+			stream.Gap(last_id)
+			entries = nil
+		}
+		for _, entry := range entries {
+			send(entry)
+			last_id = entry.ID
+		}
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case entry := <-updates.C:
+			if replay && entry.ID <= last_id {
+				continue
+			}
+			send(entry)
+		case <-heartbeat.C:
+			stream.Heartbeat()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (self *firehose) streamWebSocket(bus *events.Bus, w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Printf("Could not upgrade websocket: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	updates := bus.SubscribeAllObservations(pubsub.DropOldest)
+	defer bus.UnsubscribeAllObservations(updates)
+
+	// The firehose doesn't take any requests, but reading is still needed to
+	// handle pongs and notice when the client goes away
+	closed := make(chan interface{})
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(4096)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			conn.SetReadDeadline(time.Now().Add(wsPongWait))
+			return nil
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	// Observations that the client has missed since the last message
+	var reported uint64
+
+	for {
+		select {
+		case entry := <-updates.C:
+			observation, ok := self.observation(entry)
+			if !ok {
+				continue
+			}
+			total := updates.Dropped()
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err := conn.WriteJSON(wsMessage{
+				Type:    EventObservation,
+				Data:    observation,
+				Dropped: int(total - reported),
+			})
+			if err != nil {
+				return
+			}
+			reported = total
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// FirehoseRoute streams the observations of every station over SSE, or over a
+// websocket if the client asks to upgrade. Observations may be filtered with
+// the bbox, sensors and stations parameters.
+func FirehoseRoute(db *sql.DB, bus *events.Bus, tokens map[string]string, r *mux.Router) {
+	r.HandleFunc("/stream/all/",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "no-cache")
+
+			client, ok := authorize(w, r, tokens)
+			if !ok {
+				return
+			}
+
+			filter, err := parseFirehoseFilter(r.URL.Query())
+			if err != nil {
+				ErrorMessage(w, 400, err.Error())
+				return
+			}
+
+			self := &firehose{
+				db:      db,
+				filter:  filter,
+				infos:   make(map[string]types.StationEntry),
+				fetched: make(map[string]time.Time),
+			}
+
+			fmt.Printf("Firehose client %v connected\n", client)
+			defer fmt.Printf("Firehose client %v disconnected\n", client)
+
+			if websocket.IsWebSocketUpgrade(r) {
+				self.streamWebSocket(bus, w, r)
+			} else {
+				self.streamEvents(bus, w, r)
+			}
+		})
+}
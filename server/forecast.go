@@ -0,0 +1,270 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/forecast"
+	"github.com/ttocsneb/weather/types"
+	"github.com/ttocsneb/weather/util"
+)
+
+func metricSensor(sensors map[string][]types.SensorValue, name string) (float64, bool) {
+	values, exists := sensors[name]
+	if !exists || len(values) == 0 {
+		return 0, false
+	}
+	value, _ := util.SensorToMetric(values[0].Value, values[0].Unit, name)
+	return value, true
+}
+
+func pressureHistory(entries []types.WeatherEntry, sensor string) []types.WeatherEntry {
+	history := []types.WeatherEntry{}
+	for _, entry := range entries {
+		if _, exists := metricSensor(entry.Sensors, sensor); exists {
+			history = append(history, entry)
+		}
+	}
+	return history
+}
+
+type nowcast struct {
+	Time      time.Time          `json:"time"`
+	Pressure  *types.SensorValue `json:"pressure,omitempty"`
+	SeaLevel  types.SensorValue  `json:"sea-level-pressure"`
+	Tendency  types.SensorValue  `json:"tendency"`
+	Trend     string             `json:"trend"`
+	Zambretti string             `json:"zambretti"`
+	Forecast  string             `json:"forecast"`
+	Beaufort  *int               `json:"beaufort,omitempty"`
+	Wind      string             `json:"wind,omitempty"`
+}
+
+func StationNowcastRoute(db *sql.DB, r *mux.Router) {
+	r.HandleFunc("/station/{server}/{station}/nowcast/",
+		func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+			server := vars["server"]
+			station := vars["station"]
+
+			w.Header().Set("Cache-Control", "no-cache")
+
+			loc, err := responseLocation(db, r, server, station)
+			if err != nil {
+				ErrorMessage(w, 400, fmt.Sprintf("tz: %v", err))
+				return
+			}
+
+			entries, err := database.FetchEntries(db, `WHERE server.value = ?
+					AND station.value = ?
+					AND time >= ?
+				ORDER BY time ASC`,
+				server, station, time.Now().UTC().Add(-(3*time.Hour + 30*time.Minute)))
+			if err != nil {
+				ErrorMessage(w, 500, "Internal Server Error")
+				fmt.Printf("Could not fetch entries: %v\n", err)
+				return
+			}
+
+			// Some protocols only report the pressure already reduced to sea
+			// level, which is used if there is no station pressure
+			sensor := types.SensorPressure
+			history := pressureHistory(entries, sensor)
+			if len(history) == 0 {
+				sensor = types.SensorSeaLevelPressure
+				history = pressureHistory(entries, sensor)
+			}
+			if len(history) == 0 {
+				ErrorMessage(w, 404, "No recent pressure readings")
+				return
+			}
+
+			latest := history[len(history)-1]
+			pressure, _ := metricSensor(latest.Sensors, sensor)
+
+			// Use the reading closest to 3 hours before the latest
+			target := latest.Time.Add(-3 * time.Hour)
+			reference := history[0]
+			for _, entry := range history[1:] {
+				if entry.Time.After(target) {
+					if entry.Time.Sub(target) < target.Sub(reference.Time) {
+						reference = entry
+					}
+					break
+				}
+				reference = entry
+			}
+			span := latest.Time.Sub(reference.Time)
+			if span < time.Hour {
+				ErrorMessage(w, 404, "Not enough pressure history")
+				return
+			}
+			reference_pressure, _ := metricSensor(reference.Sensors, sensor)
+			tendency := (pressure - reference_pressure) * float64(3*time.Hour) / float64(span)
+
+			northern := true
+			elevation := 0.0
+			info, exists, err := database.FetchStationInfo(db, server, station)
+			if err != nil {
+				fmt.Printf("Could not fetch station info: %v\n", err)
+			} else if exists {
+				northern = info.Latitude >= 0
+				elevation = info.Elevation
+			}
+
+			// The tendency is fine on station pressure, but Zambretti's bands
+			// are for pressure at sea level
+			sea_level := pressure
+			if sensor == types.SensorPressure {
+				temperature := math.NaN()
+				if value, exists := metricSensor(latest.Sensors, types.SensorTemperature); exists {
+					temperature = value
+				}
+				sea_level = forecast.SeaLevelPressure(pressure, elevation, temperature)
+			}
+
+			wind_direction := math.NaN()
+			if dir, exists := metricSensor(latest.Sensors, types.SensorWindDirection); exists {
+				wind_direction = dir
+			}
+
+			trend, trend_name := forecast.PressureTendency(tendency)
+			letter, text := forecast.Zambretti(sea_level, trend, wind_direction,
+				latest.Time.Month(), northern)
+
+			result := nowcast{
+				Time:      latest.Time,
+				Trend:     trend_name,
+				Zambretti: letter,
+				Forecast:  text,
+			}
+
+			if speed, exists := metricSensor(latest.Sensors, types.SensorWindSpeed); exists {
+				number, description := forecast.Beaufort(speed)
+				result.Beaufort = &number
+				result.Wind = description
+			}
+
+			if loc != nil {
+				result.Time = result.Time.In(loc)
+			}
+
+			if sensor == types.SensorPressure {
+				value, unit := util.SensorToImperial(pressure, "hpa", types.SensorPressure)
+				result.Pressure = &types.SensorValue{Unit: unit, Value: value}
+			}
+			value, unit := util.SensorToImperial(sea_level, "hpa", types.SensorPressure)
+			result.SeaLevel = types.SensorValue{Unit: unit, Value: value}
+			value, unit = util.SensorToImperial(tendency, "hpa", types.SensorPressure)
+			result.Tendency = types.SensorValue{Unit: unit, Value: value}
+
+			writeJson(w, 200, result)
+		})
+}
+
+type forecastValue struct {
+	Time  time.Time `json:"time"`
+	Unit  string    `json:"unit"`
+	Value float64   `json:"value"`
+	Lower float64   `json:"lower"`
+	Upper float64   `json:"upper"`
+}
+
+type stationForecast struct {
+	Server  string                     `json:"server"`
+	Station string                     `json:"station"`
+	Trained time.Time                  `json:"trained"`
+	Sensors map[string][]forecastValue `json:"sensors"`
+}
+
+func StationForecastRoute(db *sql.DB, trainer *forecast.Trainer, r *mux.Router) {
+	r.HandleFunc("/station/{server}/{station}/forecast/",
+		func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+			server := vars["server"]
+			station := vars["station"]
+
+			w.Header().Set("Cache-Control", "no-cache")
+
+			loc, err := responseLocation(db, r, server, station)
+			if err != nil {
+				ErrorMessage(w, 400, fmt.Sprintf("tz: %v", err))
+				return
+			}
+
+			hours := 24
+			q := r.URL.Query()
+			if q.Has("hours") {
+				hours, err = strconv.Atoi(q.Get("hours"))
+				if err != nil || hours < 1 || hours > 72 {
+					ErrorMessage(w, 400, "hours must be a number between 1 and 72")
+					return
+				}
+			}
+
+			_, exists, err := database.FetchStationInfo(db, server, station)
+			if err != nil {
+				ErrorMessage(w, 500, "Internal Server Error")
+				fmt.Printf("Could not fetch station info: %v\n", err)
+				return
+			}
+			if !exists {
+				ErrorMessage(w, 404, "No station found")
+				return
+			}
+
+			models, status := trainer.Models(types.StationKey{Server: server, Station: station})
+			switch status {
+			case forecast.ModelsTraining:
+				w.Header().Set("Retry-After", "10")
+				ErrorMessage(w, 202, "The forecast is being trained, try again later")
+				return
+			case forecast.ModelsUnavailable:
+				ErrorMessage(w, 404, "Not enough history to forecast")
+				return
+			}
+			if loc == nil {
+				loc = time.UTC
+			}
+
+			result := stationForecast{
+				Server:  server,
+				Station: station,
+				Trained: models.Trained.In(loc),
+				Sensors: make(map[string][]forecastValue),
+			}
+
+			now := time.Now()
+			for name, model := range models.Sensors {
+				// Skip the steps between the end of the training data and now
+				skip := int(now.Sub(model.Start)/model.Step) - model.Count
+				if skip < 0 {
+					skip = 0
+				}
+				predictions := model.Predict(skip + hours)[skip:]
+
+				values := make([]forecastValue, len(predictions))
+				for i, prediction := range predictions {
+					value, unit := util.SensorToImperial(prediction.Value, model.Unit, name)
+					lower, _ := util.SensorToImperial(prediction.Lower, model.Unit, name)
+					upper, _ := util.SensorToImperial(prediction.Upper, model.Unit, name)
+					values[i] = forecastValue{
+						Time:  prediction.Time.In(loc),
+						Unit:  unit,
+						Value: value,
+						Lower: lower,
+						Upper: upper,
+					}
+				}
+				result.Sensors[name] = values
+			}
+
+			writeJson(w, 200, result)
+		})
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ttocsneb/weather/events"
+	"github.com/ttocsneb/weather/influx"
+	"github.com/ttocsneb/weather/stations"
+)
+
+// InfluxWriteRoute accepts line protocol in the same way as InfluxDB's v1 and
+// v2 write endpoints, so that /ingest/influx can be used as the url of an
+// InfluxDB output.
+func InfluxWriteRoute(db *sql.DB, bus *events.Bus, tokens map[string]string, r *mux.Router) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		// v1 clients may give their credentials as query parameters
+		if _, ok := checkToken(tokens, q.Get("p")); !ok {
+			if _, ok := authorize(w, r, tokens); !ok {
+				return
+			}
+		}
+
+		precision, err := influx.Precision(q.Get("precision"))
+		if err != nil {
+			ErrorMessage(w, 400, err.Error())
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestSize))
+		if err != nil {
+			ErrorMessage(w, 413, fmt.Sprintf("Body must be at most %v bytes", maxIngestSize))
+			return
+		}
+
+		points, err := influx.Parse(string(body), precision)
+		if err != nil {
+			ErrorMessage(w, 400, err.Error())
+			return
+		}
+		observations, err := influx.Observations(points, time.Now())
+		if err != nil {
+			ErrorMessage(w, 400, err.Error())
+			return
+		}
+
+		for _, observation := range observations {
+			if len(observation.Message.Sensors) == 0 {
+				continue
+			}
+			_, err := stations.Ingest(db, bus, observation.Server, stations.Normalize(observation.Message))
+			if stations.Rejected(err) {
+				fmt.Printf("Rejected point for %v - %v: %v\n", observation.Server, observation.Message.ID, err)
+				continue
+			}
+			if err != nil && !errors.Is(err, stations.ErrDuplicate) {
+				fmt.Printf("Unable to save message to db: %v\n", err)
+				ErrorMessage(w, 500, "Could not save message")
+				return
+			}
+		}
+		fmt.Printf("Received %v points over line protocol\n", len(points))
+
+		w.WriteHeader(204)
+	}
+
+	r.HandleFunc("/ingest/influx/write", handler).Methods("POST")
+	r.HandleFunc("/ingest/influx/api/v2/write", handler).Methods("POST")
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ttocsneb/weather/events"
+	"github.com/ttocsneb/weather/stations"
+	"github.com/ttocsneb/weather/types"
+)
+
+// The largest request body that may be ingested
+const maxIngestSize = 4 << 20
+
+// The most messages that may be ingested in a single request
+const maxIngestBatch = 1000
+
+type ingestResult struct {
+	Accepted int `json:"accepted"`
+	// Messages that were already stored, whose ids are still given
+	Duplicates int `json:"duplicates"`
+	// Messages that were refused because of their time
+	Rejected []string `json:"rejected,omitempty"`
+	IDs      []int64  `json:"ids,omitempty"`
+}
+
+// decodeBatch reads either a single message or an array of them from the
+// body of a request. If the body can't be read, an error is written and false
+// is returned.
+func decodeBatch[T any](w http.ResponseWriter, r *http.Request) ([]T, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestSize))
+	if err != nil {
+		ErrorMessage(w, 413, fmt.Sprintf("Body must be at most %v bytes", maxIngestSize))
+		return nil, false
+	}
+
+	body = bytes.TrimSpace(body)
+	var messages []T
+	if len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &messages)
+	} else {
+		var message T
+		err = json.Unmarshal(body, &message)
+		messages = []T{message}
+	}
+	if err != nil {
+		ErrorMessage(w, 400, fmt.Sprintf("Invalid message: %v", err))
+		return nil, false
+	}
+	if len(messages) == 0 {
+		ErrorMessage(w, 400, "No messages given")
+		return nil, false
+	}
+	if len(messages) > maxIngestBatch {
+		ErrorMessage(w, 400, fmt.Sprintf("At most %v messages may be sent at once", maxIngestBatch))
+		return nil, false
+	}
+	return messages, true
+}
+
+// IngestRoute lets stations that can't reach a broker report over HTTP. The
+// messages are the same as the ones sent over MQTT, and may be batched into
+// an array.
+func IngestRoute(db *sql.DB, bus *events.Bus, tokens map[string]string, r *mux.Router) {
+	r.HandleFunc("/ingest/{server}/{station}/weather",
+		func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+			server := vars["server"]
+			station := vars["station"]
+
+			if _, ok := authorize(w, r, tokens); !ok {
+				return
+			}
+
+			messages, ok := decodeBatch[types.WeatherMessage](w, r)
+			if !ok {
+				return
+			}
+			for _, message := range messages {
+				if message.ID != "" && message.ID != station {
+					ErrorMessage(w, 400, fmt.Sprintf("Message is for %v, not %v", message.ID, station))
+					return
+				}
+			}
+
+			result := ingestResult{IDs: []int64{}}
+			for _, message := range messages {
+				message.ID = station
+				if message.Time.IsZero() {
+					message.Time = time.Now()
+				}
+				entry, err := stations.Ingest(db, bus, server, stations.Normalize(message))
+				if stations.Rejected(err) {
+					result.Rejected = append(result.Rejected, err.Error())
+					continue
+				}
+				if errors.Is(err, stations.ErrDuplicate) {
+					result.Duplicates++
+				} else if err != nil {
+					fmt.Printf("Unable to save message to db: %v\n", err)
+					ErrorMessage(w, 500, "Could not save message")
+					return
+				} else {
+					result.Accepted++
+				}
+				result.IDs = append(result.IDs, entry.ID)
+			}
+			fmt.Printf("Received %v messages over http for %v - %v\n", len(messages), server, station)
+
+			writeJson(w, 200, result)
+		}).Methods("POST")
+
+	// Stations that were offline upload the messages that they buffered, which
+	// are stored together without being streamed as live
+	r.HandleFunc("/ingest/{server}/{station}/backfill",
+		func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+			server := vars["server"]
+			station := vars["station"]
+
+			if _, ok := authorize(w, r, tokens); !ok {
+				return
+			}
+
+			messages, ok := decodeBatch[types.WeatherMessage](w, r)
+			if !ok {
+				return
+			}
+			for i, message := range messages {
+				if message.ID != "" && message.ID != station {
+					ErrorMessage(w, 400, fmt.Sprintf("Message is for %v, not %v", message.ID, station))
+					return
+				}
+				if message.Time.IsZero() {
+					ErrorMessage(w, 400, "Backfilled messages must have a time")
+					return
+				}
+				message.ID = station
+				messages[i] = stations.Normalize(message)
+			}
+
+			backfill, err := stations.Backfill(db, server, messages)
+			if err != nil {
+				fmt.Printf("Unable to save backfill to db: %v\n", err)
+				ErrorMessage(w, 500, "Could not save backfill")
+				return
+			}
+
+			result := ingestResult{
+				Accepted:   len(backfill.Entries) - backfill.Duplicates,
+				Duplicates: backfill.Duplicates,
+				IDs:        []int64{},
+			}
+			for _, entry := range backfill.Entries {
+				result.IDs = append(result.IDs, entry.ID)
+			}
+			for _, err := range backfill.Rejected {
+				result.Rejected = append(result.Rejected, err.Error())
+			}
+			fmt.Printf("Received backfill of %v messages over http for %v - %v\n", len(messages), server, station)
+
+			writeJson(w, 200, result)
+		}).Methods("POST")
+
+	r.HandleFunc("/ingest/{server}/{station}/info",
+		func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+			server := vars["server"]
+			station := vars["station"]
+
+			if _, ok := authorize(w, r, tokens); !ok {
+				return
+			}
+
+			messages, ok := decodeBatch[types.StationMessage](w, r)
+			if !ok {
+				return
+			}
+
+			// Only the latest info of a station is kept
+			info, err := stations.IngestStationInfo(db, bus, server, station, messages[len(messages)-1])
+			if err != nil {
+				fmt.Printf("Unable to save station info: %v\n", err)
+				ErrorMessage(w, 500, "Could not save station info")
+				return
+			}
+			fmt.Printf("Received station info over http for %v - %v\n", info.Server, info.Station)
+
+			writeJson(w, 200, info)
+		}).Methods("POST")
+}
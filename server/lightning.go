@@ -0,0 +1,175 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/lightning"
+	"github.com/ttocsneb/weather/types"
+)
+
+type lightningStrike struct {
+	Time     time.Time          `json:"time"`
+	Count    int                `json:"count"`
+	Distance *types.SensorValue `json:"distance"`
+}
+
+type lightningStorm struct {
+	Latitude  float64           `json:"latitude"`
+	Longitude float64           `json:"longitude"`
+	Error     types.SensorValue `json:"error"`
+	Stations  int               `json:"stations"`
+}
+
+type lightningResponse struct {
+	Window  float64            `json:"window"`
+	Count   int                `json:"count"`
+	Rate    float64            `json:"rate"`
+	Nearest *types.SensorValue `json:"nearest"`
+	Last    *time.Time         `json:"last"`
+	Strikes []lightningStrike  `json:"strikes"`
+	Storm   *lightningStorm    `json:"storm"`
+}
+
+func convertStrike(strike types.LightningStrike, loc *time.Location) lightningStrike {
+	result := lightningStrike{
+		Time:  strike.Time,
+		Count: strike.Count,
+	}
+	if loc != nil {
+		result.Time = result.Time.In(loc)
+	}
+	if strike.Distance != nil {
+		distance := imperialSensor(*strike.Distance, "km", types.SensorLightningDistance)
+		result.Distance = &distance
+	}
+	return result
+}
+
+// locateStorm combines the nearest strikes seen by the stations around a
+// location to estimate where the storm is.
+func locateStorm(db *sql.DB, latitude float64, longitude float64, dist float64, after time.Time) (lightning.Storm, bool, error) {
+	stations, _, err := findNearestStations(db, latitude, longitude, dist)
+	if err != nil {
+		return lightning.Storm{}, false, err
+	}
+
+	observations := []lightning.Observation{}
+	for _, station := range stations {
+		strikes, err := lightning.FetchStrikes(db, station.Server, station.Station, after)
+		if err != nil {
+			return lightning.Storm{}, false, err
+		}
+		summary := lightning.Summarize(strikes, time.Since(after))
+		if summary.Nearest == nil {
+			continue
+		}
+		observations = append(observations, lightning.Observation{
+			Latitude:  station.Latitude,
+			Longitude: station.Longitude,
+			Distance:  *summary.Nearest,
+		})
+	}
+
+	storm, ok := lightning.LocateStorm(observations)
+	return storm, ok, nil
+}
+
+func StationLightningRoute(db *sql.DB, r *mux.Router) {
+	r.HandleFunc("/station/{server}/{station}/lightning/",
+		func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+			server := vars["server"]
+			station := vars["station"]
+
+			w.Header().Set("Cache-Control", "no-cache")
+
+			q := r.URL.Query()
+
+			minutes := 30
+			if q.Has("minutes") {
+				var err error
+				minutes, err = strconv.Atoi(q.Get("minutes"))
+				if err != nil || minutes < 1 || minutes > 24*60 {
+					ErrorMessage(w, 400, "minutes must be between 1 and 1440")
+					return
+				}
+			}
+			dist, err := queryFloat(q, "range", 100)
+			if err != nil {
+				ErrorMessage(w, 400, err.Error())
+				return
+			}
+
+			loc, err := responseLocation(db, r, server, station)
+			if err != nil {
+				ErrorMessage(w, 400, fmt.Sprintf("tz: %v", err))
+				return
+			}
+
+			info, exists, err := database.FetchStationInfo(db, server, station)
+			if err != nil {
+				ErrorMessage(w, 500, "Could not fetch station info")
+				fmt.Printf("Could not fetch station info: %v\n", err)
+				return
+			}
+			if !exists {
+				ErrorMessage(w, 404, "No station found")
+				return
+			}
+
+			window := time.Duration(minutes) * time.Minute
+			after := time.Now().Add(-window)
+
+			strikes, err := lightning.FetchStrikes(db, server, station, after)
+			if err != nil {
+				ErrorMessage(w, 500, "Could not fetch lightning")
+				fmt.Printf("Could not fetch lightning: %v\n", err)
+				return
+			}
+			summary := lightning.Summarize(strikes, window)
+
+			response := lightningResponse{
+				Window:  window.Minutes(),
+				Count:   summary.Count,
+				Rate:    summary.Rate,
+				Last:    summary.Last,
+				Strikes: []lightningStrike{},
+			}
+			if summary.Nearest != nil {
+				nearest := imperialSensor(*summary.Nearest, "km", types.SensorLightningDistance)
+				response.Nearest = &nearest
+			}
+			if response.Last != nil && loc != nil {
+				last := response.Last.In(loc)
+				response.Last = &last
+			}
+			for _, strike := range strikes {
+				response.Strikes = append(response.Strikes, convertStrike(strike, loc))
+			}
+
+			if summary.Count > 0 {
+				storm, ok, err := locateStorm(db, info.Latitude, info.Longitude, dist, after)
+				if err != nil {
+					ErrorMessage(w, 500, "Could not locate storm")
+					fmt.Printf("Could not locate storm: %v\n", err)
+					return
+				}
+				if ok {
+					response.Storm = &lightningStorm{
+						Latitude:  storm.Latitude,
+						Longitude: storm.Longitude,
+						Error:     imperialSensor(storm.Error, "km", types.SensorLightningDistance),
+						Stations:  storm.Stations,
+					}
+				}
+			}
+
+			writeJson(w, 200, response)
+		})
+}
@@ -5,12 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/ttocsneb/weather/aqi"
 	"github.com/ttocsneb/weather/database"
-	"github.com/ttocsneb/weather/stations"
+	"github.com/ttocsneb/weather/events"
+	"github.com/ttocsneb/weather/pubsub"
 	"github.com/ttocsneb/weather/types"
 	"github.com/ttocsneb/weather/util"
 )
@@ -224,6 +228,7 @@ func LocationConditionsRoute(db *sql.DB, r *mux.Router) {
 					values[name] = types.SensorValue{
 						Unit:  unit,
 						Value: val,
+						Label: sensors[0].Label,
 					}
 				}
 
@@ -232,6 +237,7 @@ func LocationConditionsRoute(db *sql.DB, r *mux.Router) {
 					values[name] = types.SensorValue{
 						Unit:  unit,
 						Value: value,
+						Label: sensor.Label,
 					}
 				}
 
@@ -259,6 +265,7 @@ func LocationConditionsRoute(db *sql.DB, r *mux.Router) {
 				average_values[name] = types.SensorValue{
 					Unit:  unit,
 					Value: value,
+					Label: sensor.Label,
 				}
 			}
 
@@ -274,24 +281,69 @@ func LocationConditionsRoute(db *sql.DB, r *mux.Router) {
 }
 
 func fetchConditions(db *sql.DB, stations []types.StationEntry) ([]types.WeatherEntry, error) {
+	return fetchConditionsAt(db, stations, 0)
+}
+
+// stationConditions builds a condition that matches any of the stations.
+func stationConditions(stations []types.StationEntry) (string, []interface{}) {
+	conditions := make([]string, len(stations))
+	args := make([]interface{}, len(stations)*2)
+	for i, station := range stations {
+		conditions[i] = "(server.value = ? AND station.value = ?)"
+		args[i*2] = station.Server
+		args[i*2+1] = station.Station
+	}
+	return fmt.Sprintf("(%v)", strings.Join(conditions, " OR ")), args
+}
+
+// fetchConditionsAt fetches the latest entry of each station with an id of at
+// most last. If last is 0, the latest entries are fetched.
+func fetchConditionsAt(db *sql.DB, stations []types.StationEntry, last int64) ([]types.WeatherEntry, error) {
 	conditions := make([]string, len(stations))
-	args := make([]interface{}, len(stations)*4)
+	args := []interface{}{}
+
+	last_query := ""
+	if last > 0 {
+		last_query = "AND weather_entry.id <= ?"
+	}
 
 	for i, station := range stations {
 		conditions[i] = fmt.Sprintf(
 			`(server.value = ? AND station.value = ? AND time = (
 			SELECT MAX(time) FROM weather_entry %v
-			WHERE server.value = ? AND station.value = ?)
-		)`, database.GenStringJoins("weather_entry", "station", "server"))
-		args[i*4] = station.Server
-		args[i*4+1] = station.Station
-		args[i*4+2] = station.Server
-		args[i*4+3] = station.Station
+			WHERE server.value = ? AND station.value = ? %v)
+		)`, database.GenStringJoins("weather_entry", "station", "server"), last_query)
+		args = append(args, station.Server, station.Station, station.Server, station.Station)
+		if last > 0 {
+			args = append(args, last)
+		}
 	}
 
 	entries, err := database.FetchEntries(db,
 		fmt.Sprintf("WHERE %v", strings.Join(conditions, " OR ")), args...)
-	return entries, err
+	if err != nil {
+		return entries, err
+	}
+
+	return entries, nil
+}
+
+// fetchEntriesAfter fetches the entries of the stations with an id after
+// last, up to one more than can be replayed.
+func fetchEntriesAfter(db *sql.DB, stations []types.StationEntry, last int64) ([]types.WeatherEntry, error) {
+	condition, args := stationConditions(stations)
+	args = append(args, last, maxReplay+1)
+
+	entries, err := database.FetchEntries(db, fmt.Sprintf(`WHERE %v
+			AND weather_entry.id > ?
+			AND NOT weather_entry.backfilled
+		ORDER BY weather_entry.id ASC
+		LIMIT ?`, condition), args...)
+	if err != nil {
+		return entries, err
+	}
+
+	return entries, nil
 }
 
 func averageConditions(conditions []types.WeatherEntry, weights map[string]float64) map[string]types.SensorValue {
@@ -306,6 +358,9 @@ func averageConditions(conditions []types.WeatherEntry, weights map[string]float
 	for _, entry := range conditions {
 		weight := weights[entry.MapId()]
 		for name, sensors := range entry.Sensors {
+			if slices.Contains(aqi.Indices, name) {
+				continue
+			}
 			val, unit := util.SensorToMetric(sensors[0].Value, sensors[0].Unit, name)
 			v, exists := value_list[name]
 			if !exists {
@@ -329,10 +384,16 @@ func averageConditions(conditions []types.WeatherEntry, weights map[string]float
 		}
 	}
 
+	// The indices aren't linear, so they are found from the average
+	// concentrations instead
+	for name, value := range aqi.CalculateIndices(average_values) {
+		average_values[name] = value
+	}
+
 	return average_values
 }
 
-func LocationConditionsUpdateRoute(db *sql.DB, brokers map[string]stations.Broker, r *mux.Router) {
+func LocationConditionsUpdateRoute(db *sql.DB, bus *events.Bus, r *mux.Router) {
 	r.HandleFunc("/location/conditions/updates/",
 		func(w http.ResponseWriter, r *http.Request) {
 			var err error
@@ -380,119 +441,140 @@ func LocationConditionsUpdateRoute(db *sql.DB, brokers map[string]stations.Broke
 				return
 			}
 
-			// Subscribe to each station's raw_updates in this location
-			raw_updates := make(map[string]chan types.WeatherMessage)
-			updates := make(chan types.WeatherEntry)
+			weights := findWeights(&dists)
+			weight_mapping := make(map[string]float64)
+			for i, weight := range weights {
+				weight_mapping[stations[i].MapId()] = weight
+			}
+
+			streamConditions(db, bus, w, r, stations, weight_mapping)
+		})
+}
 
-			on_update := func(server string, ch chan types.WeatherMessage) {
-				for {
-					update, ok := <-ch
-					if !ok {
-						break
-					}
-					updates <- update.ToEntry(server)
-				}
+// streamConditions sends the average conditions of a group of stations every
+// time one of them sends an update. Each event has the id of the entry that
+// caused it so that a reconnecting client can be caught up.
+func streamConditions(db *sql.DB, bus *events.Bus, w http.ResponseWriter, r *http.Request, station_list []types.StationEntry, weights map[string]float64) {
+	// Subscribe to each station's raw_updates in this location. Only the
+	// latest observation of each station goes into the average, so older
+	// ones are coalesced away when the client falls behind
+	updates := make(chan types.WeatherEntry)
+
+	on_update := func(sub *events.ObservationSubscription) {
+		for entry := range sub.C {
+			select {
+			case updates <- entry:
+			case <-r.Context().Done():
 			}
+		}
+	}
 
-			for _, station := range stations {
-				broker, exists := brokers[station.Server]
-				if !exists {
-					ErrorMessage(w, 500, "Internal Server Error")
-					fmt.Printf("Couldn't find broker %s\n", station.Server)
-					return
-				}
+	raw_updates := make([]*events.ObservationSubscription, len(station_list))
+	for i, station := range station_list {
+		raw_updates[i] = bus.SubscribeObservations(station.Key(), pubsub.Coalesce)
+		go on_update(raw_updates[i])
+	}
+	defer func() {
+		for i, station := range station_list {
+			bus.UnsubscribeObservations(station.Key(), raw_updates[i])
+		}
+	}()
+
+	// Fetch the current weather conditions for the location, or the
+	// conditions that the client last saw if it is reconnecting
+	last_id, replay := lastEventId(r)
+	var entries []types.WeatherEntry
+	var err error
+	if replay {
+		entries, err = fetchConditionsAt(db, station_list, last_id)
+	} else {
+		entries, err = fetchConditions(db, station_list)
+	}
+	if err != nil {
+		ErrorMessage(w, 500, "Internal Server Error")
+		fmt.Printf("Unable to fetch weather entries: %v\n", err)
+		return
+	}
 
-				ch, exists := raw_updates[station.Server]
-				if !exists {
-					ch = make(chan types.WeatherMessage)
-					raw_updates[station.Server] = ch
-					go on_update(station.Server, ch)
-				}
+	conditions := make(map[string]types.WeatherEntry)
+	for _, entry := range entries {
+		conditions[entry.MapId()] = entry
+		if !replay && entry.ID > last_id {
+			last_id = entry.ID
+		}
+	}
 
-				broker.SubscribeWeatherUpdates(station.Station, ch)
-			}
-			defer func() {
-				for _, station := range stations {
-					broker := brokers[station.Server]
-					ch := raw_updates[station.Server]
-					broker.UnsubscribeWeatherUpdates(station.Station, ch)
-				}
-				for _, ch := range raw_updates {
-					close(ch)
-				}
-				close(updates)
-			}()
+	stream := startEventStream(w)
 
-			conditions := make(map[string]types.WeatherEntry)
+	updateConditions := func(id int64) {
+		entries := make([]types.WeatherEntry, 0, len(conditions))
+		for _, entry := range conditions {
+			entries = append(entries, entry)
+		}
 
-			// Fetch the current weather conditions for the location
-			mapping := make(map[string]int)
-			map_ids := make([]string, len(stations))
-			for i, station := range stations {
-				mapid := station.MapId()
-				mapping[mapid] = i
-				map_ids[i] = mapid
+		vals := averageConditions(entries, weights)
+		for name, sensor := range vals {
+			value, unit := util.SensorToImperial(sensor.Value, sensor.Unit, name)
+			vals[name] = types.SensorValue{
+				Unit:  unit,
+				Value: value,
+				Label: sensor.Label,
 			}
-			entries, err := fetchConditions(db, stations)
+		}
+
+		if err := stream.Send(EventObservation, id, vals); err != nil {
+			fmt.Printf("Unable to send weather conditions: %v\n", err)
+		}
+	}
+
+	if replay {
+		// Catch the client up on every update that it missed
+		missed, err := fetchEntriesAfter(db, station_list, last_id)
+		if err != nil {
+			fmt.Printf("Unable to fetch weather entries: %v\n", err)
+		}
+		if len(missed) > maxReplay {
+			// Too much was missed, so start over from the current conditions
+			stream.Gap(last_id)
+			current, err := fetchConditions(db, station_list)
 			if err != nil {
-				ErrorMessage(w, 500, "Internal Server Error")
 				fmt.Printf("Unable to fetch weather entries: %v\n", err)
-				return
 			}
-			for _, entry := range entries {
+			for _, entry := range current {
 				conditions[entry.MapId()] = entry
-			}
-			weights := findWeights(&dists)
-			weight_mapping := make(map[string]float64)
-			for i, weight := range weights {
-				weight_mapping[map_ids[i]] = weight
-			}
-
-			updateConditions := func() {
-				entries := make([]types.WeatherEntry, len(conditions))
-				i := 0
-				for _, entry := range conditions {
-					entries[i] = entry
+				if entry.ID > last_id {
+					last_id = entry.ID
 				}
-
-				vals := averageConditions(entries, weight_mapping)
-				for name, sensor := range vals {
-					value, unit := util.SensorToImperial(sensor.Value, sensor.Unit, name)
-					vals[name] = types.SensorValue{
-						Unit:  unit,
-						Value: value,
-					}
-				}
-
-				data, err := json.Marshal(vals)
-				if err != nil {
-					ErrorMessage(w, 500, "Internal Server Error")
-					fmt.Printf("Unable to marshal weather conditions")
-					return
-				}
-
-				w.Write([]byte(fmt.Sprintf("data: %v\n\n", string(data))))
-				w.(http.Flusher).Flush()
 			}
+			updateConditions(last_id)
+			missed = nil
+		}
+		for _, entry := range missed {
+			conditions[entry.MapId()] = entry
+			last_id = entry.ID
+			updateConditions(entry.ID)
+		}
+	} else {
+		updateConditions(last_id)
+	}
 
-			w.Header().Set("Content-Type", "text/event-stream")
-			w.Header().Set("Cache-Control", "no-cache")
-			w.Header().Set("Connection", "keep-alive")
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.WriteHeader(200)
-			w.(http.Flusher).Flush()
-
-			updateConditions()
-
-			// Whenever an update comes, recalculate the weather conditions for this location
-			for {
-				select {
-				case update := <-updates:
-					conditions[update.MapId()] = update
-					updateConditions()
-				case <-r.Context().Done():
-					return
-				}
-			}
-		})
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	// Whenever an update comes, recalculate the weather conditions for this location
+	for {
+		select {
+		case update := <-updates:
+			if update.ID != 0 && update.ID <= last_id {
+				continue
+			}
+			conditions[update.MapId()] = update
+			last_id = update.ID
+			updateConditions(update.ID)
+		case <-heartbeat.C:
+			stream.Heartbeat()
+		case <-r.Context().Done():
+			return
+		}
+	}
 }
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/pubsub"
+	"github.com/ttocsneb/weather/stations"
+)
+
+type metricsInfo struct {
+	PubSub map[string]pubsub.Stats `json:"pubsub"`
+	Ingest stations.IngestStats    `json:"ingest"`
+	Writer *database.WriterStats   `json:"writer,omitempty"`
+}
+
+func MetricsRoute(r *mux.Router) {
+	r.HandleFunc("/metrics/",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "no-cache")
+
+			info := metricsInfo{
+				PubSub: pubsub.AllStats(),
+				Ingest: stations.Stats(),
+			}
+			if writer, exists := stations.WriterStats(); exists {
+				info.Writer = &writer
+			}
+			writeJson(w, 200, info)
+		})
+}
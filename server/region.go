@@ -10,7 +10,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/ttocsneb/weather/database"
-	"github.com/ttocsneb/weather/stations"
+	"github.com/ttocsneb/weather/events"
 	"github.com/ttocsneb/weather/types"
 	"github.com/ttocsneb/weather/util"
 )
@@ -224,6 +224,7 @@ func RegionConditionsRoute(db *sql.DB, r *mux.Router) {
 			results[name] = types.SensorValue{
 				Unit:  unit,
 				Value: value,
+				Label: sensor.Label,
 			}
 		}
 
@@ -242,7 +243,7 @@ func RegionConditionsRoute(db *sql.DB, r *mux.Router) {
 	r.HandleFunc("/region/conditions/{country}/{region}/{city}/{district}/", handler)
 }
 
-func RegionConditionsUpdateRoute(db *sql.DB, brokers map[string]stations.Broker, r *mux.Router) {
+func RegionConditionsUpdateRoute(db *sql.DB, bus *events.Bus, r *mux.Router) {
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Cache-Control", "no-cache")
 
@@ -264,118 +265,13 @@ func RegionConditionsUpdateRoute(db *sql.DB, brokers map[string]stations.Broker,
 			return
 		}
 
-		raw_updates := make(map[string]chan types.WeatherMessage)
-		updates := make(chan types.WeatherEntry)
-
-		on_update := func(server string, ch chan types.WeatherMessage) {
-			for {
-				update, ok := <-ch
-				if !ok {
-					break
-				}
-				updates <- update.ToEntry(server)
-			}
-		}
-
-		for _, station := range stations {
-			broker, exists := brokers[station.Server]
-			if !exists {
-				ErrorMessage(w, 500, "Internal Server Error")
-				fmt.Printf("Couldn't find broker %s\n", station.Server)
-				return
-			}
-
-			ch, exists := raw_updates[station.Server]
-			if !exists {
-				ch = make(chan types.WeatherMessage)
-				raw_updates[station.Server] = ch
-				go on_update(station.Server, ch)
-			}
-
-			broker.SubscribeWeatherUpdates(station.Station, ch)
-		}
-		defer func() {
-			for _, station := range stations {
-				broker := brokers[station.Server]
-				ch := raw_updates[station.Server]
-				broker.UnsubscribeWeatherUpdates(station.Station, ch)
-			}
-			for _, ch := range raw_updates {
-				close(ch)
-			}
-			close(updates)
-		}()
-
-		conditions := make(map[string]types.WeatherEntry)
-
-		// Fetch the current weather conditions for the location
-		mapping := make(map[string]int)
-		map_ids := make([]string, len(stations))
-		for i, station := range stations {
-			mapid := station.MapId()
-			mapping[mapid] = i
-			map_ids[i] = mapid
-		}
-		entries, err := fetchConditions(db, stations)
-		if err != nil {
-			ErrorMessage(w, 500, "Internal Server Error")
-			fmt.Printf("Unable to fetch weather entries: %v\n", err)
-			return
-		}
-		for _, entry := range entries {
-			conditions[entry.MapId()] = entry
-		}
-		weight := 1.0 / float64(len(entries))
+		weight := 1.0 / float64(len(stations))
 		weight_map := make(map[string]float64)
 		for _, station := range stations {
 			weight_map[station.MapId()] = weight
 		}
 
-		updateConditions := func() {
-			entries := make([]types.WeatherEntry, len(conditions))
-			i := 0
-			for _, entry := range conditions {
-				entries[i] = entry
-			}
-
-			vals := averageConditions(entries, weight_map)
-			for name, sensor := range vals {
-				value, unit := util.SensorToImperial(sensor.Value, sensor.Unit, name)
-				vals[name] = types.SensorValue{
-					Unit:  unit,
-					Value: value,
-				}
-			}
-
-			data, err := json.Marshal(vals)
-			if err != nil {
-				ErrorMessage(w, 500, "Internal Server Error")
-				fmt.Printf("Unable to marshal weather conditions")
-				return
-			}
-
-			w.Write([]byte(fmt.Sprintf("data: %v\n\n", string(data))))
-			w.(http.Flusher).Flush()
-		}
-
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.WriteHeader(200)
-		w.(http.Flusher).Flush()
-
-		updateConditions()
-
-		for {
-			select {
-			case update := <-updates:
-				conditions[update.MapId()] = update
-				updateConditions()
-			case <-r.Context().Done():
-				return
-			}
-		}
+		streamConditions(db, bus, w, r, stations, weight_map)
 	}
 	r.HandleFunc("/region/conditions/updates/{country}/{region}/{city}/", handler)
 	r.HandleFunc("/region/conditions/updates/{country}/{region}/{city}/{district}/", handler)
@@ -5,9 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/ttocsneb/weather/events"
+	"github.com/ttocsneb/weather/forecast"
 	"github.com/ttocsneb/weather/stations"
+	"github.com/ttocsneb/weather/tz"
 )
 
 type errorMsg struct {
@@ -21,20 +25,66 @@ func ErrorMessage(w http.ResponseWriter, code int, message string) {
 	w.Write(data)
 }
 
-func Serve(port uint16, db *sql.DB, brokers map[string]stations.Broker) {
+func writeJson(w http.ResponseWriter, code int, value any) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		ErrorMessage(w, 500, "Internal Server Error")
+		fmt.Printf("Could not marshal response: %v\n", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// responseLocation finds the time zone that a station's times should be
+// formatted in from the tz query parameter, which may either be "local" for
+// the station's own time zone or the name of any time zone. If there is no tz
+// parameter, nil is returned.
+func responseLocation(db *sql.DB, r *http.Request, server string, station string) (*time.Location, error) {
+	name := r.URL.Query().Get("tz")
+	switch name {
+	case "":
+		return nil, nil
+	case "local":
+		return tz.StationLocation(db, server, station)
+	}
+	return time.LoadLocation(name)
+}
+
+func Serve(port uint16, db *sql.DB, brokers map[string]stations.Broker, bus *events.Bus, trainer *forecast.Trainer, tokens map[string]string) {
 	r := mux.NewRouter()
 
 	StationConditionsRoute(db, r)
 	StationHistoryRoute(db, r)
 	StationRapidUpdatesRoute(db, brokers, r)
-	StationUpdatesRoute(db, brokers, r)
+	StationUpdatesRoute(db, bus, r)
 	StationInfoRoute(db, r)
+	StationNowcastRoute(db, r)
+	StationForecastRoute(db, trainer, r)
+	StationAstroRoute(db, r)
+	StationAgroRoute(db, r)
+	StationLightningRoute(db, r)
+	WebSocketRoute(db, bus, r)
+	FirehoseRoute(db, bus, tokens, r)
+	IngestRoute(db, bus, tokens, r)
+	UploadRoute(db, bus, tokens, r)
+	InfluxWriteRoute(db, bus, tokens, r)
 	NearestStationRoute(db, r)
+	LocationAstroRoute(r)
 	LocationConditionsRoute(db, r)
-	LocationConditionsUpdateRoute(db, brokers, r)
+	LocationConditionsUpdateRoute(db, bus, r)
 	RegionSearchRoute(db, r)
-	RegionConditionsUpdateRoute(db, brokers, r)
+	RegionConditionsUpdateRoute(db, bus, r)
 	RegionConditionsRoute(db, r)
+	BrokersRoute(brokers, r)
+	AlertRulesRoute(db, tokens, r)
+	AlertRuleRoute(db, tokens, r)
+	AlertRuleTestRoute(db, r)
+	AlertHistoryRoute(db, r)
+	AlertActiveRoute(db, r)
+	MetricsRoute(r)
 
 	fmt.Printf("Starting server on port %v\n", port)
 
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of the events sent over SSE
+const (
+	EventObservation = "observation"
+	EventStationInfo = "station-info"
+	EventAlert       = "alert"
+	EventLightning   = "lightning"
+	EventHeartbeat   = "heartbeat"
+	EventGap         = "gap"
+)
+
+// Heartbeats keep proxies from closing streams that have gone quiet
+const heartbeatInterval = 15 * time.Second
+
+// The most entries that are replayed to a client when it reconnects. A client
+// that missed more than this is sent a gap event instead.
+const maxReplay = 1000
+
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func startEventStream(w http.ResponseWriter) *eventStream {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(200)
+
+	stream := &eventStream{w: w}
+	stream.flusher, _ = w.(http.Flusher)
+	stream.flush()
+	return stream
+}
+
+func (self *eventStream) flush() {
+	if self.flusher != nil {
+		self.flusher.Flush()
+	}
+}
+
+// Send writes an event to the stream. Events with an id of 0 don't change the
+// client's last event id.
+func (self *eventStream) Send(event string, id int64, value any) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	var builder strings.Builder
+	if id > 0 {
+		builder.WriteString(fmt.Sprintf("id: %v\n", id))
+	}
+	builder.WriteString(fmt.Sprintf("event: %v\n", event))
+	builder.WriteString(fmt.Sprintf("data: %v\n\n", string(content)))
+
+	_, err = self.w.Write([]byte(builder.String()))
+	self.flush()
+	return err
+}
+
+func (self *eventStream) Heartbeat() error {
+	type heartbeat struct {
+		Time time.Time `json:"time"`
+	}
+	return self.Send(EventHeartbeat, 0, heartbeat{Time: time.Now()})
+}
+
+// Gap tells a reconnecting client that it missed too much to be replayed, so
+// that it can fetch what it missed some other way. Events after the gap are
+// sent as usual.
+func (self *eventStream) Gap(after int64) error {
+	type gap struct {
+		After int64 `json:"after"`
+		Limit int   `json:"limit"`
+	}
+	return self.Send(EventGap, 0, gap{After: after, Limit: maxReplay})
+}
+
+// lastEventId finds the id of the last event that a reconnecting client
+// received. Browsers send it in the Last-Event-ID header, while other clients
+// may use the lastEventId query parameter.
+func lastEventId(r *http.Request) (int64, bool) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("lastEventId")
+	}
+	if value == "" {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		return 0, false
+	}
+	return id, true
+}
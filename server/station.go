@@ -10,6 +10,9 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/events"
+	"github.com/ttocsneb/weather/lightning"
+	"github.com/ttocsneb/weather/pubsub"
 	"github.com/ttocsneb/weather/stations"
 	"github.com/ttocsneb/weather/types"
 	"github.com/ttocsneb/weather/util"
@@ -24,6 +27,12 @@ func StationConditionsRoute(db *sql.DB, r *mux.Router) {
 
 			w.Header().Set("Cache-Control", "no-cache")
 
+			loc, err := responseLocation(db, r, server, station)
+			if err != nil {
+				ErrorMessage(w, 400, fmt.Sprintf("tz: %v", err))
+				return
+			}
+
 			entry, err := database.FetchEntry(db, `WHERE server.value = ? 
 					AND station.value = ?
 				ORDER BY time DESC`,
@@ -34,12 +43,20 @@ func StationConditionsRoute(db *sql.DB, r *mux.Router) {
 				return
 			}
 
+			if err := deriveSensors(db, &entry); err != nil {
+				fmt.Printf("Could not derive sensors: %v\n", err)
+			}
+			if loc != nil {
+				entry.Time = entry.Time.In(loc)
+			}
+
 			for name, sensors := range entry.Sensors {
 				for i, sensor := range sensors {
 					value, unit := util.SensorToImperial(sensor.Value, sensor.Unit, name)
 					sensors[i] = types.SensorValue{
 						Unit:  unit,
 						Value: value,
+						Label: sensor.Label,
 					}
 				}
 			}
@@ -76,6 +93,12 @@ func StationHistoryRoute(db *sql.DB, r *mux.Router) {
 			fmt.Println(count)
 			fmt.Println(order)
 
+			loc, err := responseLocation(db, r, server, station)
+			if err != nil {
+				ErrorMessage(w, 400, fmt.Sprintf("tz: %v", err))
+				return
+			}
+
 			args := []interface{}{
 				server, station,
 			}
@@ -90,7 +113,7 @@ func StationHistoryRoute(db *sql.DB, r *mux.Router) {
 			before_query := ""
 			if err == nil {
 				before_query = `AND time <= ?`
-				args = append(args, before_t)
+				args = append(args, before_t.UTC())
 			} else {
 				if before != "" {
 					ErrorMessage(w, 400, fmt.Sprintf("before: %v", err))
@@ -103,7 +126,7 @@ func StationHistoryRoute(db *sql.DB, r *mux.Router) {
 			after_query := ""
 			if err == nil {
 				after_query = `AND time >= ?`
-				args = append(args, after_t)
+				args = append(args, after_t.UTC())
 			} else {
 				if after != "" {
 					ErrorMessage(w, 400, fmt.Sprintf("after: %v", err))
@@ -136,6 +159,12 @@ func StationHistoryRoute(db *sql.DB, r *mux.Router) {
 				return
 			}
 
+			if loc != nil {
+				for i := range entries {
+					entries[i].Time = entries[i].Time.In(loc)
+				}
+			}
+
 			w.Header().Set("Content-Type", "application/json")
 
 			data, _ := json.Marshal(entries)
@@ -169,45 +198,33 @@ func StationRapidUpdatesRoute(db *sql.DB, brokers map[string]stations.Broker, r
 				return
 			}
 
-			updates := make(chan types.WeatherMessage)
-			defer func() {
-				broker.UnsubscribeRapidWeatherUpdates(station, updates)
-				close(updates)
-			}()
-
-			err = broker.SubscribeRapidWeatherUpdates(station, updates)
+			updates, err := broker.SubscribeRapidWeatherUpdates(station)
 			if err != nil {
 				fmt.Printf("Could not start rapid weather updates: %v\n", err)
 				ErrorMessage(w, 500, "Could not start rapid weather updates")
 				return
 			}
+			defer broker.UnsubscribeRapidWeatherUpdates(station, updates)
 
-			w.Header().Set("Content-Type", "text/event-stream")
-			w.Header().Set("Cache-Control", "no-cache")
-			w.Header().Set("Connection", "keep-alive")
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.WriteHeader(200)
-			w.(http.Flusher).Flush()
+			stream := startEventStream(w)
+
+			heartbeat := time.NewTicker(heartbeatInterval)
+			defer heartbeat.Stop()
 
 			for {
 				select {
-				case message := <-updates:
-					for name, sensors := range message.Sensors {
-						for i, sensor := range sensors {
-							value, unit := util.SensorToImperial(sensor.Value, sensor.Unit, name)
-							sensors[i] = types.SensorValue{
-								Unit:  unit,
-								Value: value,
-							}
-						}
-					}
-					content, err := json.Marshal(message)
+				case message := <-updates.C:
+					// The message is shared with other subscribers, so the
+					// sensors are converted into a new map
+					message.Sensors = convertSensors(message.Sensors, UnitsImperial)
+					// Rapid weather isn't stored, so it can't be resumed and
+					// has no id
+					err := stream.Send(EventObservation, 0, message)
 					if err != nil {
-						fmt.Printf("Could not marshal message: %v\n", err)
-						break
+						fmt.Printf("Could not send message: %v\n", err)
 					}
-					w.Write([]byte(fmt.Sprintf("data: %v\n\n", string(content))))
-					w.(http.Flusher).Flush()
+				case <-heartbeat.C:
+					stream.Heartbeat()
 				case <-r.Context().Done():
 					return
 				}
@@ -215,18 +232,84 @@ func StationRapidUpdatesRoute(db *sql.DB, brokers map[string]stations.Broker, r
 		})
 }
 
-func StationUpdatesRoute(db *sql.DB, brokers map[string]stations.Broker, r *mux.Router) {
+// sendStationEntry sends an observation from a station along with the
+// lightning and alerts that came with it. They all share the entry's id so
+// that a reconnecting client resumes after all of them.
+func sendStationEntry(db *sql.DB, stream *eventStream, entry types.WeatherEntry, loc *time.Location) {
+	var strikes []types.LightningStrike
+	var err error
+	if lightning.HasLightning(entry.Sensors) {
+		strikes, err = database.QueryLightningStrikes(db, `WHERE
+				server.value = ? AND station.value = ? AND time = ?`,
+			entry.Server, entry.Station, entry.Time.UTC())
+		if err != nil {
+			fmt.Printf("Could not fetch lightning: %v\n", err)
+		}
+	}
+
+	events, err := database.QueryAlertEvents(db, `WHERE
+			server.value = ? AND station.value = ? AND time = ?
+		ORDER BY alert_event.id ASC`,
+		entry.Server, entry.Station, entry.Time.UTC())
+	if err != nil {
+		fmt.Printf("Could not fetch alerts: %v\n", err)
+	}
+
+	if err := deriveSensors(db, &entry); err != nil {
+		fmt.Printf("Could not derive sensors: %v\n", err)
+	}
+
+	message := types.WeatherMessage{
+		Time:    entry.Time,
+		ID:      entry.Station,
+		Sensors: entry.Sensors,
+	}
+	if loc != nil {
+		message.Time = message.Time.In(loc)
+	}
+	for name, sensors := range message.Sensors {
+		for i, sensor := range sensors {
+			value, unit := util.SensorToImperial(sensor.Value, sensor.Unit, name)
+			sensors[i] = types.SensorValue{
+				Unit:  unit,
+				Value: value,
+				Label: sensor.Label,
+			}
+		}
+	}
+
+	if err := stream.Send(EventObservation, entry.ID, message); err != nil {
+		fmt.Printf("Could not send message: %v\n", err)
+		return
+	}
+	for _, strike := range strikes {
+		if err := stream.Send(EventLightning, entry.ID, convertStrike(strike, loc)); err != nil {
+			fmt.Printf("Could not send lightning: %v\n", err)
+		}
+	}
+	for _, event := range events {
+		if loc != nil {
+			event.Time = event.Time.In(loc)
+		}
+		if err := stream.Send(EventAlert, entry.ID, event); err != nil {
+			fmt.Printf("Could not send alert: %v\n", err)
+		}
+	}
+}
+
+func StationUpdatesRoute(db *sql.DB, bus *events.Bus, r *mux.Router) {
 	r.HandleFunc("/station/{server}/{station}/conditions/updates/",
 		func(w http.ResponseWriter, r *http.Request) {
 			vars := mux.Vars(r)
 			server := vars["server"]
 			station := vars["station"]
+			key := types.StationKey{Server: server, Station: station}
 
 			w.Header().Set("Cache-Control", "no-cache")
 
-			broker, exists := brokers[server]
-			if !exists {
-				ErrorMessage(w, 404, "No station found")
+			loc, err := responseLocation(db, r, server, station)
+			if err != nil {
+				ErrorMessage(w, 400, fmt.Sprintf("tz: %v", err))
 				return
 			}
 
@@ -241,40 +324,70 @@ func StationUpdatesRoute(db *sql.DB, brokers map[string]stations.Broker, r *mux.
 				return
 			}
 
-			w.Header().Set("Content-Type", "text/event-stream")
-			w.Header().Set("Cache-Control", "no-cache")
-			w.Header().Set("Connection", "keep-alive")
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.WriteHeader(200)
-			w.(http.Flusher).Flush()
+			// Subscribe before replaying so that nothing is missed in between
+			updates := bus.SubscribeObservations(key, pubsub.DropOldest)
+			defer bus.UnsubscribeObservations(key, updates)
+			info_updates := bus.SubscribeStationInfo(key, pubsub.Coalesce)
+			defer bus.UnsubscribeStationInfo(key, info_updates)
+
+			stream := startEventStream(w)
+
+			last_id := int64(0)
+			sendEntry := func(entry types.WeatherEntry) {
+				if entry.ID != 0 && entry.ID <= last_id {
+					// The entry was already sent while replaying
+					return
+				}
+				sendStationEntry(db, stream, entry, loc)
+				last_id = entry.ID
+			}
+
+			sendInfo := func(info types.StationEntry) {
+				if loc != nil {
+					info.Updated = info.Updated.In(loc)
+				}
+				if err := stream.Send(EventStationInfo, 0, info); err != nil {
+					fmt.Printf("Could not send station info: %v\n", err)
+				}
+			}
 
-			updates := make(chan types.WeatherMessage)
-			defer func() {
-				broker.UnsubscribeWeatherUpdates(station, updates)
-				close(updates)
-			}()
+			if id, ok := lastEventId(r); ok {
+				info, exists, err := database.FetchStationInfo(db, server, station)
+				if err != nil {
+					fmt.Printf("Could not fetch station info: %v\n", err)
+				} else if exists {
+					sendInfo(info)
+				}
+				entries, err := database.FetchEntries(db, `WHERE server.value = ?
+						AND station.value = ?
+						AND weather_entry.id > ?
+						AND NOT weather_entry.backfilled
+					ORDER BY weather_entry.id ASC
+					LIMIT ?`,
+					server, station, id, maxReplay+1)
+				if err != nil {
+					fmt.Printf("Could not fetch entries: %v\n", err)
+				}
+				if len(entries) > maxReplay {
+					stream.Gap(id)
+					entries = nil
+				}
+				for _, entry := range entries {
+					sendEntry(entry)
+				}
+			}
 
-			broker.SubscribeWeatherUpdates(station, updates)
+			heartbeat := time.NewTicker(heartbeatInterval)
+			defer heartbeat.Stop()
 
 			for {
 				select {
-				case message := <-updates:
-					for name, sensors := range message.Sensors {
-						for i, sensor := range sensors {
-							value, unit := util.SensorToImperial(sensor.Value, sensor.Unit, name)
-							sensors[i] = types.SensorValue{
-								Unit:  unit,
-								Value: value,
-							}
-						}
-					}
-					content, err := json.Marshal(message)
-					if err != nil {
-						fmt.Printf("Could not marshal message: %v\n", err)
-						break
-					}
-					w.Write([]byte(fmt.Sprintf("data: %v\n\n", string(content))))
-					w.(http.Flusher).Flush()
+				case entry := <-updates.C:
+					sendEntry(entry)
+				case info := <-info_updates.C:
+					sendInfo(info)
+				case <-heartbeat.C:
+					stream.Heartbeat()
 				case <-r.Context().Done():
 					return
 				}
@@ -293,16 +406,23 @@ func StationInfoRoute(db *sql.DB, r *mux.Router) {
 
 			info, exists, err := database.FetchStationInfo(db, server, station)
 			if err != nil {
+				ErrorMessage(w, 500, "Could not fetch entries")
 				fmt.Printf("Could not fetch entries: %v\n", err)
+				return
 			}
 			if !exists {
 				ErrorMessage(w, 404, "No station found")
 				return
 			}
+
+			loc, err := responseLocation(db, r, server, station)
 			if err != nil {
-				ErrorMessage(w, 500, "Could not fetch entries")
+				ErrorMessage(w, 400, fmt.Sprintf("tz: %v", err))
 				return
 			}
+			if loc != nil {
+				info.Updated = info.Updated.In(loc)
+			}
 
 			data, err := json.Marshal(info)
 			if err != nil {
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/ttocsneb/weather/events"
+	"github.com/ttocsneb/weather/protocols"
+	"github.com/ttocsneb/weather/stations"
+	"github.com/ttocsneb/weather/types"
+)
+
+// Consoles that can only be pointed at a different host upload to the
+// standard path, so their stations are kept under this server
+const wundergroundServer = "wunderground"
+
+func ingestUpload(db *sql.DB, bus *events.Bus, w http.ResponseWriter, server string, message types.WeatherMessage, err error) bool {
+	if err != nil {
+		ErrorMessage(w, 400, err.Error())
+		return false
+	}
+	if message.ID == "" {
+		ErrorMessage(w, 400, "No station id was given")
+		return false
+	}
+
+	_, err = stations.Ingest(db, bus, server, stations.Normalize(message))
+	if stations.Rejected(err) {
+		ErrorMessage(w, 422, err.Error())
+		return false
+	}
+	if err != nil && !errors.Is(err, stations.ErrDuplicate) {
+		fmt.Printf("Unable to save message to db: %v\n", err)
+		ErrorMessage(w, 500, "Could not save message")
+		return false
+	}
+	fmt.Printf("Received upload for %v - %v\n", server, message.ID)
+	return true
+}
+
+// UploadRoute accepts the upload protocols of consumer consoles. Weather
+// Underground uploads are authenticated with a token as the PASSWORD, while
+// Ecowitt uploads are given the token in their path.
+func UploadRoute(db *sql.DB, bus *events.Bus, tokens map[string]string, r *mux.Router) {
+	wunderground := func(w http.ResponseWriter, r *http.Request) {
+		server, exists := mux.Vars(r)["server"]
+		if !exists {
+			server = wundergroundServer
+		}
+
+		q := r.URL.Query()
+		if _, ok := checkToken(tokens, q.Get("PASSWORD")); !ok {
+			unauthorized(w)
+			return
+		}
+
+		message, err := protocols.Wunderground(q)
+		if !ingestUpload(db, bus, w, server, message, err) {
+			return
+		}
+
+		// Consoles check for this response
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(200)
+		w.Write([]byte("success\n"))
+	}
+	r.HandleFunc("/weatherstation/updateweatherstation.php", wunderground).Methods("GET")
+	r.HandleFunc("/ingest/{server}/wunderground", wunderground).Methods("GET")
+
+	r.HandleFunc("/ingest/{server}/ecowitt/{token}",
+		func(w http.ResponseWriter, r *http.Request) {
+			server := mux.Vars(r)["server"]
+
+			if _, ok := authorize(w, r, tokens); !ok {
+				return
+			}
+
+			if err := r.ParseForm(); err != nil {
+				ErrorMessage(w, 400, fmt.Sprintf("Invalid form: %v", err))
+				return
+			}
+
+			message, err := protocols.Ecowitt(r.PostForm)
+			if !ingestUpload(db, bus, w, server, message, err) {
+				return
+			}
+
+			w.WriteHeader(200)
+		}).Methods("POST")
+}
@@ -0,0 +1,486 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/events"
+	"github.com/ttocsneb/weather/pubsub"
+	"github.com/ttocsneb/weather/types"
+	"github.com/ttocsneb/weather/util"
+)
+
+const (
+	// Time allowed to write a message to the client
+	wsWriteWait = 10 * time.Second
+	// Time allowed between pongs from the client
+	wsPongWait     = 60 * time.Second
+	wsPingInterval = wsPongWait * 9 / 10
+	// Control messages that may wait to be sent before the client is
+	// considered too slow and disconnected
+	wsControlQueue = 64
+	// The most subscriptions a connection may have
+	wsMaxSubscriptions = 100
+	// Every station of a subscription is subscribed to separately, so the
+	// stations of all of a connection's subscriptions are limited too
+	wsMaxStations = 250
+)
+
+const (
+	UnitsImperial = "imperial"
+	UnitsMetric   = "metric"
+)
+
+// Types of the subscriptions and messages over a websocket
+const (
+	wsStation  = "station"
+	wsLocation = "location"
+	wsRegion   = "region"
+
+	wsSubscribed   = "subscribed"
+	wsUnsubscribed = "unsubscribed"
+	wsError        = "error"
+)
+
+type wsRequest struct {
+	Action string `json:"action"`
+	// Chosen by the client to tell its subscriptions apart
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	Units string `json:"units"`
+
+	Server  string `json:"server"`
+	Station string `json:"station"`
+
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lon"`
+	Range     float64 `json:"range"`
+
+	Country  string `json:"country"`
+	Region   string `json:"region"`
+	City     string `json:"city"`
+	District string `json:"district"`
+}
+
+type wsMessage struct {
+	Type    string `json:"type"`
+	ID      string `json:"id,omitempty"`
+	Message string `json:"message,omitempty"`
+	Data    any    `json:"data,omitempty"`
+	// Observations that were replaced by this one because the client was
+	// reading too slowly
+	Dropped int `json:"dropped,omitempty"`
+}
+
+type wsSubscription struct {
+	id       string
+	units    string
+	stations int
+	done     chan interface{}
+	cleanup  func()
+}
+
+type wsConnection struct {
+	conn *websocket.Conn
+	db   *sql.DB
+	bus  *events.Bus
+
+	subscriptions map[string]*wsSubscription
+
+	lock sync.Mutex
+	// Only the latest observation of each subscription is kept while waiting
+	// to be sent, so a slow client skips observations rather than falling
+	// further and further behind
+	latest  map[string]wsMessage
+	order   []string
+	dropped map[string]int
+	wake    chan interface{}
+	control chan wsMessage
+	closed  chan interface{}
+	once    sync.Once
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// Like the SSE routes, any origin may connect
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// convertSensors converts sensors into a new map, leaving the original as is
+// since messages are shared between subscribers.
+func convertSensors(sensors map[string][]types.SensorValue, units string) map[string][]types.SensorValue {
+	converted := make(map[string][]types.SensorValue, len(sensors))
+	for name, values := range sensors {
+		converted[name] = make([]types.SensorValue, len(values))
+		for i, sensor := range values {
+			var value float64
+			var unit string
+			if units == UnitsMetric {
+				value, unit = util.SensorToMetric(sensor.Value, sensor.Unit, name)
+			} else {
+				value, unit = util.SensorToImperial(sensor.Value, sensor.Unit, name)
+			}
+			converted[name][i] = types.SensorValue{
+				Unit:  unit,
+				Value: value,
+				Label: sensor.Label,
+			}
+		}
+	}
+	return converted
+}
+
+func (self *wsConnection) close() {
+	self.once.Do(func() {
+		close(self.closed)
+		self.conn.Close()
+	})
+}
+
+// send queues a control message, disconnecting the client if it has stopped
+// reading.
+func (self *wsConnection) send(message wsMessage) {
+	select {
+	case self.control <- message:
+	case <-self.closed:
+	default:
+		fmt.Println("Websocket client is too slow, disconnecting")
+		self.close()
+	}
+}
+
+// publish queues an observation for a subscription, replacing any that hasn't
+// been sent yet.
+func (self *wsConnection) publish(id string, data any) {
+	self.lock.Lock()
+	if _, pending := self.latest[id]; pending {
+		self.dropped[id]++
+	} else {
+		self.order = append(self.order, id)
+	}
+	self.latest[id] = wsMessage{Type: EventObservation, ID: id, Data: data}
+	self.lock.Unlock()
+
+	select {
+	case self.wake <- true:
+	default:
+	}
+}
+
+func (self *wsConnection) write(message wsMessage) error {
+	self.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return self.conn.WriteJSON(message)
+}
+
+func (self *wsConnection) writer() {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	defer self.close()
+
+	for {
+		select {
+		case message := <-self.control:
+			if err := self.write(message); err != nil {
+				return
+			}
+		case <-self.wake:
+			self.lock.Lock()
+			messages := make([]wsMessage, 0, len(self.order))
+			for _, id := range self.order {
+				message := self.latest[id]
+				message.Dropped = self.dropped[id]
+				messages = append(messages, message)
+			}
+			self.latest = make(map[string]wsMessage)
+			self.dropped = make(map[string]int)
+			self.order = nil
+			self.lock.Unlock()
+
+			for _, message := range messages {
+				if err := self.write(message); err != nil {
+					return
+				}
+			}
+		case <-ping.C:
+			self.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := self.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-self.closed:
+			return
+		}
+	}
+}
+
+// resolveStations finds the stations of a subscription and how much each
+// contributes to the average.
+func (self *wsConnection) resolveStations(request wsRequest) ([]types.StationEntry, map[string]float64, error) {
+	weights := make(map[string]float64)
+
+	switch request.Type {
+	case wsStation:
+		info, exists, err := database.FetchStationInfo(self.db, request.Server, request.Station)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !exists {
+			return nil, nil, fmt.Errorf("No station found")
+		}
+		weights[info.MapId()] = 1
+		return []types.StationEntry{info}, weights, nil
+	case wsLocation:
+		dist := request.Range
+		if dist <= 0 {
+			dist = 15
+		}
+		stations, dists, err := findNearestStations(self.db, request.Latitude, request.Longitude, dist)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(stations) == 0 {
+			return nil, nil, fmt.Errorf("No stations found")
+		}
+		for i, weight := range findWeights(&dists) {
+			weights[stations[i].MapId()] = weight
+		}
+		return stations, weights, nil
+	case wsRegion:
+		if request.Country == "" || request.Region == "" || request.City == "" {
+			return nil, nil, fmt.Errorf("country, region and city are required")
+		}
+		stations, err := findRegionStations(self.db, request.District, request.City,
+			request.Region, request.Country)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(stations) == 0 {
+			return nil, nil, fmt.Errorf("Region not found")
+		}
+		for _, station := range stations {
+			weights[station.MapId()] = 1.0 / float64(len(stations))
+		}
+		return stations, weights, nil
+	}
+	return nil, nil, fmt.Errorf("Unknown subscription type %v", request.Type)
+}
+
+func (self *wsConnection) subscribe(request wsRequest) error {
+	if request.ID == "" {
+		return fmt.Errorf("id is required")
+	}
+	if _, exists := self.subscriptions[request.ID]; exists {
+		return fmt.Errorf("Already subscribed to %v", request.ID)
+	}
+	if len(self.subscriptions) >= wsMaxSubscriptions {
+		return fmt.Errorf("Too many subscriptions")
+	}
+	units := request.Units
+	if units == "" {
+		units = UnitsImperial
+	}
+	if units != UnitsImperial && units != UnitsMetric {
+		return fmt.Errorf("units must be %v or %v", UnitsImperial, UnitsMetric)
+	}
+
+	station_list, weights, err := self.resolveStations(request)
+	if err != nil {
+		return err
+	}
+	stations := len(station_list)
+	for _, other := range self.subscriptions {
+		stations += other.stations
+	}
+	if stations > wsMaxStations {
+		return fmt.Errorf("Too many stations, at most %v may be subscribed to at once",
+			wsMaxStations)
+	}
+	sub := &wsSubscription{
+		id:       request.ID,
+		units:    units,
+		stations: len(station_list),
+		done:     make(chan interface{}),
+	}
+
+	var lock sync.Mutex
+	conditions := make(map[string]types.WeatherEntry)
+
+	// Builds the observation of the subscription, which must be called with
+	// the lock held
+	observation := func(entry types.WeatherEntry) any {
+		if request.Type == wsStation {
+			message := types.WeatherMessage{
+				Time:    entry.Time,
+				ID:      entry.Station,
+				Sensors: convertSensors(entry.Sensors, units),
+			}
+			return message
+		}
+
+		entries := make([]types.WeatherEntry, 0, len(conditions))
+		for _, entry := range conditions {
+			entries = append(entries, entry)
+		}
+		values := averageConditions(entries, weights)
+		for name, sensor := range values {
+			converted := convertSensors(map[string][]types.SensorValue{name: {sensor}}, units)
+			values[name] = converted[name][0]
+		}
+		return values
+	}
+
+	// Derived sensors take several queries, so they are only added for a
+	// single station rather than to every station of an average
+	derive := func(entry *types.WeatherEntry) {
+		if request.Type != wsStation {
+			return
+		}
+		if err := deriveSensors(self.db, entry); err != nil {
+			fmt.Printf("Could not derive sensors: %v\n", err)
+		}
+	}
+
+	update := func(entry types.WeatherEntry) {
+		derive(&entry)
+		lock.Lock()
+		conditions[entry.MapId()] = entry
+		data := observation(entry)
+		lock.Unlock()
+		self.publish(sub.id, data)
+	}
+
+	// Only the latest observation of each station matters, so older ones
+	// are coalesced away when the connection falls behind
+	updates := make([]*events.ObservationSubscription, len(station_list))
+	for i, station := range station_list {
+		updates[i] = self.bus.SubscribeObservations(station.Key(), pubsub.Coalesce)
+		go func(updates *events.ObservationSubscription) {
+			for entry := range updates.C {
+				update(entry)
+			}
+		}(updates[i])
+	}
+	sub.cleanup = func() {
+		for i, station := range station_list {
+			self.bus.UnsubscribeObservations(station.Key(), updates[i])
+		}
+		close(sub.done)
+	}
+	self.subscriptions[sub.id] = sub
+
+	self.send(wsMessage{Type: wsSubscribed, ID: sub.id})
+
+	// Start the client off with the current conditions
+	entries, err := fetchConditions(self.db, station_list)
+	if err != nil {
+		fmt.Printf("Unable to fetch weather entries: %v\n", err)
+		return nil
+	}
+	if len(entries) > 0 {
+		for i := range entries {
+			derive(&entries[i])
+		}
+		lock.Lock()
+		for _, entry := range entries {
+			conditions[entry.MapId()] = entry
+		}
+		data := observation(entries[0])
+		lock.Unlock()
+		self.publish(sub.id, data)
+	}
+
+	return nil
+}
+
+func (self *wsConnection) unsubscribe(id string) error {
+	sub, exists := self.subscriptions[id]
+	if !exists {
+		return fmt.Errorf("Not subscribed to %v", id)
+	}
+	sub.cleanup()
+	delete(self.subscriptions, id)
+
+	self.lock.Lock()
+	delete(self.latest, id)
+	delete(self.dropped, id)
+	for i, pending := range self.order {
+		if pending == id {
+			self.order = append(self.order[:i], self.order[i+1:]...)
+			break
+		}
+	}
+	self.lock.Unlock()
+
+	self.send(wsMessage{Type: wsUnsubscribed, ID: id})
+	return nil
+}
+
+func WebSocketRoute(db *sql.DB, bus *events.Bus, r *mux.Router) {
+	r.HandleFunc("/ws",
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				fmt.Printf("Could not upgrade websocket: %v\n", err)
+				return
+			}
+
+			self := &wsConnection{
+				conn:          conn,
+				db:            db,
+				bus:           bus,
+				subscriptions: make(map[string]*wsSubscription),
+				latest:        make(map[string]wsMessage),
+				dropped:       make(map[string]int),
+				wake:          make(chan interface{}, 1),
+				control:       make(chan wsMessage, wsControlQueue),
+				closed:        make(chan interface{}),
+			}
+			defer func() {
+				for _, sub := range self.subscriptions {
+					sub.cleanup()
+				}
+				self.close()
+			}()
+
+			go self.writer()
+
+			conn.SetReadLimit(4096)
+			conn.SetReadDeadline(time.Now().Add(wsPongWait))
+			conn.SetPongHandler(func(string) error {
+				conn.SetReadDeadline(time.Now().Add(wsPongWait))
+				return nil
+			})
+
+			for {
+				var request wsRequest
+				if err := conn.ReadJSON(&request); err != nil {
+					if _, ok := err.(*websocket.CloseError); !ok {
+						select {
+						case <-self.closed:
+						default:
+							fmt.Printf("Could not read websocket: %v\n", err)
+						}
+					}
+					return
+				}
+
+				switch request.Action {
+				case "subscribe":
+					err = self.subscribe(request)
+				case "unsubscribe":
+					err = self.unsubscribe(request.ID)
+				default:
+					err = fmt.Errorf("Unknown action %v", request.Action)
+				}
+				if err != nil {
+					self.send(wsMessage{Type: wsError, ID: request.ID, Message: err.Error()})
+				}
+			}
+		})
+}
@@ -1,33 +1,44 @@
 package stations
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/ttocsneb/weather/config"
 	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/events"
+	"github.com/ttocsneb/weather/pubsub"
 	"github.com/ttocsneb/weather/types"
-	"github.com/ttocsneb/weather/util"
 )
 
+// ChanMux keeps a station sending rapid-weather updates for as long as anyone
+// is subscribed to them.
 type ChanMux struct {
-	updates []chan types.WeatherMessage
-	done    chan interface{}
+	subscription string
+	request      string
+	payload      []byte
+	done         chan interface{}
 }
 
-func newChanMux(broker *Broker, station string, listener chan types.WeatherMessage, on_done func(*ChanMux)) (*ChanMux, error) {
+func newChanMux(broker *Broker, station string) (*ChanMux, error) {
 	self := new(ChanMux)
-	self.updates = []chan types.WeatherMessage{listener}
 	self.done = make(chan interface{})
 
 	fmt.Println("Creating rapid-weather listener")
 
-	subscription := fmt.Sprintf("/station/rapid-weather/%v", station)
-	request := fmt.Sprintf("/station/request/%v", station)
+	self.subscription = broker.topics.RapidWeather.Format(station)
+	self.request = broker.topics.Request.Format(station)
+	self.payload = broker.requestPayload(station, "rapid-weather")
+	qos := broker.conf.QoS
 
-	err := WaitOrErr(broker.Client.Subscribe(subscription, 1, func(client mqtt.Client, msg mqtt.Message) {
+	err := broker.Subscribe(self.subscription, qos.RapidWeather, func(client mqtt.Client, msg mqtt.Message) {
 		var payload types.WeatherMessage
 		err := json.Unmarshal(msg.Payload(), &payload)
 		if err != nil {
@@ -35,37 +46,15 @@ func newChanMux(broker *Broker, station string, listener chan types.WeatherMessa
 			return
 		}
 
-		message := types.WeatherMessage{
-			Time:    payload.Time,
-			ID:      payload.ID,
-			Sensors: make(map[string][]types.SensorValue),
-		}
-
-		for sensor, values := range payload.Sensors {
-			message.Sensors[sensor] = make([]types.SensorValue, len(values))
-			for i, value := range values {
-				val, unit := util.SensorToMetric(value.Value, value.Unit, sensor)
-				message.Sensors[sensor][i] = types.SensorValue{
-					Unit:  unit,
-					Value: val,
-				}
-			}
-		}
-
-		for _, ch := range self.updates {
-			ch <- message
-		}
-	}))
+		broker.rapidUpdates.Publish(station, Normalize(payload))
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	payload, err := json.Marshal(types.RequestMessage{Action: "rapid-weather"})
-	if err != nil {
-		return nil, err
-	}
-	err = WaitOrErr(broker.Client.Publish(request, 1, false, payload))
+	err = self.sendRequest(broker)
 	if err != nil {
+		broker.Unsubscribe(self.subscription)
 		return nil, err
 	}
 	keepAlive := func() {
@@ -73,20 +62,15 @@ func newChanMux(broker *Broker, station string, listener chan types.WeatherMessa
 		for true {
 			select {
 			case <-self.done:
-				err := WaitOrErr(broker.Client.Unsubscribe(subscription))
-				if err != nil {
-					fmt.Printf("Could not Unsubscribe from rapid-weather updates: %v\n", err)
-				}
-				fmt.Println("Closing rapid-weather listener")
-				on_done(self)
 				return
 			case <-timeout:
-				err := WaitOrErr(broker.Client.Publish(request, 1, false, payload))
+				// Keep trying after a failure, as the broker may only be
+				// reconnecting
+				timeout = time.After(time.Second * 50)
+				err := self.sendRequest(broker)
 				if err != nil {
 					fmt.Printf("Could not send rapid-weather request: %v\n", err)
-					break
 				}
-				timeout = time.After(time.Second * 50)
 			}
 		}
 	}
@@ -96,31 +80,58 @@ func newChanMux(broker *Broker, station string, listener chan types.WeatherMessa
 	return self, nil
 }
 
-func (self *ChanMux) addListener(listener chan types.WeatherMessage) {
-	self.updates = append(self.updates, listener)
-	fmt.Printf("There are %v listeners", len(self.updates))
+// sendRequest asks the station to send rapid-weather updates for a while.
+func (self *ChanMux) sendRequest(broker *Broker) error {
+	return WaitOrErr(broker.Client.Publish(self.request, broker.conf.QoS.Request, false, self.payload))
 }
 
-func (self *ChanMux) delListener(listener chan types.WeatherMessage) bool {
-	for i, l := range self.updates {
-		if l == listener {
-			self.updates = append(self.updates[:i], self.updates[i+1:]...)
-			if len(self.updates) == 0 {
-				self.done <- true
-			}
-			return true
-		}
+func (self *ChanMux) close(broker *Broker) {
+	close(self.done)
+	err := broker.Unsubscribe(self.subscription)
+	if err != nil {
+		fmt.Printf("Could not Unsubscribe from rapid-weather updates: %v\n", err)
 	}
-	return false
+	fmt.Println("Closing rapid-weather listener")
 }
 
+// The number of messages buffered for each subscriber before the subscription
+// policy kicks in
+const updateBuffer = 16
+
+type WeatherSubscription = pubsub.Subscription[types.WeatherMessage]
+
 type Broker struct {
-	Client         mqtt.Client
-	Broker         string
-	db             *sql.DB
-	rapidUpdates   map[string]*ChanMux
-	stationUpdates map[string][]chan types.WeatherMessage
-	updates        []chan types.WeatherMessage
+	Client mqtt.Client
+	Broker string
+	db     *sql.DB
+	// Guards rapidMux, as rapid-weather subscriptions come and go
+	rapidLock    *sync.Mutex
+	rapidMux     map[string]*ChanMux
+	rapidUpdates *pubsub.Hub[string, types.WeatherMessage]
+	bus          *events.Bus
+	conf         config.BrokerConfig
+	topics       Topics
+	conn         *connection
+}
+
+// Subscribe subscribes to a topic, which is resubscribed to whenever the
+// broker reconnects.
+func (self *Broker) Subscribe(topic string, qos byte, handler mqtt.MessageHandler) error {
+	return self.conn.subscribe(self.Client, topic, qos, handler)
+}
+
+func (self *Broker) Unsubscribe(topic string) error {
+	return self.conn.unsubscribe(self.Client, topic)
+}
+
+func (self *Broker) State() BrokerState {
+	return self.conn.State()
+}
+
+func (self *Broker) requestPayload(station string, action string) []byte {
+	payload := strings.ReplaceAll(self.conf.RequestPayload, "{action}", action)
+	payload = strings.ReplaceAll(payload, stationPlaceholder, station)
+	return []byte(payload)
 }
 
 func WaitOrErr(fut mqtt.Token) error {
@@ -135,188 +146,260 @@ func (self *Broker) WeatherListener() mqtt.MessageHandler {
 			fmt.Printf("Unable to parse message: %v\n", err)
 			return
 		}
-
-		message := types.WeatherMessage{
-			Time:    payload.Time,
-			ID:      payload.ID,
-			Sensors: make(map[string][]types.SensorValue),
+		// The topic is trusted over the payload to say which station sent it
+		if station, ok := self.topics.Weather.Station(msg.Topic()); ok {
+			payload.ID = station
+		}
+		if payload.ID == "" {
+			fmt.Printf("Unable to find the station of %v\n", msg.Topic())
+			return
 		}
 
-		for sensor, values := range payload.Sensors {
-			message.Sensors[sensor] = make([]types.SensorValue, len(values))
-			for i, value := range values {
-				val, unit := util.SensorToMetric(value.Value, value.Unit, sensor)
-				message.Sensors[sensor][i] = types.SensorValue{
-					Unit:  unit,
-					Value: val,
-				}
+		// The callback returns once the message is queued, and the rest
+		// happens once it has been written
+		IngestAsync(self.db, self.bus, self.Broker, Normalize(payload), func(_ types.WeatherEntry, err error) {
+			if errors.Is(err, ErrDuplicate) {
+				fmt.Printf("Ignored duplicate message from %v\n", self.Broker)
+				return
 			}
-		}
+			if err != nil {
+				fmt.Printf("Unable to save message to db: %v\n", err)
+				return
+			}
+			fmt.Printf("Received Message from %v\n", self.Broker)
 
-		hooks, exists := self.stationUpdates[payload.ID]
-		if exists {
-			for _, hook := range hooks {
-				hook <- message
+			t, exists, err := database.LastStationInfoUpdate(self.db, self.Broker, payload.ID)
+			if err != nil {
+				fmt.Printf("Unable to check station from db: %v\n", err)
+				return
 			}
-		}
+			if !exists || time.Now().Sub(t) > time.Hour*24 {
+				entry, err := self.FetchStationInfo(payload.ID)
+				if err != nil {
+					fmt.Printf("Unable to fetch station info: %v\n", err)
+					return
+				}
+				fmt.Printf("Fetched station info for %v - %v\n", entry.Server, entry.Station)
+			}
+		})
+	}
+}
 
-		_, err := database.InsertWeatherEntry(self.db, message.ToEntry(self.Broker))
-		if err != nil {
-			fmt.Printf("Unable to save message to db: %v\n", err)
-			return
+// BackfillListener stores batches of messages that stations buffered while
+// they were offline. A batch may either be an array of messages or a single
+// message.
+func (self *Broker) BackfillListener() mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		payload := bytes.TrimSpace(msg.Payload())
+		var messages []types.WeatherMessage
+		var err error
+		if len(payload) > 0 && payload[0] == '[' {
+			err = json.Unmarshal(payload, &messages)
+		} else {
+			var message types.WeatherMessage
+			err = json.Unmarshal(payload, &message)
+			messages = []types.WeatherMessage{message}
 		}
-		fmt.Printf("Received Message from %v\n", self.Broker)
-
-		t, exists, err := database.LastStationInfoUpdate(self.db, self.Broker, payload.ID)
 		if err != nil {
-			fmt.Printf("Unable to check station from db: %v\n", err)
+			fmt.Printf("Unable to parse backfill: %v\n", err)
 			return
 		}
-		if !exists || time.Now().Sub(t) > time.Hour*24 {
-			entry, err := self.FetchStationInfo(payload.ID)
-			if err != nil {
-				fmt.Printf("Unable to fetch station info: %v\n", err)
+
+		station, from_topic := self.topics.Backfill.Station(msg.Topic())
+		for i := range messages {
+			if from_topic {
+				messages[i].ID = station
+			}
+			if messages[i].ID == "" {
+				fmt.Printf("Unable to find the station of %v\n", msg.Topic())
+				return
+			}
+			if messages[i].Time.IsZero() {
+				fmt.Printf("Backfill from %v has messages without a time\n", msg.Topic())
 				return
 			}
-			fmt.Printf("Fetched station info for %v - %v\n", entry.Server, entry.Station)
+			messages[i] = Normalize(messages[i])
 		}
 
+		BackfillAsync(self.db, self.Broker, messages, func(result BackfillResult, err error) {
+			if err != nil {
+				fmt.Printf("Unable to save backfill to db: %v\n", err)
+				return
+			}
+			fmt.Printf("Received backfill of %v messages from %v (%v duplicates, %v rejected)\n",
+				len(messages), self.Broker, result.Duplicates, len(result.Rejected))
+		})
 	}
 }
 
+// How long to wait for a station to respond with its info
+const infoTimeout = time.Second * 30
+
 func (self *Broker) FetchStationInfo(station string) (types.StationEntry, error) {
 	type message struct {
 		msg types.StationMessage
 		err error
 	}
-	on_recv := make(chan message)
-	subscription := fmt.Sprintf("/station/info/%v", station)
-	request := fmt.Sprintf("/station/request/%v", station)
-	err := WaitOrErr(self.Client.Subscribe(subscription, 1, func(client mqtt.Client, msg mqtt.Message) {
+	on_recv := make(chan message, 1)
+	subscription := self.topics.Info.Format(station)
+	request := self.topics.Request.Format(station)
+	err := self.Subscribe(subscription, self.conf.QoS.Info, func(client mqtt.Client, msg mqtt.Message) {
 		var payload types.StationMessage
 		err := json.Unmarshal(msg.Payload(), &payload)
-		on_recv <- message{
-			msg: payload,
-			err: err,
+		select {
+		case on_recv <- message{msg: payload, err: err}:
+		default:
 		}
-	}))
+	})
 	if err != nil {
 		return types.StationEntry{}, err
 	}
+	defer func() {
+		if err := self.Unsubscribe(subscription); err != nil {
+			fmt.Printf("Could not Unsubscribe from station info: %v\n", err)
+		}
+	}()
+
 	time.Sleep(time.Millisecond * 250)
-	payload, err := json.Marshal(types.RequestMessage{Action: "info"})
+	payload := self.requestPayload(station, "info")
+	err = WaitOrErr(self.Client.Publish(request, self.conf.QoS.Request, false, payload))
 	if err != nil {
 		return types.StationEntry{}, err
 	}
-	err = WaitOrErr(self.Client.Publish(request, 1, false, payload))
-	if err != nil {
-		return types.StationEntry{}, err
+
+	var recv message
+	select {
+	case recv = <-on_recv:
+	case <-time.After(infoTimeout):
+		return types.StationEntry{}, fmt.Errorf("%v did not respond with its info", station)
 	}
-	recv := <-on_recv
 	if recv.err != nil {
-		return types.StationEntry{}, err
-	}
-	info := recv.msg.ToEntry(self.Broker, station, time.Now())
-	err = database.UpdateStationInfo(self.db, info)
-	wait_err := WaitOrErr(self.Client.Unsubscribe(subscription))
-	if wait_err != nil {
-		return types.StationEntry{}, err
+		return types.StationEntry{}, recv.err
 	}
-	if err != nil {
-		return types.StationEntry{}, err
-	}
-	return info, nil
+	return IngestStationInfo(self.db, self.bus, self.Broker, station, recv.msg)
 }
 
-func (self *Broker) SubscribeRapidWeatherUpdates(station string, weather chan types.WeatherMessage) error {
-	mux, exists := self.rapidUpdates[station]
-	if !exists {
-		mux, err := newChanMux(self, station, weather, func(cm *ChanMux) {
-			delete(self.rapidUpdates, station)
-		})
+func (self *Broker) SubscribeRapidWeatherUpdates(station string) (*WeatherSubscription, error) {
+	self.rapidLock.Lock()
+	defer self.rapidLock.Unlock()
+
+	sub := self.rapidUpdates.Subscribe(station, updateBuffer, pubsub.DropOldest)
+	if _, exists := self.rapidMux[station]; !exists {
+		mux, err := newChanMux(self, station)
 		if err != nil {
-			return err
+			self.rapidUpdates.Unsubscribe(station, sub)
+			return nil, err
 		}
-		self.rapidUpdates[station] = mux
-		return nil
+		self.rapidMux[station] = mux
 	}
-	mux.addListener(weather)
+	fmt.Printf("There are %v rapid-weather listeners\n", self.rapidUpdates.Subscribers(station))
 
-	return nil
-}
-func (self *Broker) UnsubscribeRapidWeatherUpdates(station string, weather chan types.WeatherMessage) bool {
-	mux, exists := self.rapidUpdates[station]
-	if !exists {
-		return false
-	}
-	return mux.delListener(weather)
+	return sub, nil
 }
 
-func (self *Broker) SubscribeWeatherUpdates(station string, weather chan types.WeatherMessage) {
-	list, exists := self.stationUpdates[station]
-	if !exists {
-		list = []chan types.WeatherMessage{}
+// resendRapidWeather asks the stations with rapid-weather listeners to keep
+// sending updates, as they may have stopped while the broker was unreachable.
+func (self *Broker) resendRapidWeather() {
+	self.rapidLock.Lock()
+	muxes := make([]*ChanMux, 0, len(self.rapidMux))
+	for _, mux := range self.rapidMux {
+		muxes = append(muxes, mux)
 	}
+	self.rapidLock.Unlock()
 
-	list = append(list, weather)
-	self.stationUpdates[station] = list
+	for _, mux := range muxes {
+		if err := mux.sendRequest(self); err != nil {
+			fmt.Printf("Could not send rapid-weather request: %v\n", err)
+		}
+	}
 }
-func (self *Broker) UnsubscribeWeatherUpdates(station string, weather chan types.WeatherMessage) bool {
-	list, exists := self.stationUpdates[station]
-	if !exists {
+
+func (self *Broker) UnsubscribeRapidWeatherUpdates(station string, sub *WeatherSubscription) bool {
+	self.rapidLock.Lock()
+	defer self.rapidLock.Unlock()
+
+	if !self.rapidUpdates.Unsubscribe(station, sub) {
 		return false
 	}
-	for i, val := range list {
-		if val == weather {
-			list = append(list[:i], list[i+1:]...)
-			if len(list) == 0 {
-				delete(self.stationUpdates, station)
-			} else {
-				self.stationUpdates[station] = list
-			}
-			return true
-		}
+	mux, exists := self.rapidMux[station]
+	if exists && self.rapidUpdates.Subscribers(station) == 0 {
+		delete(self.rapidMux, station)
+		mux.close(self)
 	}
-	return false
+	return true
 }
 
-func (self *Broker) SubscribeAllWeatherUpdates(weather chan types.WeatherMessage) {
-	self.updates = append(self.updates, weather)
-}
-func (self *Broker) UnsubscribeAllWeatherUpdates(weather chan types.WeatherMessage) bool {
-	for i, val := range self.updates {
-		if val == weather {
-			self.updates = append(self.updates[:i], self.updates[i+1:]...)
-			return true
-		}
+func NewBroker(db *sql.DB, bus *events.Bus, id string, broker string, conf config.BrokerConfig) (Broker, error) {
+	topics, err := ParseTopics(conf)
+	if err != nil {
+		return Broker{}, err
 	}
-	return false
-}
 
-func NewBroker(db *sql.DB, id string, broker string, server string) (Broker, error) {
+	tls_config, err := tlsConfig(conf.TLS)
+	if err != nil {
+		return Broker{}, err
+	}
+	conn := newConnection(broker, conf.URL, id)
+
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(server)
+	opts.AddBroker(conf.URL)
 	opts.SetClientID(id)
 	opts.SetOrderMatters(false)
-	client := mqtt.NewClient(opts)
-
-	if err := WaitOrErr(client.Connect()); err != nil {
-		return Broker{}, err
+	opts.SetUsername(conf.Username)
+	opts.SetPassword(conf.Password)
+	if tls_config != nil {
+		opts.SetTLSConfig(tls_config)
 	}
+	opts.SetCleanSession(conf.CleanSession)
+	opts.SetKeepAlive(conf.KeepAlive)
+	opts.SetConnectTimeout(conf.ConnectTimeout)
+	opts.SetMaxReconnectInterval(conf.MaxReconnectInterval)
+	// Keep trying to connect rather than giving up if the broker is down, and
+	// restore every subscription once it's back
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(time.Second * 10)
+	opts.SetOnConnectHandler(conn.onConnect)
+	opts.SetConnectionLostHandler(conn.onConnectionLost)
+	client := mqtt.NewClient(opts)
 
 	self := Broker{
-		Client:         client,
-		Broker:         broker,
-		db:             db,
-		rapidUpdates:   make(map[string]*ChanMux),
-		stationUpdates: make(map[string][]chan types.WeatherMessage),
-		updates:        []chan types.WeatherMessage{},
+		Client:       client,
+		Broker:       broker,
+		db:           db,
+		rapidLock:    new(sync.Mutex),
+		rapidMux:     make(map[string]*ChanMux),
+		rapidUpdates: pubsub.NewHub[string, types.WeatherMessage]("rapid-weather/" + broker),
+		bus:          bus,
+		conf:         conf,
+		topics:       topics,
+		conn:         conn,
 	}
 
-	if err := WaitOrErr(client.Subscribe("/station/weather/+", 0,
-		self.WeatherListener())); err != nil {
+	err = self.Subscribe(topics.WeatherSubscription(), conf.QoS.Weather, self.WeatherListener())
+	if err != nil {
 		return Broker{}, err
 	}
+	if topics.Backfill != nil {
+		err = self.Subscribe(topics.BackfillSubscription(), conf.QoS.Backfill, self.BackfillListener())
+		if err != nil {
+			return Broker{}, err
+		}
+	}
+
+	conn.connected = func(client mqtt.Client) {
+		self.resendRapidWeather()
+	}
+
+	// The connection is made in the background, as it is retried until the
+	// broker is available
+	token := client.Connect()
+	go func() {
+		if err := WaitOrErr(token); err != nil {
+			fmt.Printf("Could not connect to %v: %v\n", broker, err)
+			conn.setError(err)
+		}
+	}()
 
 	return self, nil
 }
@@ -0,0 +1,183 @@
+package stations
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/ttocsneb/weather/config"
+)
+
+// ClientId fills in the template of a broker's client id.
+func ClientId(template string, id string, instance string, broker string) string {
+	return strings.NewReplacer(
+		"{id}", id,
+		"{instance}", instance,
+		"{broker}", broker,
+	).Replace(template)
+}
+
+type subscription struct {
+	qos     byte
+	handler mqtt.MessageHandler
+}
+
+// BrokerState describes the connection to a broker.
+type BrokerState struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	ClientId  string `json:"clientId"`
+	Connected bool   `json:"connected"`
+	// When the broker last connected or disconnected
+	Since      *time.Time `json:"since"`
+	Reconnects int        `json:"reconnects"`
+	LastError  string     `json:"lastError,omitempty"`
+	Topics     []string   `json:"topics"`
+}
+
+// connection keeps track of a broker's subscriptions so that they can be
+// restored whenever the client reconnects.
+type connection struct {
+	lock          sync.Mutex
+	subscriptions map[string]subscription
+	state         BrokerState
+	connects      int
+	// Called once the subscriptions have been restored after connecting
+	connected func(client mqtt.Client)
+}
+
+func newConnection(name string, broker string, id string) *connection {
+	// Don't give away any credentials in the url
+	if parsed, err := url.Parse(broker); err == nil && parsed.User != nil {
+		parsed.User = nil
+		broker = parsed.String()
+	}
+	return &connection{
+		subscriptions: make(map[string]subscription),
+		state: BrokerState{
+			Name:     name,
+			URL:      broker,
+			ClientId: id,
+		},
+	}
+}
+
+func (self *connection) onConnect(client mqtt.Client) {
+	self.lock.Lock()
+	now := time.Now()
+	self.state.Connected = true
+	self.state.Since = &now
+	if self.connects > 0 {
+		self.state.Reconnects++
+	}
+	self.connects++
+	subscriptions := make(map[string]subscription, len(self.subscriptions))
+	for topic, sub := range self.subscriptions {
+		subscriptions[topic] = sub
+	}
+	self.lock.Unlock()
+
+	fmt.Printf("Connected to %v, subscribing to %v topics\n", self.state.Name, len(subscriptions))
+	for topic, sub := range subscriptions {
+		if err := WaitOrErr(client.Subscribe(topic, sub.qos, sub.handler)); err != nil {
+			fmt.Printf("Could not resubscribe to %v: %v\n", topic, err)
+			self.setError(err)
+		}
+	}
+	if self.connected != nil {
+		self.connected(client)
+	}
+}
+
+func (self *connection) onConnectionLost(client mqtt.Client, err error) {
+	fmt.Printf("Lost connection to %v: %v\n", self.state.Name, err)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := time.Now()
+	self.state.Connected = false
+	self.state.Since = &now
+	self.state.LastError = err.Error()
+}
+
+func (self *connection) setError(err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.state.LastError = err.Error()
+}
+
+// Subscribe subscribes to a topic now if the client is connected, and again
+// whenever it reconnects.
+func (self *connection) subscribe(client mqtt.Client, topic string, qos byte, handler mqtt.MessageHandler) error {
+	self.lock.Lock()
+	self.subscriptions[topic] = subscription{qos: qos, handler: handler}
+	self.lock.Unlock()
+
+	if !client.IsConnectionOpen() {
+		return nil
+	}
+	return WaitOrErr(client.Subscribe(topic, qos, handler))
+}
+
+func (self *connection) unsubscribe(client mqtt.Client, topic string) error {
+	self.lock.Lock()
+	delete(self.subscriptions, topic)
+	self.lock.Unlock()
+
+	if !client.IsConnectionOpen() {
+		return nil
+	}
+	return WaitOrErr(client.Unsubscribe(topic))
+}
+
+func (self *connection) State() BrokerState {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	state := self.state
+	state.Topics = make([]string, 0, len(self.subscriptions))
+	for topic := range self.subscriptions {
+		state.Topics = append(state.Topics, topic)
+	}
+	sort.Strings(state.Topics)
+	return state
+}
+
+func tlsConfig(conf config.TLSConfig) (*tls.Config, error) {
+	if conf == (config.TLSConfig{}) {
+		return nil, nil
+	}
+
+	self := &tls.Config{
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+	}
+	if conf.CA != "" {
+		pem, err := os.ReadFile(conf.CA)
+		if err != nil {
+			return nil, err
+		}
+		self.RootCAs = x509.NewCertPool()
+		if !self.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %v", conf.CA)
+		}
+	}
+	if conf.Cert != "" || conf.Key != "" {
+		if conf.Cert == "" || conf.Key == "" {
+			return nil, errors.New("Both a client certificate and key are needed")
+		}
+		cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, err
+		}
+		self.Certificates = []tls.Certificate{cert}
+	}
+	return self, nil
+}
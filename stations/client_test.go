@@ -0,0 +1,17 @@
+package stations
+
+import "testing"
+
+func TestClientId(t *testing.T) {
+	tests := map[string]string{
+		"{id}-{instance}-{broker}": "weather-host1-home",
+		"fixed":                    "fixed",
+		"{broker}/{broker}":        "home/home",
+		"{id}-{unknown}":           "weather-{unknown}",
+	}
+	for template, want := range tests {
+		if id := ClientId(template, "weather", "host1", "home"); id != want {
+			t.Errorf("%v: got %v, want %v", template, id, want)
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package stations
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ttocsneb/weather/alerts"
+	"github.com/ttocsneb/weather/config"
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/events"
+	"github.com/ttocsneb/weather/lightning"
+	"github.com/ttocsneb/weather/rain"
+	"github.com/ttocsneb/weather/types"
+	"github.com/ttocsneb/weather/tz"
+	"github.com/ttocsneb/weather/util"
+)
+
+// Normalize converts the sensors of a message to metric.
+func Normalize(payload types.WeatherMessage) types.WeatherMessage {
+	message := types.WeatherMessage{
+		Time:    payload.Time,
+		ID:      payload.ID,
+		Sensors: make(map[string][]types.SensorValue),
+	}
+
+	for sensor, values := range payload.Sensors {
+		message.Sensors[sensor] = make([]types.SensorValue, len(values))
+		for i, value := range values {
+			val, unit := util.SensorToMetric(value.Value, value.Unit, sensor)
+			message.Sensors[sensor][i] = types.SensorValue{
+				Unit:  unit,
+				Value: val,
+			}
+		}
+	}
+
+	return message
+}
+
+var (
+	// ErrDuplicate is returned along with the stored entry when a station
+	// already has an entry at the same time, which the message is merged into.
+	ErrDuplicate  = errors.New("The station already has an entry at this time")
+	ErrFuture     = errors.New("The message is too far in the future")
+	ErrOutOfOrder = errors.New("The message is older than the station's latest")
+)
+
+// Rejected checks if a message was refused because of its time.
+func Rejected(err error) bool {
+	return errors.Is(err, ErrFuture) || errors.Is(err, ErrOutOfOrder)
+}
+
+// IngestStats counts what happened to the messages that were ingested.
+type IngestStats struct {
+	Accepted   uint64 `json:"accepted"`
+	Duplicates uint64 `json:"duplicates"`
+	Rejected   uint64 `json:"rejected"`
+	// Messages that were too far in the future, which are either rejected or
+	// clamped
+	Future  uint64 `json:"future"`
+	Clamped uint64 `json:"clamped"`
+	// Messages older than their station's latest
+	OutOfOrder uint64 `json:"outOfOrder"`
+	// Messages that were stored from backfills
+	Backfilled uint64 `json:"backfilled"`
+}
+
+// An Exporter is given the entries that have been stored, including ones
+// that were merged into an existing entry. Export must not block.
+type Exporter interface {
+	Export(entries []types.WeatherEntry)
+}
+
+var ingest = struct {
+	lock  sync.Mutex
+	conf  config.IngestConfig
+	stats IngestStats
+	// Entries are written directly when there isn't a writer
+	writer   *database.Writer
+	exporter Exporter
+	// The time of each station's latest entry
+	latest map[types.StationKey]time.Time
+}{
+	latest: make(map[types.StationKey]time.Time),
+}
+
+// ConfigureIngest sets how messages with unexpected times are handled, the
+// writer that entries are batched by, and the exporter that stored entries
+// are given to if there is one.
+func ConfigureIngest(conf config.IngestConfig, writer *database.Writer, exporter Exporter) error {
+	switch conf.Future {
+	case "reject", "clamp":
+	default:
+		return fmt.Errorf("Unknown future policy %v", conf.Future)
+	}
+	switch conf.OutOfOrder {
+	case "accept", "store", "reject":
+	default:
+		return fmt.Errorf("Unknown out of order policy %v", conf.OutOfOrder)
+	}
+
+	ingest.lock.Lock()
+	defer ingest.lock.Unlock()
+	ingest.conf = conf
+	ingest.writer = writer
+	ingest.exporter = exporter
+	return nil
+}
+
+// WriterStats describes the writer that entries are batched by, if there is
+// one.
+func WriterStats() (database.WriterStats, bool) {
+	ingest.lock.Lock()
+	writer := ingest.writer
+	ingest.lock.Unlock()
+	if writer == nil {
+		return database.WriterStats{}, false
+	}
+	return writer.Stats(), true
+}
+
+// storeEntries writes entries with the writer if there is one, giving the
+// result to done from a goroutine of its own once they have been written.
+func storeEntries(db *sql.DB, writer *database.Writer, entries []types.WeatherEntry, backfilled bool, done func(ids []int64, created []bool, err error)) {
+	if writer != nil {
+		writer.Enqueue(entries, backfilled, func(ids []int64, created []bool, err error) {
+			go done(ids, created, err)
+		})
+		return
+	}
+	if backfilled {
+		ids, created, err := database.InsertBackfill(db, entries)
+		done(ids, created, err)
+		return
+	}
+	id, created, err := database.InsertWeatherEntry(db, entries[0])
+	done([]int64{id}, []bool{created}, err)
+}
+
+func Stats() IngestStats {
+	ingest.lock.Lock()
+	defer ingest.lock.Unlock()
+	return ingest.stats
+}
+
+func count(counter *uint64) {
+	ingest.lock.Lock()
+	defer ingest.lock.Unlock()
+	*counter++
+}
+
+func latestTime(db *sql.DB, key types.StationKey) (time.Time, error) {
+	ingest.lock.Lock()
+	latest, exists := ingest.latest[key]
+	ingest.lock.Unlock()
+	if exists {
+		return latest, nil
+	}
+
+	latest, _, err := database.LatestEntryTime(db, key.Server, key.Station)
+	if err != nil {
+		return time.Time{}, err
+	}
+	ingest.lock.Lock()
+	defer ingest.lock.Unlock()
+	if current, exists := ingest.latest[key]; !exists || latest.After(current) {
+		ingest.latest[key] = latest
+	}
+	return ingest.latest[key], nil
+}
+
+func setLatestTime(key types.StationKey, t time.Time) {
+	ingest.lock.Lock()
+	defer ingest.lock.Unlock()
+	// Stations that haven't been loaded yet will be from the database
+	if latest, exists := ingest.latest[key]; exists && t.After(latest) {
+		ingest.latest[key] = t
+	}
+}
+
+// Ingest stores a normalised message from a station and publishes it to the
+// bus. Messages are checked against the ingest policy first, and duplicates
+// are merged into the existing entry without being published again.
+func Ingest(db *sql.DB, bus *events.Bus, server string, message types.WeatherMessage) (types.WeatherEntry, error) {
+	type result struct {
+		entry types.WeatherEntry
+		err   error
+	}
+	ingested := make(chan result, 1)
+	IngestAsync(db, bus, server, message, func(entry types.WeatherEntry, err error) {
+		ingested <- result{entry, err}
+	})
+	r := <-ingested
+	return r.entry, r.err
+}
+
+// IngestAsync is like Ingest, but only waits for the message to be checked
+// against the ingest policy. The rest happens once the writer has stored the
+// message, after which done is given what Ingest would have returned.
+func IngestAsync(db *sql.DB, bus *events.Bus, server string, message types.WeatherMessage, done func(types.WeatherEntry, error)) {
+	entry := message.ToEntry(server)
+	// Times are stored and compared in UTC
+	entry.Time = entry.Time.UTC()
+	key := entry.Key()
+	now := time.Now().UTC()
+
+	ingest.lock.Lock()
+	conf := ingest.conf
+	writer := ingest.writer
+	exporter := ingest.exporter
+	ingest.lock.Unlock()
+
+	if conf.MaxFuture > 0 && entry.Time.After(now.Add(conf.MaxFuture)) {
+		count(&ingest.stats.Future)
+		if conf.Future != "clamp" {
+			count(&ingest.stats.Rejected)
+			done(types.WeatherEntry{}, fmt.Errorf("%w: %v", ErrFuture, entry.Time))
+			return
+		}
+		count(&ingest.stats.Clamped)
+		entry.Time = now
+	}
+
+	latest, err := latestTime(db, key)
+	if err != nil {
+		done(types.WeatherEntry{}, err)
+		return
+	}
+	out_of_order := entry.Time.Before(latest)
+	if out_of_order {
+		count(&ingest.stats.OutOfOrder)
+		if conf.OutOfOrder == "reject" {
+			count(&ingest.stats.Rejected)
+			done(types.WeatherEntry{}, fmt.Errorf("%w: %v", ErrOutOfOrder, entry.Time))
+			return
+		}
+	}
+
+	storeEntries(db, writer, []types.WeatherEntry{entry}, false, func(ids []int64, created []bool, err error) {
+		if err != nil {
+			done(types.WeatherEntry{}, err)
+			return
+		}
+		entry.ID = ids[0]
+		if exporter != nil {
+			exporter.Export([]types.WeatherEntry{entry})
+		}
+		if !created[0] {
+			count(&ingest.stats.Duplicates)
+			done(entry, ErrDuplicate)
+			return
+		}
+		count(&ingest.stats.Accepted)
+		setLatestTime(key, entry.Time)
+
+		if !out_of_order || conf.OutOfOrder != "store" {
+			bus.PublishObservation(entry)
+			done(entry, nil)
+			return
+		}
+		// Stored entries aren't live, so like backfills they only update the
+		// rain totals and lightning of their past, and aren't checked for
+		// alerts
+		recomputeRain(db, key, entry.Time, entry.Time)
+		_, _, err = lightning.Record(db, entry)
+		if err != nil {
+			fmt.Printf("Unable to record lightning: %v\n", err)
+		}
+		done(entry, nil)
+	})
+}
+
+// recomputeRain rebuilds the rain totals of a station after entries were
+// stored into its past.
+func recomputeRain(db *sql.DB, key types.StationKey, from time.Time, to time.Time) {
+	loc, err := tz.StationLocation(db, key.Server, key.Station)
+	if err != nil {
+		fmt.Printf("Unable to find station time zone: %v\n", err)
+	}
+	err = rain.Recompute(db, key.Server, key.Station, from, to, loc)
+	if err != nil {
+		fmt.Printf("Unable to recompute rain: %v\n", err)
+	}
+}
+
+// BackfillResult describes what happened to the messages of a backfill.
+type BackfillResult struct {
+	// Every entry that was stored, including duplicates
+	Entries    []types.WeatherEntry
+	Duplicates int
+	Rejected   []error
+}
+
+// Backfill stores messages that stations buffered while they were offline in a
+// single transaction. Backfilled entries aren't published to the bus, as they
+// aren't live, but the rain totals and lightning that they affect are
+// recorded. Messages too far in the future are always rejected, as clamping
+// them would put them out of place.
+func Backfill(db *sql.DB, server string, messages []types.WeatherMessage) (BackfillResult, error) {
+	type backfill struct {
+		result BackfillResult
+		err    error
+	}
+	backfilled := make(chan backfill, 1)
+	BackfillAsync(db, server, messages, func(result BackfillResult, err error) {
+		backfilled <- backfill{result, err}
+	})
+	b := <-backfilled
+	return b.result, b.err
+}
+
+// BackfillAsync is like Backfill, but gives the result to done once the
+// messages have been stored instead of waiting for them.
+func BackfillAsync(db *sql.DB, server string, messages []types.WeatherMessage, done func(BackfillResult, error)) {
+	var result BackfillResult
+	now := time.Now().UTC()
+
+	ingest.lock.Lock()
+	conf := ingest.conf
+	writer := ingest.writer
+	exporter := ingest.exporter
+	ingest.lock.Unlock()
+
+	entries := make([]types.WeatherEntry, 0, len(messages))
+	for _, message := range messages {
+		entry := message.ToEntry(server)
+		entry.Time = entry.Time.UTC()
+		if conf.MaxFuture > 0 && entry.Time.After(now.Add(conf.MaxFuture)) {
+			count(&ingest.stats.Future)
+			count(&ingest.stats.Rejected)
+			result.Rejected = append(result.Rejected, fmt.Errorf("%w: %v", ErrFuture, entry.Time))
+			continue
+		}
+		entry.Backfilled = true
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		done(result, nil)
+		return
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+
+	storeEntries(db, writer, entries, true, func(ids []int64, created []bool, err error) {
+		if err != nil {
+			done(result, err)
+			return
+		}
+
+		// The span of time that each station was backfilled over
+		type span struct {
+			from time.Time
+			to   time.Time
+		}
+		spans := make(map[types.StationKey]span)
+		for i := range entries {
+			entries[i].ID = ids[i]
+			if created[i] {
+				count(&ingest.stats.Backfilled)
+			} else {
+				count(&ingest.stats.Duplicates)
+				result.Duplicates++
+			}
+			key := entries[i].Key()
+			setLatestTime(key, entries[i].Time)
+
+			current, exists := spans[key]
+			if !exists {
+				current.from = entries[i].Time
+			}
+			current.to = entries[i].Time
+			spans[key] = current
+		}
+		result.Entries = entries
+		if exporter != nil {
+			exporter.Export(entries)
+		}
+
+		for key, span := range spans {
+			recomputeRain(db, key, span.from, span.to)
+		}
+		for i, entry := range entries {
+			if !created[i] {
+				continue
+			}
+			_, _, err = lightning.Record(db, entry)
+			if err != nil {
+				fmt.Printf("Unable to record lightning: %v\n", err)
+			}
+		}
+
+		done(result, nil)
+	})
+}
+
+// IngestStationInfo stores the info of a station and publishes it to the bus.
+func IngestStationInfo(db *sql.DB, bus *events.Bus, server string, station string, message types.StationMessage) (types.StationEntry, error) {
+	info := message.ToEntry(server, station, time.Now())
+	info.Timezone = tz.Lookup(info.Latitude, info.Longitude)
+	err := database.UpdateStationInfo(db, info)
+	if err != nil {
+		return types.StationEntry{}, err
+	}
+
+	bus.PublishStationInfo(info)
+	return info, nil
+}
+
+// Process records the rain, lightning and alerts of every observation on the
+// bus.
+func Process(db *sql.DB, bus *events.Bus) {
+	bus.HandleObservations(func(entry types.WeatherEntry) {
+		loc, err := tz.StationLocation(db, entry.Server, entry.Station)
+		if err != nil {
+			fmt.Printf("Unable to find station time zone: %v\n", err)
+		}
+		err = rain.Record(db, entry, loc)
+		if err != nil {
+			fmt.Printf("Unable to record rain: %v\n", err)
+		}
+		_, _, err = lightning.Record(db, entry)
+		if err != nil {
+			fmt.Printf("Unable to record lightning: %v\n", err)
+		}
+
+		_, err = alerts.CheckEntry(db, entry)
+		if err != nil {
+			fmt.Printf("Unable to check alerts: %v\n", err)
+		}
+	})
+}
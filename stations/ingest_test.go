@@ -0,0 +1,218 @@
+package stations
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ttocsneb/weather/config"
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/events"
+	"github.com/ttocsneb/weather/types"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestIngest resets ingest to use conf on an empty database, returning the
+// entries that get published.
+func newTestIngest(t *testing.T, conf config.IngestConfig, with_writer bool) (*sql.DB, *events.Bus, *[]types.WeatherEntry) {
+	schema, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.Migrate(db, string(schema)); err != nil {
+		t.Fatal(err)
+	}
+
+	var writer *database.Writer
+	if with_writer {
+		writer, err = database.NewWriter(db, config.WriterConfig{BatchSize: 10, Queue: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go writer.Run()
+	}
+	if err := ConfigureIngest(conf, writer, nil); err != nil {
+		t.Fatal(err)
+	}
+	ingest.lock.Lock()
+	ingest.stats = IngestStats{}
+	ingest.latest = make(map[types.StationKey]time.Time)
+	ingest.lock.Unlock()
+
+	bus := events.NewBus()
+	published := []types.WeatherEntry{}
+	bus.HandleObservations(func(entry types.WeatherEntry) {
+		published = append(published, entry)
+	})
+	return db, bus, &published
+}
+
+func testMessage(t time.Time, temperature float64) types.WeatherMessage {
+	return types.WeatherMessage{
+		Time: t,
+		ID:   "station",
+		Sensors: map[string][]types.SensorValue{
+			types.SensorTemperature: {{Unit: "c", Value: temperature}},
+		},
+	}
+}
+
+func storedTimes(t *testing.T, db *sql.DB) []time.Time {
+	entries, err := database.FetchEntries(db, "ORDER BY time ASC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	times := make([]time.Time, len(entries))
+	for i, entry := range entries {
+		times[i] = entry.Time
+	}
+	return times
+}
+
+var acceptAll = config.IngestConfig{Future: "reject", OutOfOrder: "accept"}
+
+func TestIngestStoresTimesInUTC(t *testing.T) {
+	db, bus, _ := newTestIngest(t, acceptAll, false)
+	zone := time.FixedZone("+02:00", 2*60*60)
+
+	entry, err := Ingest(db, bus, "s", testMessage(time.Date(2024, 5, 1, 14, 0, 0, 0, zone), 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Time.Location() != time.UTC {
+		t.Errorf("ingested in %v", entry.Time.Location())
+	}
+	_, err = Backfill(db, "s", []types.WeatherMessage{
+		testMessage(time.Date(2024, 5, 1, 13, 0, 0, 0, zone), 19),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both are found by their time in UTC, whatever the zone they were sent in
+	for _, want := range []time.Time{
+		time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC),
+	} {
+		entries, err := database.FetchEntries(db, "WHERE time >= ? AND time < ?",
+			want.Add(-time.Minute), want.Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || !entries[0].Time.Equal(want) {
+			t.Errorf("fetched %v around %v", entries, want)
+		}
+	}
+}
+
+func TestIngestDuplicates(t *testing.T) {
+	for _, with_writer := range []bool{false, true} {
+		db, bus, published := newTestIngest(t, acceptAll, with_writer)
+		at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+		first, err := Ingest(db, bus, "s", testMessage(at, 20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := Ingest(db, bus, "s", testMessage(at, 21))
+		if !errors.Is(err, ErrDuplicate) {
+			t.Errorf("writer %v: got error %v", with_writer, err)
+		}
+		if again.ID != first.ID || first.ID == 0 {
+			t.Errorf("writer %v: duplicate has id %v, stored as %v", with_writer, again.ID, first.ID)
+		}
+		if len(*published) != 1 {
+			t.Errorf("writer %v: published %v entries", with_writer, len(*published))
+		}
+		if stats := Stats(); stats.Accepted != 1 || stats.Duplicates != 1 {
+			t.Errorf("writer %v: got stats %+v", with_writer, stats)
+		}
+	}
+}
+
+func TestIngestPolicies(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	latest := now.Add(-time.Hour)
+
+	tests := []struct {
+		name       string
+		conf       config.IngestConfig
+		time       time.Time
+		err        error
+		stored     bool
+		published  bool
+		outOfOrder uint64
+	}{
+		{"in order", acceptAll, latest.Add(time.Minute), nil, true, true, 0},
+		{"future is rejected",
+			config.IngestConfig{MaxFuture: time.Minute, Future: "reject", OutOfOrder: "accept"},
+			now.Add(time.Hour), ErrFuture, false, false, 0},
+		{"future is clamped",
+			config.IngestConfig{MaxFuture: time.Minute, Future: "clamp", OutOfOrder: "accept"},
+			now.Add(time.Hour), nil, true, true, 0},
+		{"future within the limit",
+			config.IngestConfig{MaxFuture: time.Hour, Future: "reject", OutOfOrder: "accept"},
+			now.Add(time.Minute), nil, true, true, 0},
+		{"out of order is accepted", acceptAll, latest.Add(-time.Minute), nil, true, true, 1},
+		{"out of order is stored",
+			config.IngestConfig{Future: "reject", OutOfOrder: "store"},
+			latest.Add(-time.Minute), nil, true, false, 1},
+		{"out of order is rejected",
+			config.IngestConfig{Future: "reject", OutOfOrder: "reject"},
+			latest.Add(-time.Minute), ErrOutOfOrder, false, false, 1},
+	}
+
+	for _, test := range tests {
+		db, bus, published := newTestIngest(t, test.conf, false)
+		if _, err := Ingest(db, bus, "s", testMessage(latest, 20)); err != nil {
+			t.Fatal(err)
+		}
+
+		entry, err := Ingest(db, bus, "s", testMessage(test.time, 21))
+		if !errors.Is(err, test.err) {
+			t.Errorf("%v: got error %v", test.name, err)
+		}
+		if Rejected(err) != (test.err != nil) {
+			t.Errorf("%v: rejected is %v", test.name, Rejected(err))
+		}
+
+		times := storedTimes(t, db)
+		if test.stored != (len(times) == 2) {
+			t.Errorf("%v: stored %v", test.name, times)
+		}
+		if test.published != (len(*published) == 2) {
+			t.Errorf("%v: published %v", test.name, *published)
+		}
+		if stats := Stats(); stats.OutOfOrder != test.outOfOrder {
+			t.Errorf("%v: counted %v out of order", test.name, stats.OutOfOrder)
+		}
+		if !test.stored {
+			continue
+		}
+
+		want := test.time
+		if test.conf.Future == "clamp" {
+			// Clamped to the time it was ingested at
+			if entry.Time.Before(now) || entry.Time.After(time.Now()) {
+				t.Errorf("%v: clamped to %v", test.name, entry.Time)
+			}
+			want = entry.Time
+		}
+		found := false
+		for _, stored := range times {
+			found = found || stored.Equal(want)
+		}
+		if !found {
+			t.Errorf("%v: stored %v, want %v", test.name, times, want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package stations
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ttocsneb/weather/config"
+)
+
+const stationPlaceholder = "{station}"
+
+// Topic is a topic template where one of the levels may be the id of a
+// station.
+type Topic struct {
+	levels []string
+	// The level of the station's id, or -1 if there isn't one
+	station int
+}
+
+func ParseTopic(prefix string, template string) (Topic, error) {
+	if prefix != "" {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if !strings.HasPrefix(template, "/") {
+			prefix += "/"
+		}
+		template = prefix + template
+	}
+
+	self := Topic{
+		levels:  strings.Split(template, "/"),
+		station: -1,
+	}
+	for i, level := range self.levels {
+		switch {
+		case level == stationPlaceholder:
+			if self.station >= 0 {
+				return self, fmt.Errorf("%v has more than one station", template)
+			}
+			self.station = i
+		case level == "+":
+		case level == "#":
+			if i != len(self.levels)-1 {
+				return self, fmt.Errorf("# must be the last level of %v", template)
+			}
+		case strings.ContainsAny(level, "+#{}"):
+			return self, fmt.Errorf("Invalid level %v in %v", level, template)
+		}
+	}
+	return self, nil
+}
+
+// Subscription is the topic that matches every station.
+func (self Topic) Subscription() string {
+	return self.Format("+")
+}
+
+// Format fills in the id of a station.
+func (self Topic) Format(station string) string {
+	levels := append([]string{}, self.levels...)
+	if self.station >= 0 {
+		levels[self.station] = station
+	}
+	return strings.Join(levels, "/")
+}
+
+// HasWildcards checks if the topic can only be subscribed to, as it can't be
+// published to.
+func (self Topic) HasWildcards() bool {
+	for _, level := range self.levels {
+		if level == "+" || level == "#" {
+			return true
+		}
+	}
+	return false
+}
+
+// Station finds the id of the station in a topic that matches the template.
+func (self Topic) Station(topic string) (string, bool) {
+	if self.station < 0 {
+		return "", false
+	}
+	levels := strings.Split(topic, "/")
+	for i, level := range self.levels {
+		if level == "#" {
+			break
+		}
+		if i >= len(levels) {
+			return "", false
+		}
+		if level != "+" && i != self.station && level != levels[i] {
+			return "", false
+		}
+	}
+	if self.station >= len(levels) || levels[self.station] == "" {
+		return "", false
+	}
+	return levels[self.station], true
+}
+
+// Topics are the templates of every topic that a broker uses.
+type Topics struct {
+	Weather      Topic
+	Info         Topic
+	Request      Topic
+	RapidWeather Topic
+	// May be nil if backfills aren't accepted
+	Backfill *Topic
+	// The shared subscription group of weather and backfills, if any
+	Share string
+}
+
+func (self Topics) shared(topic Topic) string {
+	if self.Share == "" {
+		return topic.Subscription()
+	}
+	return "$share/" + self.Share + "/" + topic.Subscription()
+}
+
+// WeatherSubscription is the topic subscribed to for the weather of every
+// station.
+func (self Topics) WeatherSubscription() string {
+	return self.shared(self.Weather)
+}
+
+func (self Topics) BackfillSubscription() string {
+	return self.shared(*self.Backfill)
+}
+
+func ParseTopics(conf config.BrokerConfig) (Topics, error) {
+	var topics Topics
+	var err error
+	if topics.Weather, err = ParseTopic(conf.Prefix, conf.Topics.Weather); err != nil {
+		return topics, err
+	}
+	if topics.Info, err = ParseTopic(conf.Prefix, conf.Topics.Info); err != nil {
+		return topics, err
+	}
+	if topics.Request, err = ParseTopic(conf.Prefix, conf.Topics.Request); err != nil {
+		return topics, err
+	}
+	if topics.RapidWeather, err = ParseTopic(conf.Prefix, conf.Topics.RapidWeather); err != nil {
+		return topics, err
+	}
+	if conf.Topics.Backfill != "" {
+		backfill, err := ParseTopic(conf.Prefix, conf.Topics.Backfill)
+		if err != nil {
+			return topics, err
+		}
+		topics.Backfill = &backfill
+	}
+	if topics.Request.HasWildcards() {
+		return topics, fmt.Errorf("The request topic can't have wildcards")
+	}
+	if strings.ContainsAny(conf.ShareGroup, "/+#") {
+		return topics, fmt.Errorf("Invalid share group %v", conf.ShareGroup)
+	}
+	topics.Share = conf.ShareGroup
+	return topics, nil
+}
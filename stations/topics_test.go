@@ -0,0 +1,149 @@
+package stations
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ttocsneb/weather/config"
+)
+
+func TestParseTopic(t *testing.T) {
+	tests := []struct {
+		prefix       string
+		template     string
+		subscription string
+		formatted    string
+		wildcards    bool
+		err          bool
+	}{
+		{"", "/station/weather/{station}", "/station/weather/+", "/station/weather/abc", false, false},
+		{"home", "/station/{station}/weather", "home/station/+/weather", "home/station/abc/weather", false, false},
+		{"home/", "station/{station}", "home/station/+", "home/station/abc", false, false},
+		{"", "weather/+/{station}", "weather/+/+", "weather/+/abc", true, false},
+		{"", "weather/{station}/#", "weather/+/#", "weather/abc/#", true, false},
+		{"", "weather/info", "weather/info", "weather/info", false, false},
+		{"", "weather/{station}/{station}", "", "", false, true},
+		{"", "weather/#/{station}", "", "", false, true},
+		{"", "weather/st+/{station}", "", "", false, true},
+		{"", "weather/{id}", "", "", false, true},
+	}
+
+	for _, test := range tests {
+		topic, err := ParseTopic(test.prefix, test.template)
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: expected an error", test.template)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.template, err)
+			continue
+		}
+		if topic.Subscription() != test.subscription {
+			t.Errorf("%v: subscription %v, want %v", test.template,
+				topic.Subscription(), test.subscription)
+		}
+		if topic.Format("abc") != test.formatted {
+			t.Errorf("%v: formatted %v, want %v", test.template,
+				topic.Format("abc"), test.formatted)
+		}
+		if topic.HasWildcards() != test.wildcards {
+			t.Errorf("%v: wildcards %v, want %v", test.template,
+				topic.HasWildcards(), test.wildcards)
+		}
+	}
+}
+
+func TestTopicStation(t *testing.T) {
+	tests := []struct {
+		template string
+		topic    string
+		station  string
+		ok       bool
+	}{
+		{"/station/weather/{station}", "/station/weather/abc", "abc", true},
+		{"/station/weather/{station}", "/station/info/abc", "", false},
+		{"/station/weather/{station}", "/station/weather", "", false},
+		{"/station/weather/{station}", "/station/weather/", "", false},
+		{"home/{station}/weather", "home/abc/weather", "abc", true},
+		{"home/{station}/weather", "home/abc/rain", "", false},
+		{"+/{station}/weather", "anything/abc/weather", "abc", true},
+		{"weather/{station}/#", "weather/abc/outdoor/temperature", "abc", true},
+		{"weather/info", "weather/info", "", false},
+	}
+
+	for _, test := range tests {
+		topic, err := ParseTopic("", test.template)
+		if err != nil {
+			t.Fatalf("%v: %v", test.template, err)
+		}
+		station, ok := topic.Station(test.topic)
+		if station != test.station || ok != test.ok {
+			t.Errorf("%v in %v: got %v, %v, want %v, %v", test.topic,
+				test.template, station, ok, test.station, test.ok)
+		}
+	}
+}
+
+func TestParseTopics(t *testing.T) {
+	conf := config.DefaultBrokerConfig()
+	conf.Prefix = "home"
+	topics, err := ParseTopics(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every topic is under the prefix
+	for _, topic := range []Topic{topics.Weather, topics.Info, topics.Request, topics.RapidWeather} {
+		if formatted := topic.Format("abc"); !strings.HasPrefix(formatted, "home/station/") {
+			t.Errorf("%v isn't under the prefix", formatted)
+		}
+	}
+	if topics.WeatherSubscription() != "home/station/weather/+" {
+		t.Errorf("subscribed to %v", topics.WeatherSubscription())
+	}
+
+	// Requests are published, so they must name a single station
+	conf.Topics.Request = "station/+/request/{station}"
+	if _, err := ParseTopics(conf); err == nil {
+		t.Errorf("a request topic with wildcards was accepted")
+	}
+	conf.Topics.Request = "station/request/{station}/{station}"
+	if _, err := ParseTopics(conf); err == nil {
+		t.Errorf("an invalid request topic was accepted")
+	}
+}
+
+func TestRequestPayload(t *testing.T) {
+	broker := Broker{conf: config.DefaultBrokerConfig()}
+	if payload := string(broker.requestPayload("abc", "rapid-weather")); payload != `{"action":"rapid-weather"}` {
+		t.Errorf("got %v", payload)
+	}
+	broker.conf.RequestPayload = "{action} {station} {action}"
+	if payload := string(broker.requestPayload("abc", "info")); payload != "info abc info" {
+		t.Errorf("got %v", payload)
+	}
+}
+
+func TestSharedSubscriptions(t *testing.T) {
+	conf := config.DefaultBrokerConfig()
+	conf.ShareGroup = "weather"
+	topics, err := ParseTopics(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub := topics.WeatherSubscription(); sub != "$share/weather//station/weather/+" {
+		t.Errorf("subscribed to %v", sub)
+	}
+	// Only weather and backfills are shared, as every instance needs the rest
+	if sub := topics.Info.Subscription(); sub != "/station/info/+" {
+		t.Errorf("subscribed to %v", sub)
+	}
+
+	for _, group := range []string{"a/b", "+", "#"} {
+		conf.ShareGroup = group
+		if _, err := ParseTopics(conf); err == nil {
+			t.Errorf("share group %v was accepted", group)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package types
+
+import "time"
+
+const (
+	AlertScopeStation = "station"
+	AlertScopeRadius  = "radius"
+	AlertScopeRegion  = "region"
+)
+
+type AlertRule struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Sensor    string    `json:"sensor"`
+	Operator  string    `json:"operator"`
+	Threshold float64   `json:"threshold"`
+	Unit      string    `json:"unit"`
+	Scope     string    `json:"scope"`
+	Server    string    `json:"server"`
+	Station   string    `json:"station"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Range     float64   `json:"range"`
+	District  string    `json:"district"`
+	City      string    `json:"city"`
+	Region    string    `json:"region"`
+	Country   string    `json:"country"`
+	Enabled   bool      `json:"enabled"`
+	Created   time.Time `json:"created"`
+}
+
+type AlertEvent struct {
+	ID      int64     `json:"id"`
+	Rule    int64     `json:"rule"`
+	Server  string    `json:"server"`
+	Station string    `json:"station"`
+	Time    time.Time `json:"time"`
+	Firing  bool      `json:"firing"`
+	Value   float64   `json:"value"`
+	Unit    string    `json:"unit"`
+}
+
+type ActiveAlert struct {
+	Rule    int64     `json:"rule"`
+	Server  string    `json:"server"`
+	Station string    `json:"station"`
+	Since   time.Time `json:"since"`
+	Value   float64   `json:"value"`
+	Unit    string    `json:"unit"`
+}
@@ -0,0 +1,13 @@
+package types
+
+import "time"
+
+type LightningStrike struct {
+	ID      int64     `json:"id"`
+	Server  string    `json:"server"`
+	Station string    `json:"station"`
+	Time    time.Time `json:"time"`
+	Count   int       `json:"count"`
+	// Estimated distance to the strike in km, if the station reported one
+	Distance *float64 `json:"distance"`
+}
@@ -0,0 +1,102 @@
+package types
+
+import "time"
+
+// Names of the sensors that the server knows how to interpret.
+const (
+	SensorTemperature   = "temperature"
+	SensorHumidity      = "humidity"
+	SensorPressure      = "pressure"
+	SensorWindSpeed     = "wind-speed"
+	SensorWindDirection = "wind-direction"
+	SensorWindGust      = "wind-gust"
+	SensorDewPoint      = "dew-point"
+	SensorUV            = "uv"
+
+	// Pressure reduced to sea level by the station, rather than measured at it
+	SensorSeaLevelPressure = "sea-level-pressure"
+
+	SensorIndoorTemperature = "indoor-temperature"
+	SensorIndoorHumidity    = "indoor-humidity"
+
+	// Rain since the previous message
+	SensorRain = "rain"
+	// Rain counter which only resets when the station does
+	SensorRainCounter = "rain-counter"
+	// Rain since the station's midnight
+	SensorRainDaily = "rain-daily"
+
+	SensorRainRate  = "rain-rate"
+	SensorRainHour  = "rain-hour"
+	SensorRain24h   = "rain-24h"
+	SensorRainToday = "rain-today"
+	SensorRainStorm = "rain-storm"
+	SensorRainMonth = "rain-month"
+	SensorRainYear  = "rain-year"
+
+	SensorSolarRadiation = "solar-radiation"
+
+	// Irradiance expected under a cloudless sky
+	SensorSolarClearSky = "solar-clear-sky"
+	// Ratio of the measured to the clear-sky irradiance
+	SensorClearSkyIndex = "clear-sky-index"
+	SensorCloudCover    = "cloud-cover"
+
+	// Particulate matter concentrations
+	SensorPM1  = "pm1"
+	SensorPM25 = "pm2.5"
+	SensorPM10 = "pm10"
+	SensorCO2  = "co2"
+
+	// US EPA air quality index, which is the worst of the pollutants' indices
+	SensorAQI     = "aqi"
+	SensorAQIPM25 = "aqi-pm2.5"
+	SensorAQIPM10 = "aqi-pm10"
+	// European common air quality index
+	SensorCAQI = "caqi"
+
+	// Lightning strikes since the previous message
+	SensorLightning = "lightning"
+	// Lightning strike counter which only resets when the station does
+	SensorLightningCounter = "lightning-counter"
+	// Estimated distance to the most recent strike
+	SensorLightningDistance = "lightning-distance"
+)
+
+// The units that sensors are stored in once they have been normalised
+var MetricUnits = map[string]string{
+	SensorTemperature:       "c",
+	SensorHumidity:          "%",
+	SensorPressure:          "hpa",
+	SensorSeaLevelPressure:  "hpa",
+	SensorWindSpeed:         "mps",
+	SensorWindDirection:     "deg",
+	SensorWindGust:          "mps",
+	SensorDewPoint:          "c",
+	SensorUV:                "uv",
+	SensorIndoorTemperature: "c",
+	SensorIndoorHumidity:    "%",
+	SensorRain:              "mm",
+	SensorRainCounter:       "mm",
+	SensorRainDaily:         "mm",
+	SensorRainRate:          "mm/h",
+	SensorRainHour:          "mm",
+	SensorRain24h:           "mm",
+	SensorRainToday:         "mm",
+	SensorRainStorm:         "mm",
+	SensorRainMonth:         "mm",
+	SensorRainYear:          "mm",
+	SensorSolarRadiation:    "w/m2",
+	SensorSolarClearSky:     "w/m2",
+	SensorPM1:               "ug/m3",
+	SensorPM25:              "ug/m3",
+	SensorPM10:              "ug/m3",
+	SensorCO2:               "ppm",
+	SensorLightningDistance: "km",
+}
+
+type SensorSeries struct {
+	Unit   string
+	Times  []time.Time
+	Values []float64
+}
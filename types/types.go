@@ -13,6 +13,8 @@ type StationKey struct {
 type SensorValue struct {
 	Unit  string  `json:"unit"`
 	Value float64 `json:"value"`
+	// A description of the value, such as the category of an air quality index
+	Label string `json:"label,omitempty"`
 }
 
 type WeatherMessage struct {
@@ -22,10 +24,13 @@ type WeatherMessage struct {
 }
 
 type WeatherEntry struct {
+	ID      int64                    `json:"-"`
 	Station string                   `json:"station"`
 	Server  string                   `json:"server"`
 	Time    time.Time                `json:"time"`
 	Sensors map[string][]SensorValue `json:"sensors"`
+	// The entry was uploaded after the fact by a station that was offline
+	Backfilled bool `json:"backfilled,omitempty"`
 }
 
 func (self *WeatherMessage) ToEntry(server string) WeatherEntry {
@@ -41,6 +46,10 @@ func (self *WeatherEntry) MapId() string {
 	return MapId(self.Server, self.Station)
 }
 
+func (self *WeatherEntry) Key() StationKey {
+	return StationKey{Server: self.Server, Station: self.Station}
+}
+
 type StationMessage struct {
 	Make         string  `json:"make"`
 	Model        string  `json:"model"`
@@ -71,6 +80,7 @@ type StationEntry struct {
 	Region       string    `json:"region"`
 	Country      string    `json:"country"`
 	RapidWeather bool      `json:"rapidWeather"`
+	Timezone     string    `json:"timezone"`
 	Updated      time.Time `json:"updated"`
 }
 
@@ -78,6 +88,10 @@ func (self *StationEntry) MapId() string {
 	return MapId(self.Server, self.Station)
 }
 
+func (self *StationEntry) Key() StationKey {
+	return StationKey{Server: self.Server, Station: self.Station}
+}
+
 func MapId(server string, station string) string {
 	return fmt.Sprintf("%v-%v", server, station)
 }
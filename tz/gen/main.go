@@ -0,0 +1,265 @@
+//go:build ignore
+
+// Generates boundaries.bin.gz from the time zone boundaries of
+// timezone-boundary-builder, as distributed by tzf-rel-lite
+// (combined-with-oceans.reduce.bin). The boundaries are simplified and
+// quantized so that they are small enough to embed.
+//
+//	go run gen/main.go combined-with-oceans.reduce.bin
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+)
+
+// Boundaries are simplified to within this many degrees, about 500m
+const tolerance = 0.005
+
+// Coordinates are stored in thousandths of a degree
+const scale = 1e3
+
+type point struct {
+	lng float64
+	lat float64
+}
+
+type zone struct {
+	name     string
+	polygons [][][]point
+}
+
+// field is a protobuf field of the wire format
+type field struct {
+	number int
+	value  uint64
+	bytes  []byte
+}
+
+func fields(data []byte) ([]field, error) {
+	result := []field{}
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid key")
+		}
+		data = data[n:]
+		f := field{number: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			f.value, n = binary.Uvarint(data)
+			if n <= 0 {
+				return nil, fmt.Errorf("invalid varint")
+			}
+			data = data[n:]
+		case 1:
+			f.value = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return nil, fmt.Errorf("invalid length")
+			}
+			f.bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case 5:
+			f.value = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		default:
+			return nil, fmt.Errorf("unsupported wire type %v", key&7)
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+// parsePolygon reads a Polygon {1: repeated Point, 2: repeated Polygon} as
+// its outer ring followed by its holes.
+func parsePolygon(data []byte) ([][]point, error) {
+	fs, err := fields(data)
+	if err != nil {
+		return nil, err
+	}
+	rings := [][]point{{}}
+	for _, f := range fs {
+		switch f.number {
+		case 1:
+			pfs, err := fields(f.bytes)
+			if err != nil {
+				return nil, err
+			}
+			var p point
+			for _, pf := range pfs {
+				value := float64(math.Float32frombits(uint32(pf.value)))
+				if pf.number == 1 {
+					p.lng = value
+				} else if pf.number == 2 {
+					p.lat = value
+				}
+			}
+			rings[0] = append(rings[0], p)
+		case 2:
+			hole, err := parsePolygon(f.bytes)
+			if err != nil {
+				return nil, err
+			}
+			rings = append(rings, hole[0])
+		}
+	}
+	return rings, nil
+}
+
+func parse(data []byte) ([]zone, string, error) {
+	fs, err := fields(data)
+	if err != nil {
+		return nil, "", err
+	}
+	zones := []zone{}
+	version := ""
+	for _, f := range fs {
+		switch f.number {
+		case 1:
+			zfs, err := fields(f.bytes)
+			if err != nil {
+				return nil, "", err
+			}
+			var z zone
+			for _, zf := range zfs {
+				switch zf.number {
+				case 1:
+					rings, err := parsePolygon(zf.bytes)
+					if err != nil {
+						return nil, "", err
+					}
+					z.polygons = append(z.polygons, rings)
+				case 2:
+					z.name = string(zf.bytes)
+				}
+			}
+			zones = append(zones, z)
+		case 3:
+			version = string(f.bytes)
+		}
+	}
+	return zones, version, nil
+}
+
+// simplify reduces a ring with the Douglas-Peucker algorithm.
+func simplify(ring []point) []point {
+	if len(ring) < 3 {
+		return ring
+	}
+	keep := make([]bool, len(ring))
+	keep[0] = true
+	keep[len(ring)-1] = true
+	stack := [][2]int{{0, len(ring) - 1}}
+	for len(stack) > 0 {
+		a, b := stack[len(stack)-1][0], stack[len(stack)-1][1]
+		stack = stack[:len(stack)-1]
+
+		dx := ring[b].lng - ring[a].lng
+		dy := ring[b].lat - ring[a].lat
+		length := dx*dx + dy*dy
+		best, index := -1.0, -1
+		for i := a + 1; i < b; i++ {
+			px := ring[i].lng - ring[a].lng
+			py := ring[i].lat - ring[a].lat
+			if length > 0 {
+				t := math.Max(0, math.Min(1, (px*dx+py*dy)/length))
+				px -= t * dx
+				py -= t * dy
+			}
+			if d := px*px + py*py; d > best {
+				best, index = d, i
+			}
+		}
+		if best > tolerance*tolerance {
+			keep[index] = true
+			stack = append(stack, [2]int{a, index}, [2]int{index, b})
+		}
+	}
+
+	result := []point{}
+	for i, p := range ring {
+		if keep[i] {
+			result = append(result, p)
+		}
+	}
+	// Small islands would disappear entirely
+	if len(result) < 4 {
+		return ring
+	}
+	return result
+}
+
+func quantize(ring []point) [][2]int64 {
+	result := [][2]int64{}
+	for _, p := range ring {
+		q := [2]int64{int64(math.Round(p.lng * scale)), int64(math.Round(p.lat * scale))}
+		if len(result) > 0 && result[len(result)-1] == q {
+			continue
+		}
+		result = append(result, q)
+	}
+	return result
+}
+
+func encode(zones []zone) []byte {
+	out := []byte{}
+	out = binary.AppendUvarint(out, uint64(len(zones)))
+	for _, z := range zones {
+		out = binary.AppendUvarint(out, uint64(len(z.name)))
+		out = append(out, z.name...)
+		out = binary.AppendUvarint(out, uint64(len(z.polygons)))
+		for _, rings := range z.polygons {
+			out = binary.AppendUvarint(out, uint64(len(rings)))
+			for _, ring := range rings {
+				points := quantize(simplify(ring))
+				out = binary.AppendUvarint(out, uint64(len(points)))
+				var last [2]int64
+				for _, p := range points {
+					out = binary.AppendVarint(out, p[0]-last[0])
+					out = binary.AppendVarint(out, p[1]-last[1])
+					last = p
+				}
+			}
+		}
+	}
+	return out
+}
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Println("usage: go run gen/main.go combined-with-oceans.reduce.bin")
+		os.Exit(1)
+	}
+	data, err := os.ReadFile(os.Args[1])
+	if err != nil {
+		panic(err)
+	}
+	zones, version, err := parse(data)
+	if err != nil {
+		panic(err)
+	}
+
+	file, err := os.Create("boundaries.bin.gz")
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	writer, err := gzip.NewWriterLevel(file, gzip.BestCompression)
+	if err != nil {
+		panic(err)
+	}
+	writer.Comment = "timezone-boundary-builder " + version
+	if _, err := writer.Write(encode(zones)); err != nil {
+		panic(err)
+	}
+	if err := writer.Close(); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Wrote %v zones from %v\n", len(zones), version)
+}
@@ -0,0 +1,286 @@
+package tz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	_ "embed"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/ttocsneb/weather/database"
+	"github.com/ttocsneb/weather/util"
+)
+
+// The boundaries of every time zone from timezone-boundary-builder,
+// simplified to within about 500m by gen/main.go. The boundaries are licensed
+// under the ODbL, see BOUNDARIES_LICENSE.
+//
+//go:embed boundaries.bin.gz
+var boundariesData []byte
+
+type polygon struct {
+	zone string
+	// The outer ring followed by its holes, as alternating longitudes and
+	// latitudes in thousandths of a degree
+	rings [][]int32
+	// The bounding box of the outer ring
+	minLng, minLat, maxLng, maxLat int32
+}
+
+var (
+	polygons []polygon
+	// Indices of the polygons whose bounding boxes overlap each square degree
+	grid         [180][360][]int32
+	polygonsOnce sync.Once
+
+	locations     = make(map[string]*time.Location)
+	locationsLock sync.Mutex
+)
+
+const boundaryScale = 1e3
+
+func loadPolygons() {
+	reader, err := gzip.NewReader(bytes.NewReader(boundariesData))
+	if err != nil {
+		panic(err)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		panic(err)
+	}
+	buf := bytes.NewReader(data)
+	uvarint := func() int {
+		v, err := binary.ReadUvarint(buf)
+		if err != nil {
+			panic(err)
+		}
+		return int(v)
+	}
+	varint := func() int32 {
+		v, err := binary.ReadVarint(buf)
+		if err != nil {
+			panic(err)
+		}
+		return int32(v)
+	}
+
+	zones := uvarint()
+	for i := 0; i < zones; i++ {
+		name := make([]byte, uvarint())
+		if _, err := io.ReadFull(buf, name); err != nil {
+			panic(err)
+		}
+		count := uvarint()
+		for j := 0; j < count; j++ {
+			p := polygon{zone: string(name)}
+			rings := uvarint()
+			for k := 0; k < rings; k++ {
+				points := uvarint()
+				ring := make([]int32, points*2)
+				var lng, lat int32
+				for l := 0; l < points; l++ {
+					lng += varint()
+					lat += varint()
+					ring[l*2] = lng
+					ring[l*2+1] = lat
+				}
+				p.rings = append(p.rings, ring)
+			}
+			p.minLng, p.minLat = math.MaxInt32, math.MaxInt32
+			p.maxLng, p.maxLat = math.MinInt32, math.MinInt32
+			outer := p.rings[0]
+			for l := 0; l < len(outer); l += 2 {
+				p.minLng = min(p.minLng, outer[l])
+				p.maxLng = max(p.maxLng, outer[l])
+				p.minLat = min(p.minLat, outer[l+1])
+				p.maxLat = max(p.maxLat, outer[l+1])
+			}
+			polygons = append(polygons, p)
+		}
+	}
+
+	for i, p := range polygons {
+		for lat := gridLat(p.minLat); lat <= gridLat(p.maxLat); lat++ {
+			for lng := gridLng(p.minLng); lng <= gridLng(p.maxLng); lng++ {
+				grid[lat][lng] = append(grid[lat][lng], int32(i))
+			}
+		}
+	}
+}
+
+func gridLat(lat int32) int {
+	return max(0, min(179, int(math.Floor(float64(lat)/boundaryScale))+90))
+}
+
+func gridLng(lng int32) int {
+	return max(0, min(359, int(math.Floor(float64(lng)/boundaryScale))+180))
+}
+
+// inRing tests whether a point is inside of a ring by casting a ray from it.
+func inRing(ring []int32, lng float64, lat float64) bool {
+	inside := false
+	n := len(ring) / 2
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		x1, y1 := float64(ring[i*2]), float64(ring[i*2+1])
+		x2, y2 := float64(ring[j*2]), float64(ring[j*2+1])
+		if (y1 > lat) != (y2 > lat) && lng < (x2-x1)*(lat-y1)/(y2-y1)+x1 {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func (self *polygon) contains(lng float64, lat float64) bool {
+	if !inRing(self.rings[0], lng, lat) {
+		return false
+	}
+	for _, hole := range self.rings[1:] {
+		if inRing(hole, lng, lat) {
+			return false
+		}
+	}
+	return true
+}
+
+// distance finds the squared distance from a point to the closest edge of
+// the polygon's outer ring, in scaled degrees.
+func (self *polygon) distance(lng float64, lat float64) float64 {
+	closest := math.Inf(1)
+	ring := self.rings[0]
+	n := len(ring) / 2
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		x1, y1 := float64(ring[j*2]), float64(ring[j*2+1])
+		dx, dy := float64(ring[i*2])-x1, float64(ring[i*2+1])-y1
+		px, py := lng-x1, lat-y1
+		if length := dx*dx + dy*dy; length > 0 {
+			t := math.Max(0, math.Min(1, (px*dx+py*dy)/length))
+			px -= t * dx
+			py -= t * dy
+		}
+		closest = math.Min(closest, px*px+py*py)
+	}
+	return closest
+}
+
+// Lookup finds the IANA time zone of a location.
+func Lookup(latitude float64, longitude float64) string {
+	if latitude == 0 && longitude == 0 {
+		// The station hasn't said where it is
+		return "UTC"
+	}
+
+	polygonsOnce.Do(loadPolygons)
+
+	longitude = util.ModBounds(longitude+180, 360) - 180
+	lng := longitude * boundaryScale
+	lat := latitude * boundaryScale
+	row := gridLat(int32(math.Floor(lat)))
+	col := gridLng(int32(math.Floor(lng)))
+
+	for _, i := range grid[row][col] {
+		p := &polygons[i]
+		if lng < float64(p.minLng) || lng > float64(p.maxLng) ||
+			lat < float64(p.minLat) || lat > float64(p.maxLat) {
+			continue
+		}
+		if p.contains(lng, lat) {
+			return p.zone
+		}
+	}
+
+	// Simplifying the boundaries leaves slivers between some zones, which
+	// belong to the closest one
+	closest := ""
+	closest_dist := math.Inf(1)
+	for r := max(0, row-1); r <= min(179, row+1); r++ {
+		for c := max(0, col-1); c <= min(359, col+1); c++ {
+			for _, i := range grid[r][c] {
+				if d := polygons[i].distance(lng, lat); d < closest_dist {
+					closest_dist = d
+					closest = polygons[i].zone
+				}
+			}
+		}
+	}
+	if closest != "" {
+		return closest
+	}
+
+	// Every part of the world is covered, even the oceans, so this should
+	// never happen
+	offset := int(math.Round(longitude / 15))
+	switch {
+	case offset == 0:
+		return "Etc/GMT"
+	case offset > 0:
+		// The Etc zones have their signs inverted
+		return fmt.Sprintf("Etc/GMT-%v", offset)
+	default:
+		return fmt.Sprintf("Etc/GMT+%v", -offset)
+	}
+}
+
+// Location loads a time zone by name, falling back to UTC if it is unknown.
+func Location(name string) *time.Location {
+	if name == "" {
+		return time.UTC
+	}
+
+	locationsLock.Lock()
+	defer locationsLock.Unlock()
+
+	loc, exists := locations[name]
+	if exists {
+		return loc
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		fmt.Printf("Could not load time zone %v: %v\n", name, err)
+		loc = time.UTC
+	}
+	locations[name] = loc
+	return loc
+}
+
+// StationLocation finds the time zone of a station, or UTC if the station is
+// unknown.
+func StationLocation(db *sql.DB, server string, station string) (*time.Location, error) {
+	info, exists, err := database.FetchStationInfo(db, server, station)
+	if err != nil || !exists {
+		return time.UTC, err
+	}
+	if info.Timezone == "" {
+		return Location(Lookup(info.Latitude, info.Longitude)), nil
+	}
+	return Location(info.Timezone), nil
+}
+
+// UpdateTimezones looks up the time zones of all stations again, for stations
+// stored without one or with one found by an older version of Lookup.
+func UpdateTimezones(db *sql.DB) (int64, error) {
+	stations, err := database.QueryStationInfos(db, "")
+	if err != nil {
+		return 0, err
+	}
+
+	updated := int64(0)
+	for _, info := range stations {
+		timezone := Lookup(info.Latitude, info.Longitude)
+		if timezone == info.Timezone {
+			continue
+		}
+		info.Timezone = timezone
+		if err := database.UpdateStationInfo(db, info); err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, nil
+}
@@ -17,6 +17,9 @@ func SensorToMetric(value float64, unit string, sensor_hint string) (float64, st
 		value = value / 2.236936
 	case "mps", "m/s":
 		unit = "mps"
+	case "km/h", "kph", "kmh":
+		unit = "mps"
+		value = value / 3.6
 	case "c":
 		unit = "c"
 	case "f":
@@ -24,9 +27,14 @@ func SensorToMetric(value float64, unit string, sensor_hint string) (float64, st
 		value = (value - 32) * 5.0 / 9.0
 	case "in":
 		unit = "mm"
-		value = value / 25.4
+		value = value * 25.4
 	case "mm":
 		unit = "mm"
+	case "in/h", "in/hr", "iph":
+		unit = "mm/h"
+		value = value * 25.4
+	case "mm/h", "mm/hr":
+		unit = "mm/h"
 	case "nm":
 		unit = "km"
 		value = value * 1.852
@@ -50,6 +58,24 @@ func SensorToMetric(value float64, unit string, sensor_hint string) (float64, st
 	case "rad":
 		unit = "deg"
 		value = value * 180.0 / math.Pi
+	case "w/m2", "w/m^2", "w/m²", "wm2":
+		unit = "w/m2"
+	case "ug/m3", "µg/m3", "μg/m3", "µg/m³", "μg/m³", "ug/m^3":
+		unit = "ug/m3"
+	case "mg/m3", "mg/m³", "mg/m^3":
+		unit = "ug/m3"
+		value = value * 1000
+	case "ppm":
+		unit = "ppm"
+	case "ppb":
+		unit = "ppm"
+		value = value / 1000
+	case "lux", "lx":
+		if sensor_hint == "solar-radiation" {
+			// Approximate luminous efficacy of sunlight
+			unit = "w/m2"
+			value = value / 126.7
+		}
 	}
 	return value, unit
 }
@@ -60,6 +86,9 @@ func SensorToImperial(value float64, unit string, sensor_hint string) (float64,
 	case "m/s", "mps":
 		unit = "mph"
 		value = value * 2.236936
+	case "km/h", "kph", "kmh":
+		unit = "mph"
+		value = value / 1.609344
 	case "c":
 		unit = "f"
 		value = value*9.0/5.0 + 32
@@ -69,7 +98,12 @@ func SensorToImperial(value float64, unit string, sensor_hint string) (float64,
 		unit = "in"
 	case "mm":
 		unit = "in"
-		value = value * 25.4
+		value = value / 25.4
+	case "in/h", "in/hr", "iph":
+		unit = "in/h"
+	case "mm/h", "mm/hr":
+		unit = "in/h"
+		value = value / 25.4
 	case "nm":
 		unit = "nm"
 	case "mi":
@@ -92,6 +126,12 @@ func SensorToImperial(value float64, unit string, sensor_hint string) (float64,
 	case "rad":
 		unit = "deg"
 		value = value * 180.0 / math.Pi
+	case "w/m2", "w/m^2", "w/m²", "wm2":
+		unit = "w/m2"
+	case "ug/m3", "µg/m3", "μg/m3", "µg/m³", "μg/m³", "ug/m^3":
+		unit = "ug/m3"
+	case "ppm":
+		unit = "ppm"
 	}
 	return value, unit
 }